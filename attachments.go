@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"maunium.net/go/mautrix/event"
+
+	"imap-bridge/pkg/emailmeow"
+)
+
+var (
+	errAttachmentTooLarge       = errors.New("attachment is too large")
+	errAttachmentDownloadFailed = errors.New("failed to download attachment")
+)
+
+// isMediaMessage returns true if the content has a file that should be
+// attached to the email.
+func isMediaMessage(content *event.MessageEventContent) bool {
+	if content.URL == "" && content.File == nil {
+		return false
+	}
+	switch content.MsgType {
+	case event.MsgImage, event.MsgFile, event.MsgAudio, event.MsgVideo, "":
+		// Stickers don't have a msgtype
+		return true
+	default:
+		return false
+	}
+}
+
+// mediaCaption returns the caption of a media message, or an empty string if
+// the body is just the file name.
+func mediaCaption(content *event.MessageEventContent) string {
+	if content.FileName != "" && content.Body != content.FileName {
+		return content.Body
+	}
+	return ""
+}
+
+func mediaFilename(content *event.MessageEventContent, mimeType string) string {
+	if content.FileName != "" {
+		return content.FileName
+	} else if content.Body != "" {
+		return content.Body
+	}
+	var ext string
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		ext = exts[0]
+	}
+	return "attachment" + ext
+}
+
+func (portal *Portal) checkAttachmentSize(size int) error {
+	maxMB := portal.bridge.Config.Bridge.MaxAttachmentSizeMB
+	if maxMB > 0 && size > maxMB*1024*1024 {
+		return fmt.Errorf("%w: the limit is %d MB", errAttachmentTooLarge, maxMB)
+	}
+	return nil
+}
+
+// downloadAttachment downloads the media of a Matrix message from the
+// homeserver, decrypting it if it's encrypted.
+func (portal *Portal) downloadAttachment(ctx context.Context, content *event.MessageEventContent) (*emailmeow.OutgoingAttachment, error) {
+	if content.Info != nil {
+		if err := portal.checkAttachmentSize(content.Info.Size); err != nil {
+			return nil, err
+		}
+	}
+	mxc := content.URL
+	if content.File != nil {
+		mxc = content.File.URL
+	}
+	parsedMXC, err := mxc.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid URL: %w", errAttachmentDownloadFailed, err)
+	}
+	data, err := portal.MainIntent().DownloadBytes(ctx, parsedMXC)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errAttachmentDownloadFailed, err)
+	}
+	if content.File != nil {
+		err = content.File.DecryptInPlace(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to decrypt: %w", errAttachmentDownloadFailed, err)
+		}
+	}
+	if err = portal.checkAttachmentSize(len(data)); err != nil {
+		return nil, err
+	}
+	var mimeType string
+	if content.Info != nil {
+		mimeType = content.Info.MimeType
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	return &emailmeow.OutgoingAttachment{
+		Filename:    mediaFilename(content, mimeType),
+		ContentType: mimeType,
+		Data:        data,
+	}, nil
+}
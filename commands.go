@@ -1,9 +1,27 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
 
 	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+
+	"imap-bridge/config"
+	"imap-bridge/pkg/emailmeow"
+	"imap-bridge/pkg/managesieve"
+)
+
+var (
+	HelpSectionCreatingPortals  = commands.HelpSection{Name: "Creating portals", Order: 15}
+	HelpSectionPortalManagement = commands.HelpSection{Name: "Portal management", Order: 20}
+	HelpSectionSettings         = commands.HelpSection{Name: "Settings", Order: 25}
 )
 
 type WrappedCommandEvent struct {
@@ -18,6 +36,20 @@ func (br *IMAPBridge) RegisterCommands() {
 	proc.AddHandlers(
 		cmdPing,
 		cmdLogin,
+		cmdLogout,
+		cmdPM,
+		cmdSubject,
+		cmdUnsubscribe,
+		cmdCardDAV,
+		cmdFilter,
+		cmdSieve,
+		cmdPortalMode,
+		cmdReadReceipts,
+		cmdSendReadReceipt,
+		cmdSchedule,
+		cmdUndoSend,
+		cmdQuotedText,
+		cmdShowQuoted,
 	)
 }
 
@@ -54,7 +86,7 @@ func fnLogin(ce *WrappedCommandEvent) {
 	}
 
 	user := ce.Bridge.GetUserByMXID(ce.User.MXID)
-	reply, err := user.Login(ce.Ctx, ce.Args[0], strings.Join(ce.Args[1:], " "))
+	reply, err := user.Login(ce.Ctx, ce.Args[0], strings.Join(ce.Args[1:], " "), emailmeow.ServerSettings{})
 	if err != nil {
 		ce.Reply(reply)
 		return
@@ -63,6 +95,24 @@ func fnLogin(ce *WrappedCommandEvent) {
 	ce.Reply("Successfully logged")
 }
 
+var cmdLogout = &commands.FullHandler{
+	Func: wrapCommand(fnLogout),
+	Name: "logout",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Unlink the bridge from your email account.",
+	},
+}
+
+func fnLogout(ce *WrappedCommandEvent) {
+	if ce.User.EmailAddress == "" {
+		ce.Reply("You're not logged in")
+		return
+	}
+	ce.User.Logout(ce.Ctx)
+	ce.Reply("Logged out successfully")
+}
+
 var cmdPing = &commands.FullHandler{
 	Func: wrapCommand(fnPing),
 	Name: "ping",
@@ -81,3 +131,655 @@ func fnPing(ce *WrappedCommandEvent) {
 		ce.Reply("You're logged in")
 	}
 }
+
+var cmdPM = &commands.FullHandler{
+	Func: wrapCommand(fnPM),
+	Name: "pm",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionCreatingPortals,
+		Description: "Start a new email conversation with the given address.",
+		Args:        "<_email address_> [_subject_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnPM(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `$cmdprefix pm <email address> [subject]`")
+		return
+	}
+	addr, err := mail.ParseAddress(ce.Args[0])
+	if err != nil {
+		ce.Reply("Invalid email address: %v", err)
+		return
+	}
+	subject := strings.Join(ce.Args[1:], " ")
+	portal, justCreated, err := ce.User.GetOrCreatePrivateChat(ce.Ctx, addr.Address, subject)
+	if err != nil {
+		ce.ZLog.Err(err).Str("email_address", addr.Address).Msg("Failed to start private chat")
+		ce.Reply("Failed to create portal room: %v", err)
+		return
+	}
+	if !justCreated {
+		ce.Reply("You already have a portal with %s at [%s](https://matrix.to/#/%s)", addr.Address, portal.MXID, portal.MXID)
+		return
+	}
+	ce.Reply("Created portal room [%s](https://matrix.to/#/%s). Your first message there will be sent as a new email.", portal.MXID, portal.MXID)
+}
+
+var cmdSubject = &commands.FullHandler{
+	Func: wrapCommand(fnSubject),
+	Name: "subject",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Start a new email thread with the given subject. Without arguments, show the current subject.",
+		Args:        "[_subject_]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnSubject(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		if ce.Portal.Subject == "" {
+			ce.Reply("This portal doesn't have a subject")
+		} else if ce.Portal.NewThread {
+			ce.Reply("The next message will start a new thread with the subject `%s`", ce.Portal.Subject)
+		} else {
+			ce.Reply("The current subject is `%s`", ce.Portal.Subject)
+		}
+		return
+	}
+	subject := strings.Join(ce.Args, " ")
+	err := ce.Portal.startNewThread(ce.Ctx, subject)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save portal subject")
+		ce.Reply("Failed to save subject: %v", err)
+		return
+	}
+	ce.Reply("The next message will start a new thread with the subject `%s`", subject)
+}
+
+var cmdUnsubscribe = &commands.FullHandler{
+	Func: wrapCommand(fnUnsubscribe),
+	Name: "unsubscribe",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Unsubscribe from the newsletter or mailing list of this portal and archive the room.",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnUnsubscribe(ce *WrappedCommandEvent) {
+	if ce.Portal.ListUnsubscribe == "" {
+		ce.Reply("No unsubscription info has been received in this portal")
+		return
+	}
+	target, err := ce.User.Client.Unsubscribe(ce.Ctx, ce.Portal.ListUnsubscribe, ce.Portal.ListUnsubscribePost)
+	if errors.Is(err, emailmeow.ErrManualUnsubscribe) {
+		ce.Reply("This sender doesn't support automatic unsubscription, open %s to unsubscribe", target)
+		return
+	} else if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to unsubscribe")
+		ce.Reply("Failed to unsubscribe: %v", err)
+		return
+	}
+	ce.Reply("Unsubscribed using %s", target.Scheme)
+	err = ce.Portal.archive(ce.Ctx, ce.User)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to archive portal after unsubscribing")
+		ce.Reply("Failed to archive room: %v", err)
+	}
+}
+
+var cmdCardDAV = &commands.FullHandler{
+	Func: wrapCommand(fnCardDAV),
+	Name: "carddav",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSettings,
+		Description: "Configure the CardDAV address book used for contact names and photos.",
+		Args:        "<set _url_ [_username_] [_password_]|disable|sync>",
+	},
+}
+
+func fnCardDAV(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		if ce.User.CardDAVURL == "" {
+			ce.Reply("CardDAV contact sync isn't configured")
+		} else {
+			ce.Reply("Contacts are synced from %s", ce.User.CardDAVURL)
+		}
+		ce.Reply("**Usage:** `$cmdprefix carddav <set <url> [username] [password]|disable|sync>`")
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "set":
+		if len(ce.Args) < 2 {
+			ce.Reply("**Usage:** `$cmdprefix carddav set <url> [username] [password]`")
+			return
+		}
+		parsed, err := url.Parse(ce.Args[1])
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+			ce.Reply("Invalid address book URL")
+			return
+		}
+		ce.User.CardDAVURL = parsed.String()
+		ce.User.CardDAVUsername = ""
+		ce.User.CardDAVPassword = ""
+		if len(ce.Args) > 2 {
+			ce.User.CardDAVUsername = ce.Args[2]
+		}
+		if len(ce.Args) > 3 {
+			ce.User.CardDAVPassword = strings.Join(ce.Args[3:], " ")
+			ce.Redact()
+		}
+		err = ce.User.Update(ce.Ctx)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to save CardDAV settings")
+			ce.Reply("Failed to save CardDAV settings: %v", err)
+			return
+		}
+		ce.User.startContactSync()
+		ce.Reply("CardDAV contact sync enabled")
+	case "disable":
+		ce.User.stopContactSync()
+		ce.User.CardDAVURL = ""
+		ce.User.CardDAVUsername = ""
+		ce.User.CardDAVPassword = ""
+		err := ce.User.Update(ce.Ctx)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to save CardDAV settings")
+			ce.Reply("Failed to save CardDAV settings: %v", err)
+			return
+		}
+		ce.Reply("CardDAV contact sync disabled")
+	case "sync":
+		updated, err := ce.User.SyncContacts(ce.Ctx)
+		if err != nil {
+			ce.Reply("Failed to sync contacts: %v", err)
+			return
+		}
+		ce.Reply("Updated %d email users from your address book", updated)
+	default:
+		ce.Reply("**Usage:** `$cmdprefix carddav <set <url> [username] [password]|disable|sync>`")
+	}
+}
+
+var cmdFilter = &commands.FullHandler{
+	Func: wrapCommand(fnFilter),
+	Name: "filter",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSettings,
+		Description: "Manage rules deciding how incoming email is bridged.",
+		Args:        "<list|add _field_ _pattern_ _action_ [_target_]|delete _number_>",
+	},
+	RequiresLogin: true,
+}
+
+const filterUsage = "**Usage:** `$cmdprefix filter <list|add <field> <pattern> <action> [target]|delete <number>>`\n\n" +
+	"* Fields: `from`, `to`, `subject`, `list-id`, `header:<name>` and `size`.\n" +
+	"* Patterns are case-insensitive and may contain `*` and `?` wildcards. Size patterns look like `>5M` or `<10k`.\n" +
+	"* Actions: `ignore`, `silent` (bridge without notifying), `read` (mark as read), " +
+	"`room <room ID>` (bridge to another portal, defaults to the current one) and `move <folder>`.\n\n" +
+	"The first matching rule is used."
+
+func fnFilter(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply(filterUsage)
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "list":
+		rules, err := ce.Bridge.DB.FilterRule.GetAllByUser(ce.Ctx, ce.User.MXID)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to get filter rules")
+			ce.Reply("Failed to get filter rules: %v", err)
+			return
+		} else if len(rules) == 0 {
+			ce.Reply("You don't have any filter rules")
+			return
+		}
+		lines := make([]string, len(rules))
+		for i, rule := range rules {
+			lines[i] = fmt.Sprintf("%d. `%s` matches `%s`: %s %s", rule.Priority, rule.Field, rule.Pattern, rule.Action, rule.Target)
+		}
+		ce.Reply("%s", strings.Join(lines, "\n"))
+	case "add":
+		if len(ce.Args) < 4 {
+			ce.Reply(filterUsage)
+			return
+		}
+		rule := ce.Bridge.DB.FilterRule.New()
+		rule.UserMXID = ce.User.MXID
+		rule.Field = strings.ToLower(ce.Args[1])
+		if strings.HasPrefix(rule.Field, filterFieldHeaderPrefix) {
+			// Keep the canonical header name for display
+			rule.Field = filterFieldHeaderPrefix + ce.Args[1][len(filterFieldHeaderPrefix):]
+		}
+		rule.Pattern = ce.Args[2]
+		rule.Action = strings.ToLower(ce.Args[3])
+		rule.Target = strings.Join(ce.Args[4:], " ")
+		if filterAction(rule.Action) == filterActionRoom && rule.Target == "" && ce.Portal != nil {
+			rule.Target = ce.Portal.MXID.String()
+		}
+		_, err := compileFilterRule(rule)
+		if err != nil {
+			ce.Reply("Invalid filter rule: %v", err)
+			return
+		}
+		err = rule.Insert(ce.Ctx)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to save filter rule")
+			ce.Reply("Failed to save filter rule: %v", err)
+			return
+		}
+		ce.User.invalidateFilterRules()
+		ce.Reply("Added filter rule %d", rule.Priority)
+	case "delete":
+		if len(ce.Args) < 2 {
+			ce.Reply(filterUsage)
+			return
+		}
+		number, err := strconv.Atoi(ce.Args[1])
+		if err != nil {
+			ce.Reply("Invalid rule number")
+			return
+		}
+		rule := ce.Bridge.DB.FilterRule.New()
+		rule.UserMXID = ce.User.MXID
+		rule.Priority = number
+		err = rule.Delete(ce.Ctx)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to delete filter rule")
+			ce.Reply("Failed to delete filter rule: %v", err)
+			return
+		}
+		ce.User.invalidateFilterRules()
+		ce.Reply("Deleted filter rule %d", number)
+	default:
+		ce.Reply(filterUsage)
+	}
+}
+
+var cmdSieve = &commands.FullHandler{
+	Func: wrapCommand(fnSieve),
+	Name: "sieve",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSettings,
+		Description: "Manage the Sieve filter scripts of your account on the mail server.",
+		Args:        "<list|get _name_|put _name_|activate _name_|deactivate|delete _name_>",
+	},
+	RequiresLogin: true,
+}
+
+const sieveUsage = "**Usage:** `$cmdprefix sieve <list|get <name>|put <name>|activate <name>|deactivate|delete <name>>`\n\n" +
+	"To upload a script with `put`, either include it in a code block after the command or reply to a script file."
+
+func fnSieve(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply(sieveUsage)
+		return
+	}
+	subcommand := strings.ToLower(ce.Args[0])
+	var name string
+	switch subcommand {
+	case "list", "deactivate":
+	case "get", "put", "activate", "delete":
+		if len(ce.Args) < 2 {
+			ce.Reply(sieveUsage)
+			return
+		}
+		name = ce.Args[1]
+	default:
+		ce.Reply(sieveUsage)
+		return
+	}
+	var script string
+	if subcommand == "put" {
+		var err error
+		script, err = getSieveScript(ce)
+		if err != nil {
+			ce.Reply("Failed to get script: %v", err)
+			return
+		}
+	}
+
+	client, err := ce.User.newSieveClient(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to connect to ManageSieve server")
+		ce.Reply("Failed to connect to ManageSieve server: %v", err)
+		return
+	}
+	defer func() {
+		_ = client.Logout()
+	}()
+
+	switch subcommand {
+	case "list":
+		var scripts []managesieve.Script
+		scripts, err = client.ListScripts()
+		if err == nil {
+			if len(scripts) == 0 {
+				ce.Reply("You don't have any Sieve scripts")
+				return
+			}
+			lines := make([]string, len(scripts))
+			for i, script := range scripts {
+				lines[i] = fmt.Sprintf("* `%s`", script.Name)
+				if script.Active {
+					lines[i] += " (active)"
+				}
+			}
+			ce.Reply("%s", strings.Join(lines, "\n"))
+		}
+	case "get":
+		script, err = client.GetScript(name)
+		if err == nil {
+			ce.Reply("```sieve\n%s\n```", strings.TrimRight(script, "\r\n"))
+		}
+	case "put":
+		err = client.PutScript(name, script)
+		if err == nil {
+			ce.Reply("Uploaded script `%s`", name)
+		}
+	case "activate":
+		err = client.SetActive(name)
+		if err == nil {
+			ce.Reply("Activated script `%s`", name)
+		}
+	case "deactivate":
+		err = client.SetActive("")
+		if err == nil {
+			ce.Reply("Deactivated all scripts")
+		}
+	case "delete":
+		err = client.DeleteScript(name)
+		if err == nil {
+			ce.Reply("Deleted script `%s`", name)
+		}
+	}
+	if err != nil {
+		ce.ZLog.Err(err).Str("sieve_command", subcommand).Msg("ManageSieve command failed")
+		ce.Reply("Server rejected the command: %s", formatSieveError(err))
+	}
+}
+
+var cmdPortalMode = &commands.FullHandler{
+	Func: wrapCommand(fnPortalMode),
+	Name: "portal-mode",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSettings,
+		Description: "Choose whether new email creates one room per contact or one room per thread.",
+		Args:        "[contact|thread|default]",
+	},
+}
+
+func fnPortalMode(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("Incoming email is bridged in %s mode", ce.User.GetPortalMode())
+		ce.Reply("**Usage:** `$cmdprefix portal-mode [contact|thread|default]`")
+		return
+	}
+	mode := config.PortalMode(strings.ToLower(ce.Args[0]))
+	if mode == "default" {
+		mode = ""
+	} else if !mode.IsValid() {
+		ce.Reply("**Usage:** `$cmdprefix portal-mode [contact|thread|default]`")
+		return
+	}
+	ce.User.PortalMode = string(mode)
+	err := ce.User.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save portal mode")
+		ce.Reply("Failed to save portal mode: %v", err)
+		return
+	}
+	ce.Reply("Incoming email will now be bridged in %s mode. Existing rooms are not changed.", ce.User.GetPortalMode())
+}
+
+var cmdReadReceipts = &commands.FullHandler{
+	Func: wrapCommand(fnReadReceipts),
+	Name: "read-receipts",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSettings,
+		Description: "Choose whether to send read receipts when reading email that asks for one.",
+		Args:        "[always|never|ask|default]",
+	},
+}
+
+func fnReadReceipts(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("Read receipt policy: %s", ce.User.GetReadReceiptPolicy())
+		ce.Reply("**Usage:** `$cmdprefix read-receipts [always|never|ask|default]`")
+		return
+	}
+	policy := config.ReadReceiptPolicy(strings.ToLower(ce.Args[0]))
+	if policy == "default" {
+		policy = ""
+	} else if !policy.IsValid() {
+		ce.Reply("**Usage:** `$cmdprefix read-receipts [always|never|ask|default]`")
+		return
+	}
+	ce.User.ReadReceiptPolicy = string(policy)
+	err := ce.User.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save read receipt policy")
+		ce.Reply("Failed to save read receipt policy: %v", err)
+		return
+	}
+	ce.Reply("Read receipt policy set to %s", ce.User.GetReadReceiptPolicy())
+}
+
+var cmdSendReadReceipt = &commands.FullHandler{
+	Func: wrapCommand(fnSendReadReceipt),
+	Name: "send-read-receipt",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Send the read receipts that the bridge asked about in this portal.",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnSendReadReceipt(ce *WrappedCommandEvent) {
+	requests, err := ce.Bridge.DB.ReadReceiptRequest.GetAllAsked(ce.Ctx, ce.Portal.MXID)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to get read receipt requests")
+		ce.Reply("Failed to get read receipt requests: %v", err)
+		return
+	} else if len(requests) == 0 {
+		ce.Reply("No read receipts have been requested in this portal")
+		return
+	}
+	sent := ce.User.sendReadReceipts(*ce.ZLog, requests, true)
+	if sent < len(requests) {
+		ce.Reply("Sent %d of %d read receipts, check the logs for errors", sent, len(requests))
+	} else {
+		ce.Reply("Sent %d read receipt(s)", sent)
+	}
+}
+
+var cmdSchedule = &commands.FullHandler{
+	Func: wrapCommand(fnSchedule),
+	Name: "schedule",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Send an email in this portal at a later time, or list the scheduled emails. Redact the command to cancel the email.",
+		Args:        "<_time_> <_message_> | list",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnSchedule(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `$cmdprefix schedule <time> <message>` or `$cmdprefix schedule list`\n\n" +
+			"The time can be a duration like `+2h` or `1d`, a time of day like `15:04` or a date like `2006-01-02 15:04`.")
+		return
+	} else if strings.ToLower(ce.Args[0]) == "list" {
+		fnListScheduled(ce)
+		return
+	}
+	timeArg, body := cutArg(ce.RawArgs)
+	sendAt, err := parseSendTime(timeArg, time.Now())
+	if errors.Is(err, errInvalidSendTime) {
+		// Dates can be written with a space before the time
+		dateArg, rest := cutArg(body)
+		if dateSendAt, dateErr := parseSendTime(timeArg+" "+dateArg, time.Now()); dateErr == nil {
+			sendAt, err, body = dateSendAt, nil, rest
+		}
+	}
+	if err != nil {
+		ce.Reply("%v", err)
+		return
+	} else if body == "" {
+		ce.Reply("**Usage:** `$cmdprefix schedule <time> <message>`")
+		return
+	} else if ce.User.Client == nil {
+		ce.Reply("You're not connected to your email account")
+		return
+	}
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: body}
+	_, err = ce.Portal.queueEmailMessage(ce.Ctx, content, ce.User, ce.EventID, nil, sendAt)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to schedule email")
+		ce.Reply("Failed to schedule email: %v", err)
+		return
+	}
+	ce.Bridge.outbox.wake()
+	ce.Reply("The email will be sent at %s. Redact your command message to cancel it.", formatSendTime(sendAt))
+}
+
+func fnListScheduled(ce *WrappedCommandEvent) {
+	scheduled, err := ce.Bridge.DB.Outbox.GetScheduled(ce.Ctx, ce.Portal.MXID)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to get scheduled emails")
+		ce.Reply("Failed to get scheduled emails: %v", err)
+		return
+	} else if len(scheduled) == 0 {
+		ce.Reply("No emails are scheduled in this portal")
+		return
+	}
+	var lines []string
+	for _, msg := range scheduled {
+		link := ce.Portal.MXID.EventURI(msg.MXID, ce.Bridge.AS.HomeserverDomain).MatrixToURL()
+		lines = append(lines, fmt.Sprintf("* [%s](%s)", formatSendTime(msg.ScheduledFor), link))
+	}
+	ce.Reply("Scheduled emails:\n\n%s", strings.Join(lines, "\n"))
+}
+
+var cmdUndoSend = &commands.FullHandler{
+	Func: wrapCommand(fnUndoSend),
+	Name: "undo-send",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSettings,
+		Description: "Set how long to wait before sending email, so that it can be cancelled by redacting the message.",
+		Args:        "[<_seconds_>|off|default]",
+	},
+}
+
+func fnUndoSend(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("Undo send delay: %s", ce.User.GetUndoSendDelay())
+		ce.Reply("**Usage:** `$cmdprefix undo-send [<seconds>|off|default]`")
+		return
+	}
+	var delay string
+	switch arg := strings.ToLower(ce.Args[0]); arg {
+	case "default":
+	case "off":
+		delay = "0s"
+	default:
+		if seconds, err := strconv.Atoi(arg); err == nil {
+			arg = strconv.Itoa(seconds) + "s"
+		}
+		parsed, err := time.ParseDuration(arg)
+		if err != nil || parsed < 0 {
+			ce.Reply("**Usage:** `$cmdprefix undo-send [<seconds>|off|default]`")
+			return
+		}
+		delay = parsed.String()
+	}
+	ce.User.UndoSendDelay = delay
+	err := ce.User.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save undo send delay")
+		ce.Reply("Failed to save undo send delay: %v", err)
+		return
+	}
+	if sendDelay := ce.User.GetUndoSendDelay(); sendDelay > 0 {
+		ce.Reply("Email will be sent %s after the message. Redact a message before then to cancel it.", sendDelay)
+	} else {
+		ce.Reply("Email will be sent immediately")
+	}
+}
+
+var cmdQuotedText = &commands.FullHandler{
+	Func: wrapCommand(fnQuotedText),
+	Name: "quoted-text",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionSettings,
+		Description: "Choose what to do with quoted previous messages and signatures in incoming replies.",
+		Args:        "[collapse|drop|keep|default]",
+	},
+}
+
+func fnQuotedText(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("Quoted text in incoming email: %s", ce.User.GetQuotedText())
+		ce.Reply("**Usage:** `$cmdprefix quoted-text [collapse|drop|keep|default]`")
+		return
+	}
+	action := config.QuotedTextAction(strings.ToLower(ce.Args[0]))
+	if action == "default" {
+		action = ""
+	} else if !action.IsValid() {
+		ce.Reply("**Usage:** `$cmdprefix quoted-text [collapse|drop|keep|default]`")
+		return
+	}
+	ce.User.QuotedText = string(action)
+	err := ce.User.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save quoted text setting")
+		ce.Reply("Failed to save quoted text setting: %v", err)
+		return
+	}
+	switch ce.User.GetQuotedText() {
+	case config.QuotedTextCollapse:
+		ce.Reply("Quoted text in incoming email will be collapsed")
+	case config.QuotedTextDrop:
+		ce.Reply("Quoted text in incoming email will be removed. Reply to a message with `$cmdprefix show-quoted` to see it.")
+	default:
+		ce.Reply("Incoming email will be bridged with quoted text")
+	}
+}
+
+var cmdShowQuoted = &commands.FullHandler{
+	Func: wrapCommand(fnShowQuoted),
+	Name: "show-quoted",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Show the quoted text and signature that were removed from an email. Reply to the message with this command.",
+	},
+	RequiresPortal: true,
+}
+
+func fnShowQuoted(ce *WrappedCommandEvent) {
+	if ce.ReplyTo == "" {
+		ce.Reply("Reply to an email with `$cmdprefix show-quoted` to see its quoted text")
+		return
+	}
+	evt, err := ce.Bridge.getMessageEvent(ce.Ctx, ce.RoomID, ce.ReplyTo)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to get message for showing quoted text")
+		ce.Reply("Failed to get message: %v", err)
+		return
+	}
+	quoted, _ := evt.Content.Raw[quotedTextKey].(string)
+	if quoted == "" {
+		ce.Reply("No quoted text was removed from that message")
+		return
+	}
+	ce.ReplyAdvanced(quoted, false, false)
+}
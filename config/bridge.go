@@ -13,12 +13,25 @@ import (
 )
 
 type BridgeConfig struct {
-	UsernameTemplate      string `yaml:"username_template"`
-	DisplaynameTemplate   string `yaml:"displayname_template"`
-	PrivateChatPortalMeta string `yaml:"private_chat_portal_meta"`
-	UseContactAvatars     bool   `yaml:"use_contact_avatars"`
-	UseOutdatedProfiles   bool   `yaml:"use_outdated_profiles"`
-	NumberInTopic         bool   `yaml:"number_in_topic"`
+	UsernameTemplate       string              `yaml:"username_template"`
+	DisplaynameTemplate    string              `yaml:"displayname_template"`
+	PrivateChatPortalMeta  string              `yaml:"private_chat_portal_meta"`
+	PortalMode             PortalMode          `yaml:"portal_mode"`
+	ArchiveTag             string              `yaml:"archive_tag"`
+	AutomatedMail          AutomatedMailAction `yaml:"automated_mail"`
+	RemoteImages           RemoteImageAction   `yaml:"remote_images"`
+	QuotedText             QuotedTextAction    `yaml:"quoted_text"`
+	RequestReadReceipts    bool                `yaml:"request_read_receipts"`
+	ReadReceiptPolicy      ReadReceiptPolicy   `yaml:"read_receipt_policy"`
+	UseContactAvatars      bool                `yaml:"use_contact_avatars"`
+	ContactSyncIntervalStr string              `yaml:"contact_sync_interval"`
+	OutboxDeadlineStr      string              `yaml:"outbox_deadline"`
+	UndoSendDelayStr       string              `yaml:"undo_send_delay"`
+	EditMode               EditMode            `yaml:"edit_mode"`
+	EditWindowStr          string              `yaml:"edit_window"`
+	MaxAttachmentSizeMB    int                 `yaml:"max_attachment_size_mb"`
+	UseOutdatedProfiles    bool                `yaml:"use_outdated_profiles"`
+	NumberInTopic          bool                `yaml:"number_in_topic"`
 
 	NoteToSelfAvatar id.ContentURIString `yaml:"note_to_self_avatar"`
 
@@ -62,6 +75,11 @@ type BridgeConfig struct {
 
 	Relay RelaybotConfig `yaml:"relay"`
 
+	ContactSyncInterval time.Duration `yaml:"-"`
+	OutboxDeadline      time.Duration `yaml:"-"`
+	UndoSendDelay       time.Duration `yaml:"-"`
+	EditWindow          time.Duration `yaml:"-"`
+
 	usernameTemplate    *template.Template `yaml:"-"`
 	displaynameTemplate *template.Template `yaml:"-"`
 }
@@ -96,6 +114,98 @@ func (bc *BridgeConfig) Validate() error {
 	return nil
 }
 
+// PortalMode decides which emails share a portal room.
+type PortalMode string
+
+const (
+	// PortalModeContact creates one room per correspondent. Separate email
+	// threads are bridged as Matrix threads in the room.
+	PortalModeContact PortalMode = "contact"
+	// PortalModeThread creates one room per email thread.
+	PortalModeThread PortalMode = "thread"
+)
+
+func (pm PortalMode) IsValid() bool {
+	return pm == PortalModeContact || pm == PortalModeThread
+}
+
+// AutomatedMailAction decides what happens to automatically generated mail
+// like auto-replies and bounces.
+type AutomatedMailAction string
+
+const (
+	AutomatedMailDrop   AutomatedMailAction = "drop"
+	AutomatedMailNotice AutomatedMailAction = "notice"
+	// AutomatedMailManagementRoom sends a summary of the mail to the user's
+	// management room instead of the portal.
+	AutomatedMailManagementRoom AutomatedMailAction = "management_room"
+)
+
+func (ama AutomatedMailAction) IsValid() bool {
+	return ama == AutomatedMailDrop || ama == AutomatedMailNotice || ama == AutomatedMailManagementRoom
+}
+
+// RemoteImageAction decides what happens to images in email HTML that are
+// loaded from remote servers, which can be used to track when mail is read.
+type RemoteImageAction string
+
+const (
+	RemoteImagesStrip RemoteImageAction = "strip"
+	// RemoteImagesLink replaces remote images with links to them.
+	RemoteImagesLink RemoteImageAction = "link"
+)
+
+func (ria RemoteImageAction) IsValid() bool {
+	return ria == RemoteImagesStrip || ria == RemoteImagesLink
+}
+
+// QuotedTextAction decides what happens to the quoted previous messages and
+// signatures of incoming replies.
+type QuotedTextAction string
+
+const (
+	// QuotedTextCollapse moves the quoted text into a collapsed section.
+	QuotedTextCollapse QuotedTextAction = "collapse"
+	QuotedTextDrop     QuotedTextAction = "drop"
+	QuotedTextKeep     QuotedTextAction = "keep"
+)
+
+func (qta QuotedTextAction) IsValid() bool {
+	return qta == QuotedTextCollapse || qta == QuotedTextDrop || qta == QuotedTextKeep
+}
+
+// ReadReceiptPolicy decides whether read receipts are sent when the user
+// reads an email that asks for one.
+type ReadReceiptPolicy string
+
+const (
+	ReadReceiptPolicyAlways ReadReceiptPolicy = "always"
+	ReadReceiptPolicyNever  ReadReceiptPolicy = "never"
+	// ReadReceiptPolicyAsk makes the bridge ask the user in the room before
+	// sending a read receipt.
+	ReadReceiptPolicyAsk ReadReceiptPolicy = "ask"
+)
+
+func (rrp ReadReceiptPolicy) IsValid() bool {
+	return rrp == ReadReceiptPolicyAlways || rrp == ReadReceiptPolicyNever || rrp == ReadReceiptPolicyAsk
+}
+
+// EditMode decides what is sent when a Matrix message is edited after the
+// email has already been sent.
+type EditMode string
+
+const (
+	// EditModeCorrection sends a follow-up email showing what changed.
+	EditModeCorrection EditMode = "correction"
+	// EditModeResend sends the new text as a reply to the original email.
+	EditModeResend EditMode = "resend"
+	EditModeReject EditMode = "reject"
+)
+
+func (em EditMode) IsValid() bool {
+	return em == EditModeCorrection || em == EditModeResend || em == EditModeReject
+}
+
 type umBridgeConfig BridgeConfig
 
 func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -114,6 +224,60 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	if bc.PortalMode == "" {
+		bc.PortalMode = PortalModeContact
+	} else if !bc.PortalMode.IsValid() {
+		return fmt.Errorf("invalid portal_mode %q", bc.PortalMode)
+	}
+	if bc.AutomatedMail == "" {
+		bc.AutomatedMail = AutomatedMailNotice
+	} else if !bc.AutomatedMail.IsValid() {
+		return fmt.Errorf("invalid automated_mail %q", bc.AutomatedMail)
+	}
+	if bc.RemoteImages == "" {
+		bc.RemoteImages = RemoteImagesLink
+	} else if !bc.RemoteImages.IsValid() {
+		return fmt.Errorf("invalid remote_images %q", bc.RemoteImages)
+	}
+	if bc.QuotedText == "" {
+		bc.QuotedText = QuotedTextCollapse
+	} else if !bc.QuotedText.IsValid() {
+		return fmt.Errorf("invalid quoted_text %q", bc.QuotedText)
+	}
+	if bc.ReadReceiptPolicy == "" {
+		bc.ReadReceiptPolicy = ReadReceiptPolicyAsk
+	} else if !bc.ReadReceiptPolicy.IsValid() {
+		return fmt.Errorf("invalid read_receipt_policy %q", bc.ReadReceiptPolicy)
+	}
+	if bc.EditMode == "" {
+		bc.EditMode = EditModeCorrection
+	} else if !bc.EditMode.IsValid() {
+		return fmt.Errorf("invalid edit_mode %q", bc.EditMode)
+	}
+	if bc.ContactSyncIntervalStr != "" {
+		bc.ContactSyncInterval, err = time.ParseDuration(bc.ContactSyncIntervalStr)
+		if err != nil {
+			return fmt.Errorf("invalid contact_sync_interval: %w", err)
+		}
+	}
+	if bc.OutboxDeadlineStr != "" {
+		bc.OutboxDeadline, err = time.ParseDuration(bc.OutboxDeadlineStr)
+		if err != nil {
+			return fmt.Errorf("invalid outbox_deadline: %w", err)
+		}
+	}
+	if bc.UndoSendDelayStr != "" {
+		bc.UndoSendDelay, err = time.ParseDuration(bc.UndoSendDelayStr)
+		if err != nil {
+			return fmt.Errorf("invalid undo_send_delay: %w", err)
+		}
+	}
+	if bc.EditWindowStr != "" {
+		bc.EditWindow, err = time.ParseDuration(bc.EditWindowStr)
+		if err != nil {
+			return fmt.Errorf("invalid edit_window: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -143,14 +307,16 @@ func (bc BridgeConfig) FormatUsername(userID string) string {
 }
 
 type DisplaynameParams struct {
-	ProfileName string
-	ContactName string
-	Username    string
-	PhoneNumber string
-	UUID        string
-	ACI         string
-	PNI         string
-	AboutEmoji  string
+	Name      string
+	Address   string
+	LocalPart string
+	Domain    string
+}
+
+func (bc BridgeConfig) FormatDisplayname(params DisplaynameParams) string {
+	var buffer strings.Builder
+	_ = bc.displaynameTemplate.Execute(&buffer, params)
+	return buffer.String()
 }
 
 type RelaybotConfig struct {
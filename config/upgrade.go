@@ -20,6 +20,7 @@ import (
 	"strings"
 
 	up "go.mau.fi/util/configupgrade"
+	"go.mau.fi/util/random"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 )
 
@@ -73,12 +74,28 @@ func DoUpgrade(helper *up.Helper) {
 		helper.Copy(up.Str, "bridge", "username_template")
 	}
 	if displaynameTemplate, ok := helper.Get(up.Str, "bridge", "displayname_template"); ok && strings.Contains(displaynameTemplate, "{displayname}") {
-		helper.Set(up.Str, strings.ReplaceAll(displaynameTemplate, "{displayname}", `{{or .ProfileName .PhoneNumber "Unknown user"}}`), "bridge", "displayname_template")
+		helper.Set(up.Str, strings.ReplaceAll(displaynameTemplate, "{displayname}", `{{or .Name .Address}}`), "bridge", "displayname_template")
+	} else if ok && (strings.Contains(displaynameTemplate, ".ProfileName") || strings.Contains(displaynameTemplate, ".PhoneNumber")) {
+		// Templates using the old Signal fields can't be rendered anymore
+		helper.Set(up.Str, `{{or .Name .Address}}`, "bridge", "displayname_template")
 	} else {
 		helper.Copy(up.Str, "bridge", "displayname_template")
 	}
 	helper.Copy(up.Str, "bridge", "private_chat_portal_meta")
+	helper.Copy(up.Str, "bridge", "portal_mode")
+	helper.Copy(up.Str|up.Null, "bridge", "archive_tag")
+	helper.Copy(up.Str, "bridge", "automated_mail")
+	helper.Copy(up.Str, "bridge", "remote_images")
+	helper.Copy(up.Str, "bridge", "quoted_text")
+	helper.Copy(up.Bool, "bridge", "request_read_receipts")
+	helper.Copy(up.Str, "bridge", "read_receipt_policy")
 	helper.Copy(up.Bool, "bridge", "use_contact_avatars")
+	helper.Copy(up.Str, "bridge", "contact_sync_interval")
+	helper.Copy(up.Str, "bridge", "outbox_deadline")
+	helper.Copy(up.Str, "bridge", "undo_send_delay")
+	helper.Copy(up.Str, "bridge", "edit_mode")
+	helper.Copy(up.Str, "bridge", "edit_window")
+	helper.Copy(up.Int, "bridge", "max_attachment_size_mb")
 	helper.Copy(up.Bool, "bridge", "use_outdated_profiles")
 	helper.Copy(up.Bool, "bridge", "number_in_topic")
 	helper.Copy(up.Str, "bridge", "note_to_self_avatar")
@@ -101,6 +118,13 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome_connected")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome_unconnected")
 	helper.Copy(up.Str|up.Null, "bridge", "management_room_text", "additional_help")
+	helper.Copy(up.Str, "bridge", "provisioning", "prefix")
+	if secret, ok := helper.Get(up.Str, "bridge", "provisioning", "shared_secret"); !ok || secret == "generate" {
+		sharedSecret := random.String(64)
+		helper.Set(up.Str, sharedSecret, "bridge", "provisioning", "shared_secret")
+	} else {
+		helper.Copy(up.Str, "bridge", "provisioning", "shared_secret")
+	}
 	helper.Copy(up.Bool, "bridge", "provisioning", "debug_endpoints")
 
 	helper.Copy(up.Map, "bridge", "permissions")
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"imap-bridge/pkg/carddav"
+	"imap-bridge/pkg/emailmeow"
+)
+
+var errContactSyncNotConfigured = errors.New("CardDAV contact sync isn't configured")
+
+func (user *User) newCardDAVClient() *carddav.Client {
+	if user.CardDAVURL == "" {
+		return nil
+	}
+	return carddav.NewClient(user.CardDAVURL, user.CardDAVUsername, user.CardDAVPassword)
+}
+
+// startContactSync starts polling the user's CardDAV address book, replacing
+// any previous sync loop.
+func (user *User) startContactSync() {
+	user.stopContactSync()
+	if user.CardDAVURL == "" || user.bridge.Config.Bridge.ContactSyncInterval <= 0 {
+		return
+	}
+	log := user.log.With().Str("action", "contact sync").Logger()
+	ctx, cancel := context.WithCancel(log.WithContext(context.Background()))
+	user.contactSyncLock.Lock()
+	user.contactSyncCancel = cancel
+	user.contactSyncLock.Unlock()
+	go user.contactSyncLoop(ctx, user.bridge.Config.Bridge.ContactSyncInterval)
+}
+
+func (user *User) stopContactSync() {
+	user.contactSyncLock.Lock()
+	defer user.contactSyncLock.Unlock()
+	if user.contactSyncCancel != nil {
+		user.contactSyncCancel()
+		user.contactSyncCancel = nil
+	}
+}
+
+func (user *User) contactSyncLoop(ctx context.Context, interval time.Duration) {
+	log := zerolog.Ctx(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := user.SyncContacts(ctx); err != nil && ctx.Err() == nil {
+			log.Err(err).Msg("Failed to sync contacts")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SyncContacts fetches the user's CardDAV address book and updates the ghosts
+// of every address found in it. It returns the number of updated ghosts.
+func (user *User) SyncContacts(ctx context.Context) (int, error) {
+	client := user.newCardDAVClient()
+	if client == nil {
+		return 0, errContactSyncNotConfigured
+	}
+	log := zerolog.Ctx(ctx)
+	contacts, err := client.Contacts(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch contacts: %w", err)
+	}
+	log.Debug().Int("contact_count", len(contacts)).Msg("Fetched contacts from CardDAV")
+	updated := 0
+	for _, contact := range contacts {
+		var puppets []*Puppet
+		for _, address := range contact.Emails {
+			// Don't create ghosts for every contact, only ones we've seen mail from or sent mail to.
+			puppet := user.bridge.GetPuppetByEmailAddressIfExists(emailmeow.NormalizeAddress(address))
+			if puppet != nil {
+				puppets = append(puppets, puppet)
+			}
+		}
+		if len(puppets) == 0 {
+			continue
+		}
+		info := PuppetInfo{
+			Name:        contact.Name,
+			NameQuality: nameQualityContact,
+		}
+		if user.bridge.Config.Bridge.UseContactAvatars {
+			info.Avatar, info.AvatarType = contact.Photo, contact.PhotoType
+			if info.Avatar == nil && contact.PhotoURL != "" {
+				info.Avatar, info.AvatarType, err = client.DownloadPhoto(ctx, contact.PhotoURL)
+				if err != nil {
+					log.Warn().Err(err).Str("contact_uid", contact.UID).Msg("Failed to download contact photo")
+				}
+			}
+		}
+		for _, puppet := range puppets {
+			puppet.UpdateInfo(ctx, info)
+			updated++
+		}
+	}
+	return updated, nil
+}
@@ -81,7 +81,9 @@ func (user *User) tryAutomaticDoublePuppeting() {
 	}
 	user.log.Debug().Msg("Checking if double puppeting needs to be enabled")
 	puppet := user.bridge.GetPuppetByEmailAddress(user.EmailAddress)
-	if puppet.CustomMXID == user.MXID {
+	if puppet == nil {
+		return
+	} else if puppet.CustomMXID == user.MXID {
 		user.log.Debug().Msg("User already has double-puppeting enabled")
 		// Custom puppet already enabled
 		return
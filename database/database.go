@@ -19,6 +19,11 @@ type Database struct {
 	Portal  *PortalQuery
 	Puppet  *PuppetQuery
 	Message *MessageQuery
+
+	FilterRule         *FilterRuleQuery
+	ReadReceiptRequest *ReadReceiptRequestQuery
+	Outbox             *OutboxQuery
+	SentMessage        *SentMessageQuery
 }
 
 func New(db *dbutil.Database) *Database {
@@ -29,5 +34,10 @@ func New(db *dbutil.Database) *Database {
 		Portal:   &PortalQuery{dbutil.MakeQueryHelper(db, newPortal)},
 		Puppet:   &PuppetQuery{dbutil.MakeQueryHelper(db, newPuppet)},
 		Message:  &MessageQuery{dbutil.MakeQueryHelper(db, newMessage)},
+
+		FilterRule:         &FilterRuleQuery{dbutil.MakeQueryHelper(db, newFilterRule)},
+		ReadReceiptRequest: &ReadReceiptRequestQuery{dbutil.MakeQueryHelper(db, newReadReceiptRequest)},
+		Outbox:             &OutboxQuery{dbutil.MakeQueryHelper(db, newOutboxMessage)},
+		SentMessage:        &SentMessageQuery{dbutil.MakeQueryHelper(db, newSentMessage)},
 	}
 }
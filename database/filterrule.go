@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getFilterRulesByUserQuery = `
+        SELECT user_mxid, priority, field, pattern, action, target FROM filter_rule
+        WHERE user_mxid=$1
+        ORDER BY priority ASC
+    `
+	getMaxFilterRulePriorityQuery = `SELECT COALESCE(MAX(priority), 0) FROM filter_rule WHERE user_mxid=$1`
+	insertFilterRuleQuery         = `
+        INSERT INTO filter_rule (user_mxid, priority, field, pattern, action, target)
+        VALUES ($1, $2, $3, $4, $5, $6)
+    `
+	deleteFilterRuleQuery = `DELETE FROM filter_rule WHERE user_mxid=$1 AND priority=$2`
+)
+
+type FilterRuleQuery struct {
+	*dbutil.QueryHelper[*FilterRule]
+}
+
+// GetAllByUser returns the user's filter rules in the order they should be evaluated.
+func (frq *FilterRuleQuery) GetAllByUser(ctx context.Context, userID id.UserID) ([]*FilterRule, error) {
+	return frq.QueryMany(ctx, getFilterRulesByUserQuery, userID)
+}
+
+type FilterRule struct {
+	qh *dbutil.QueryHelper[*FilterRule]
+
+	UserMXID id.UserID
+	// Priority is the position of the rule in the user's rule list. It's also
+	// used as the rule number in commands.
+	Priority int
+	Field    string
+	Pattern  string
+	Action   string
+	Target   string
+}
+
+func newFilterRule(qh *dbutil.QueryHelper[*FilterRule]) *FilterRule {
+	return &FilterRule{qh: qh}
+}
+
+func (fr *FilterRule) Scan(row dbutil.Scannable) (*FilterRule, error) {
+	err := row.Scan(&fr.UserMXID, &fr.Priority, &fr.Field, &fr.Pattern, &fr.Action, &fr.Target)
+	if err != nil {
+		return nil, err
+	}
+	return fr, nil
+}
+
+func (fr *FilterRule) sqlVariables() []any {
+	return []any{fr.UserMXID, fr.Priority, fr.Field, fr.Pattern, fr.Action, fr.Target}
+}
+
+// Insert adds the rule to the end of the user's rule list.
+func (fr *FilterRule) Insert(ctx context.Context) error {
+	var maxPriority int
+	err := fr.qh.GetDB().QueryRow(ctx, getMaxFilterRulePriorityQuery, fr.UserMXID).Scan(&maxPriority)
+	if err != nil {
+		return err
+	}
+	fr.Priority = maxPriority + 1
+	return fr.qh.Exec(ctx, insertFilterRuleQuery, fr.sqlVariables()...)
+}
+
+func (fr *FilterRule) Delete(ctx context.Context) error {
+	return fr.qh.Exec(ctx, deleteFilterRuleQuery, fr.UserMXID, fr.Priority)
+}
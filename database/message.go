@@ -11,62 +11,94 @@ import (
 )
 
 // Queries
-// Message attrs: Sender, Timestamp, PartIndex, EmailAddress, EmailReceiver, MXID, RoomID,
+// Message attrs: Sender, Timestamp, PartIndex, EmailAddress, EmailReceiver, MXID, RoomID, EmailMessageID, EmailThreadID, Flagged
 const (
 	getMessageByMXIDQuery = `
-        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room FROM message
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
         WHERE mxid=$1
     `
 	getMessagePartByEmailAddressQuery = `
-        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room FROM message
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
         WHERE sender=$1 AND timestamp=$2 AND part_index=$3 AND email_receiver=$4
     `
 	getLastMessagePartByEmailAddressQuery = `
-        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room FROM message
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
         WHERE sender=$1 AND timestamp=$2 AND email_receiver=$3
         ORDER BY part_index DESC LIMIT 1
     `
 	getAllMessagePartsByEmailAddressQuery = `
-        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room FROM message
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
         WHERE sender=$1 AND timestamp=$2 AND email_receiver=$3
     `
 	getMessageLastPartByEmailAddressWithUnknownReceiverQuery = `
-        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room FROM message
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
         WHERE sender=$1 AND timestamp=$2 AND (email_receiver=$3 OR email_receiver='00000000-0000-0000-0000-000000000000')
         ORDER BY part_index DESC LIMIT 1
     `
 	getManyMessagesByEmailAddressQueryPostgres = `
-        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room FROM message
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
         WHERE sender=$1 AND (email_receiver=$2 OR email_receiver=$3) AND timestamp=ANY($4)
         ORDER BY timestamp DESC, part_index DESC
     `
 	getManyMessagesByEmailAddressQuerySQLite = `
-        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room FROM message
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
         WHERE sender=?1 AND (email_receiver=?2 OR email_receiver=?3) AND timestamp IN (?4)
         ORDER BY timestamp DESC, part_index DESC
     `
 	getFirstBeforeQuery = `
-        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room FROM message
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
         WHERE mx_room=$1 AND timestamp <= $2
         ORDER BY timestamp DESC
         LIMIT 1
     `
 	getMessagesBetweenTimeQuery = `
-        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room FROM message
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
         WHERE email_address=$1 AND email_receiver=$2 AND timestamp>$3 AND timestamp<=$4 AND part_index=0
         ORDER BY timestamp ASC
     `
 	insertMessageQuery = `
-        INSERT INTO message (sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room)
-        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        INSERT INTO message (sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
     `
 	deleteMessageQuery = `
         DELETE FROM message
         WHERE sender=$1 AND timestamp=$2 AND part_index=$3 AND email_receiver=$4
+    `
+	getLastMessageWithEmailIDQuery = `
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
+        WHERE email_address=$1 AND email_receiver=$2 AND email_message_id<>''
+        ORDER BY timestamp DESC LIMIT 1
+    `
+	getMessageByEmailMessageIDQuery = `
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
+        WHERE email_receiver=$1 AND email_message_id=$2
+        ORDER BY part_index ASC LIMIT 1
+    `
+	getFirstMessageInEmailThreadQuery = `
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
+        WHERE email_address=$1 AND email_receiver=$2 AND email_thread_id=$3
+        ORDER BY timestamp ASC, part_index ASC LIMIT 1
+    `
+	getLastMessageInEmailThreadQuery = `
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
+        WHERE email_address=$1 AND email_receiver=$2 AND email_thread_id=$3 AND email_message_id<>''
+        ORDER BY timestamp DESC LIMIT 1
+    `
+	getAnyMessageInEmailThreadQuery = `
+        SELECT sender, timestamp, part_index, email_address, email_receiver, mxid, mx_room, email_message_id, email_thread_id, flagged FROM message
+        WHERE email_receiver=$1 AND email_thread_id=$2
+        LIMIT 1
     `
 	updateMessageTimestampQuery = `
         UPDATE message SET timestamp=$4 WHERE sender=$1 AND timestamp=$2 AND email_receiver=$3
     `
+	updateMessageFlaggedQuery = `
+        UPDATE message SET flagged=$4 WHERE sender=$1 AND timestamp=$2 AND email_receiver=$3
+    `
+	countFlaggedMessagesQuery = `
+        SELECT COUNT(*) FROM message
+        WHERE email_address=$1 AND email_receiver=$2 AND part_index=0 AND flagged=true
+    `
 )
 
 // Message Query
@@ -98,6 +130,37 @@ func (mq *MessageQuery) GetAllBetweenTimestamps(ctx context.Context, key PortalK
 	return mq.QueryMany(ctx, getMessagesBetweenTimeQuery, key.ThreadID, key.Receiver, int64(min), int64(max))
 }
 
+// GetLastWithEmailID returns the newest message in the portal that has a known email Message-ID.
+func (mq *MessageQuery) GetLastWithEmailID(ctx context.Context, key PortalKey) (*Message, error) {
+	return mq.QueryOne(ctx, getLastMessageWithEmailIDQuery, key.ThreadID, key.Receiver)
+}
+
+// GetFirstInEmailThread returns the oldest message of the given email thread in the portal.
+func (mq *MessageQuery) GetFirstInEmailThread(ctx context.Context, key PortalKey, emailThreadID string) (*Message, error) {
+	return mq.QueryOne(ctx, getFirstMessageInEmailThreadQuery, key.ThreadID, key.Receiver, emailThreadID)
+}
+
+// GetLastInEmailThread returns the newest message of the given email thread in the portal.
+func (mq *MessageQuery) GetLastInEmailThread(ctx context.Context, key PortalKey, emailThreadID string) (*Message, error) {
+	return mq.QueryOne(ctx, getLastMessageInEmailThreadQuery, key.ThreadID, key.Receiver, emailThreadID)
+}
+
+// GetAnyInEmailThread returns a message of the given email thread from any of the receiver's portals.
+func (mq *MessageQuery) GetAnyInEmailThread(ctx context.Context, receiver, emailThreadID string) (*Message, error) {
+	return mq.QueryOne(ctx, getAnyMessageInEmailThreadQuery, receiver, emailThreadID)
+}
+
+// GetByEmailMessageID returns the first part of the bridged email with the given Message-ID.
+func (mq *MessageQuery) GetByEmailMessageID(ctx context.Context, receiver, emailMessageID string) (*Message, error) {
+	return mq.QueryOne(ctx, getMessageByEmailMessageIDQuery, receiver, emailMessageID)
+}
+
+// CountFlagged returns the number of flagged emails in the portal.
+func (mq *MessageQuery) CountFlagged(ctx context.Context, key PortalKey) (count int, err error) {
+	err = mq.GetDB().QueryRow(ctx, countFlaggedMessagesQuery, key.ThreadID, key.Receiver).Scan(&count)
+	return
+}
+
 func (mq *MessageQuery) GetLastPartByEmailAddressWithUnknownReceiver(ctx context.Context, sender string, timestamp uint64, receiver string) (*Message, error) {
 	return mq.QueryOne(ctx, getMessageLastPartByEmailAddressWithUnknownReceiverQuery, sender, timestamp, receiver)
 }
@@ -143,6 +206,11 @@ type Message struct {
 
 	MXID   id.EventID
 	RoomID id.RoomID
+
+	EmailMessageID string
+	EmailThreadID  string
+
+	Flagged bool
 }
 
 func (msg *Message) Scan(row dbutil.Scannable) (*Message, error) {
@@ -154,11 +222,14 @@ func (msg *Message) Scan(row dbutil.Scannable) (*Message, error) {
 		&msg.EmailReceiver,
 		&msg.MXID,
 		&msg.RoomID,
+		&msg.EmailMessageID,
+		&msg.EmailThreadID,
+		&msg.Flagged,
 	))
 }
 
 func (msg *Message) sqlVariables() []any {
-	return []any{msg.Sender, msg.Timestamp, msg.PartIndex, msg.EmailAddress, msg.EmailReceiver, msg.MXID, msg.RoomID}
+	return []any{msg.Sender, msg.Timestamp, msg.PartIndex, msg.EmailAddress, msg.EmailReceiver, msg.MXID, msg.RoomID, msg.EmailMessageID, msg.EmailThreadID, msg.Flagged}
 }
 
 func (msg *Message) Insert(ctx context.Context) error {
@@ -172,3 +243,12 @@ func (msg *Message) Delete(ctx context.Context) error {
 func (msg *Message) SetTimestamp(ctx context.Context, editTime uint64) error {
 	return msg.qh.Exec(ctx, updateMessageTimestampQuery, msg.Sender, msg.Timestamp, msg.EmailReceiver, editTime)
 }
+
+// SetFlagged updates the flagged state of all parts of the email.
+func (msg *Message) SetFlagged(ctx context.Context, flagged bool) error {
+	err := msg.qh.Exec(ctx, updateMessageFlaggedQuery, msg.Sender, msg.Timestamp, msg.EmailReceiver, flagged)
+	if err == nil {
+		msg.Flagged = flagged
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getDueOutboxMessagesQuery = `
+        SELECT mxid, mx_room, user_mxid, email_message_id, email_thread_id, edit_target, recipients, raw, attempts, created_at, next_attempt, error_notice, scheduled_for, text FROM outbox
+        WHERE next_attempt<=$1
+        ORDER BY created_at ASC
+    `
+	getOutboxMessageByMXIDQuery = `
+        SELECT mxid, mx_room, user_mxid, email_message_id, email_thread_id, edit_target, recipients, raw, attempts, created_at, next_attempt, error_notice, scheduled_for, text FROM outbox
+        WHERE mxid=$1
+    `
+	getScheduledOutboxMessagesQuery = `
+        SELECT mxid, mx_room, user_mxid, email_message_id, email_thread_id, edit_target, recipients, raw, attempts, created_at, next_attempt, error_notice, scheduled_for, text FROM outbox
+        WHERE mx_room=$1 AND scheduled_for IS NOT NULL AND attempts=0
+        ORDER BY scheduled_for ASC
+    `
+	getNextOutboxAttemptQuery = `SELECT MIN(next_attempt) FROM outbox`
+	insertOutboxMessageQuery  = `
+        INSERT INTO outbox (mxid, mx_room, user_mxid, email_message_id, email_thread_id, edit_target, recipients, raw, attempts, created_at, next_attempt, error_notice, scheduled_for, text)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+    `
+	updateOutboxMessageQuery = `UPDATE outbox SET attempts=$2, next_attempt=$3, error_notice=$4 WHERE mxid=$1`
+	deleteOutboxMessageQuery = `DELETE FROM outbox WHERE mxid=$1`
+)
+
+type OutboxQuery struct {
+	*dbutil.QueryHelper[*OutboxMessage]
+}
+
+// GetDue returns the queued messages that should be submitted at the given time.
+func (oq *OutboxQuery) GetDue(ctx context.Context, now time.Time) ([]*OutboxMessage, error) {
+	return oq.QueryMany(ctx, getDueOutboxMessagesQuery, now.UnixMilli())
+}
+
+func (oq *OutboxQuery) GetByMXID(ctx context.Context, mxid id.EventID) (*OutboxMessage, error) {
+	return oq.QueryOne(ctx, getOutboxMessageByMXIDQuery, mxid)
+}
+
+// GetScheduled returns the messages in the room that are waiting for their
+// scheduled send time.
+func (oq *OutboxQuery) GetScheduled(ctx context.Context, roomID id.RoomID) ([]*OutboxMessage, error) {
+	return oq.QueryMany(ctx, getScheduledOutboxMessagesQuery, roomID)
+}
+
+// GetNextAttempt returns the time of the next scheduled submission, or a zero
+// time if the outbox is empty.
+func (oq *OutboxQuery) GetNextAttempt(ctx context.Context) (time.Time, error) {
+	var next sql.NullInt64
+	err := oq.GetDB().QueryRow(ctx, getNextOutboxAttemptQuery).Scan(&next)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, err
+	} else if !next.Valid {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(next.Int64), nil
+}
+
+// OutboxMessage is an email composed from a Matrix message that hasn't been
+// accepted by the SMTP server yet.
+type OutboxMessage struct {
+	qh *dbutil.QueryHelper[*OutboxMessage]
+
+	MXID     id.EventID
+	RoomID   id.RoomID
+	UserMXID id.UserID
+
+	EmailMessageID string
+	EmailThreadID  string
+	// EditTarget is the original message if the email was sent for an edit.
+	EditTarget id.EventID
+
+	Recipients []string
+	Raw        []byte
+
+	Attempts    int
+	CreatedAt   time.Time
+	NextAttempt time.Time
+	// ErrorNotice is the notice that tells the user about failed attempts.
+	ErrorNotice id.EventID
+	// ScheduledFor is the time the user asked the message to be sent at, or
+	// a zero time if it was sent immediately.
+	ScheduledFor time.Time
+	// Text is the plain text of the Matrix message, stored after sending for
+	// showing changes in edits.
+	Text string
+}
+
+// SendAt returns when the message was first supposed to be sent.
+func (om *OutboxMessage) SendAt() time.Time {
+	if !om.ScheduledFor.IsZero() {
+		return om.ScheduledFor
+	}
+	return om.CreatedAt
+}
+
+func newOutboxMessage(qh *dbutil.QueryHelper[*OutboxMessage]) *OutboxMessage {
+	return &OutboxMessage{qh: qh}
+}
+
+func (om *OutboxMessage) Scan(row dbutil.Scannable) (*OutboxMessage, error) {
+	var recipients string
+	var createdAt, nextAttempt int64
+	var scheduledFor sql.NullInt64
+	err := row.Scan(
+		&om.MXID,
+		&om.RoomID,
+		&om.UserMXID,
+		&om.EmailMessageID,
+		&om.EmailThreadID,
+		&om.EditTarget,
+		&recipients,
+		&om.Raw,
+		&om.Attempts,
+		&createdAt,
+		&nextAttempt,
+		&om.ErrorNotice,
+		&scheduledFor,
+		&om.Text,
+	)
+	if err != nil {
+		return nil, err
+	}
+	om.Recipients = strings.Split(recipients, ",")
+	om.CreatedAt = time.UnixMilli(createdAt)
+	om.NextAttempt = time.UnixMilli(nextAttempt)
+	if scheduledFor.Valid {
+		om.ScheduledFor = time.UnixMilli(scheduledFor.Int64)
+	}
+	return om, nil
+}
+
+func (om *OutboxMessage) sqlVariables() []any {
+	var scheduledFor *int64
+	if !om.ScheduledFor.IsZero() {
+		ms := om.ScheduledFor.UnixMilli()
+		scheduledFor = &ms
+	}
+	return []any{
+		om.MXID,
+		om.RoomID,
+		om.UserMXID,
+		om.EmailMessageID,
+		om.EmailThreadID,
+		om.EditTarget,
+		strings.Join(om.Recipients, ","),
+		om.Raw,
+		om.Attempts,
+		om.CreatedAt.UnixMilli(),
+		om.NextAttempt.UnixMilli(),
+		om.ErrorNotice,
+		scheduledFor,
+		om.Text,
+	}
+}
+
+func (om *OutboxMessage) Insert(ctx context.Context) error {
+	return om.qh.Exec(ctx, insertOutboxMessageQuery, om.sqlVariables()...)
+}
+
+// Update saves the retry state of the message.
+func (om *OutboxMessage) Update(ctx context.Context) error {
+	return om.qh.Exec(ctx, updateOutboxMessageQuery, om.MXID, om.Attempts, om.NextAttempt.UnixMilli(), om.ErrorNotice)
+}
+
+func (om *OutboxMessage) Delete(ctx context.Context) error {
+	return om.qh.Exec(ctx, deleteOutboxMessageQuery, om.MXID)
+}
@@ -10,8 +10,9 @@ import (
 
 const (
 	portalBaseSelect = `
-        SELECT thread_id, receiver, mxid, name, email_address, topic, avatar_path, avatar_hash, avatar_url,
-               name_set, avatar_set, topic_set, revision, encrypted, relay_user_id, expiration_time
+        SELECT thread_id, receiver, mxid, name, email_address, topic, subject, avatar_path, avatar_hash, avatar_url,
+               name_set, avatar_set, topic_set, revision, encrypted, relay_user_id, expiration_time, new_thread,
+               list_post, list_unsubscribe, list_unsubscribe_post, favourite_set
         FROM portal
     `
 	getAllPortalsWithMXIDQuery = portalBaseSelect + `WHERE mxid IS NOT NULL`
@@ -21,14 +22,17 @@ const (
 	getPortalsByReceiverQuery  = portalBaseSelect + `WHERE receiver=$1`
 	insertPortalQuery          = `
         INSERT INTO portal (
-            thread_id, receiver, mxid, name, email_address, topic, avatar_path, avatar_hash, avatar_url,
-            name_set, avatar_set, topic_set, revision, encrypted, relay_user_id, expiration_time
-        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+            thread_id, receiver, mxid, name, email_address, topic, subject, avatar_path, avatar_hash, avatar_url,
+            name_set, avatar_set, topic_set, revision, encrypted, relay_user_id, expiration_time, new_thread,
+            list_post, list_unsubscribe, list_unsubscribe_post, favourite_set
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)
     `
 	updatePortalQuery = `
         UPDATE portal SET
-            mxid=$3, name=$4, email_address=$5, topic=$6, avatar_path=$7, avatar_hash=$8, avatar_url=$9,
-            name_set=$10, avatar_set=$11, topic_set=$12, revision=$13, encrypted=$14, relay_user_id=$15, expiration_time=$16
+            mxid=$3, name=$4, email_address=$5, topic=$6, subject=$7, avatar_path=$8, avatar_hash=$9, avatar_url=$10,
+            name_set=$11, avatar_set=$12, topic_set=$13, revision=$14, encrypted=$15, relay_user_id=$16, expiration_time=$17,
+            new_thread=$18, list_post=$19, list_unsubscribe=$20, list_unsubscribe_post=$21,
+            favourite_set=$22
         WHERE thread_id=$1 AND receiver=$2
     `
 	deletePortalQuery = `DELETE FROM portal WHERE thread_id=$1 AND receiver=$2`
@@ -52,6 +56,7 @@ type Portal struct {
 	Name           string
 	EmailAddress   string
 	Topic          string
+	Subject        string
 	AvatarPath     string
 	AvatarHash     string
 	AvatarURL      id.ContentURI
@@ -62,6 +67,15 @@ type Portal struct {
 	Encrypted      bool
 	RelayUserID    id.UserID
 	ExpirationTime uint32
+	NewThread      bool
+	ListPost       string
+
+	ListUnsubscribe     string
+	ListUnsubscribePost string
+
+	// FavouriteSet is true if the bridge added the favourite tag because a
+	// message in the portal was flagged.
+	FavouriteSet bool
 }
 
 func NewPortalKey(threadID string, receiver string) PortalKey {
@@ -86,7 +100,9 @@ func (p *Portal) Scan(row dbutil.Scannable) (*Portal, error) {
 		&p.Receiver,
 		&mxid,
 		&p.Name,
+		&p.EmailAddress,
 		&p.Topic,
+		&p.Subject,
 		&p.AvatarPath,
 		&p.AvatarHash,
 		&p.AvatarURL,
@@ -97,6 +113,11 @@ func (p *Portal) Scan(row dbutil.Scannable) (*Portal, error) {
 		&p.Encrypted,
 		&p.RelayUserID,
 		&p.ExpirationTime,
+		&p.NewThread,
+		&p.ListPost,
+		&p.ListUnsubscribe,
+		&p.ListUnsubscribePost,
+		&p.FavouriteSet,
 	)
 	if err != nil {
 		return nil, err
@@ -111,10 +132,12 @@ func (p *Portal) sqlVariables() []any {
 		p.Receiver,
 		dbutil.StrPtr(p.MXID),
 		p.Name,
+		p.EmailAddress,
 		p.Topic,
+		p.Subject,
 		p.AvatarPath,
 		p.AvatarHash,
-		p.AvatarURL,
+		&p.AvatarURL,
 		p.NameSet,
 		p.AvatarSet,
 		p.TopicSet,
@@ -122,6 +145,11 @@ func (p *Portal) sqlVariables() []any {
 		p.Encrypted,
 		p.RelayUserID,
 		p.ExpirationTime,
+		p.NewThread,
+		p.ListPost,
+		p.ListUnsubscribe,
+		p.ListUnsubscribePost,
+		p.FavouriteSet,
 	}
 }
 
@@ -8,19 +8,27 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
-// email_address, name, name_set, custom_mxid, access_token
 const (
-	puppetBaseSelect           = `SELECT email_address, name, name_set, custom_mxid, access_token FROM puppet `
-	getPuppetByMetaIDQuery     = puppetBaseSelect + `WHERE id=$1`
-	getPuppetByCustomMXIDQuery = puppetBaseSelect + `WHERE custom_mxid=$1`
-	getPuppetsWithCustomMXID   = puppetBaseSelect + `WHERE custom_mxid<>''`
-	updatePuppetQuery          = `UPDATE puppet SET name=$2, name_set=$3, custom_mxid=$3, access_token=$4 WHERE email_address=$1`
-	insertPuppetQuery          = `
-		INSERT INTO puppet (
-						email_address, name, name_set, custom_mxid, access_token
-		)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`
+	puppetBaseSelect = `
+        SELECT email_address, name, name_quality, avatar_path, avatar_hash, avatar_url, name_set, avatar_set,
+               custom_mxid, access_token
+        FROM puppet
+    `
+	getPuppetByEmailAddressQuery = puppetBaseSelect + `WHERE email_address=$1`
+	getPuppetByCustomMXIDQuery   = puppetBaseSelect + `WHERE custom_mxid=$1`
+	getPuppetsWithCustomMXID     = puppetBaseSelect + `WHERE custom_mxid<>''`
+	updatePuppetQuery            = `
+        UPDATE puppet SET
+            name=$2, name_quality=$3, avatar_path=$4, avatar_hash=$5, avatar_url=$6, name_set=$7, avatar_set=$8,
+            custom_mxid=$9, access_token=$10
+        WHERE email_address=$1
+    `
+	insertPuppetQuery = `
+        INSERT INTO puppet (
+            email_address, name, name_quality, avatar_path, avatar_hash, avatar_url, name_set, avatar_set,
+            custom_mxid, access_token
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+    `
 )
 
 type PuppetQuery struct {
@@ -32,8 +40,12 @@ type Puppet struct {
 
 	EmailAddress string
 	Name         string
-
-	NameSet bool
+	NameQuality  int
+	AvatarPath   string
+	AvatarHash   string
+	AvatarURL    id.ContentURI
+	NameSet      bool
+	AvatarSet    bool
 
 	CustomMXID  id.UserID
 	AccessToken string
@@ -44,7 +56,7 @@ func newPuppet(qh *dbutil.QueryHelper[*Puppet]) *Puppet {
 }
 
 func (pq *PuppetQuery) GetByEmailAddress(ctx context.Context, email string) (*Puppet, error) {
-	return pq.QueryOne(ctx, getPuppetByMetaIDQuery, email)
+	return pq.QueryOne(ctx, getPuppetByEmailAddressQuery, email)
 }
 
 func (pq *PuppetQuery) GetByCustomMXID(ctx context.Context, mxid id.UserID) (*Puppet, error) {
@@ -60,7 +72,12 @@ func (p *Puppet) Scan(row dbutil.Scannable) (*Puppet, error) {
 	err := row.Scan(
 		&p.EmailAddress,
 		&p.Name,
+		&p.NameQuality,
+		&p.AvatarPath,
+		&p.AvatarHash,
+		&p.AvatarURL,
 		&p.NameSet,
+		&p.AvatarSet,
 		&customMXID,
 		&p.AccessToken,
 	)
@@ -75,16 +92,21 @@ func (p *Puppet) sqlVariables() []any {
 	return []any{
 		p.EmailAddress,
 		p.Name,
+		p.NameQuality,
+		p.AvatarPath,
+		p.AvatarHash,
+		&p.AvatarURL,
 		p.NameSet,
-		p.AccessToken,
+		p.AvatarSet,
 		dbutil.StrPtr(p.CustomMXID),
+		p.AccessToken,
 	}
 }
 
 func (p *Puppet) Insert(ctx context.Context) error {
-	return p.qh.Exec(ctx, insertPortalQuery, p.sqlVariables()...)
+	return p.qh.Exec(ctx, insertPuppetQuery, p.sqlVariables()...)
 }
 
 func (p *Puppet) Update(ctx context.Context) error {
-	return p.qh.Exec(ctx, updatePortalQuery, p.sqlVariables()...)
+	return p.qh.Exec(ctx, updatePuppetQuery, p.sqlVariables()...)
 }
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getReadReceiptRequestsBeforeQuery = `
+        SELECT email_receiver, email_message_id, mxid, mx_room, timestamp, notify_to, to_sender, subject, asked FROM read_receipt_request
+        WHERE mx_room=$1 AND timestamp<=$2
+        ORDER BY timestamp ASC
+    `
+	getReadReceiptRequestQuery = `
+        SELECT email_receiver, email_message_id, mxid, mx_room, timestamp, notify_to, to_sender, subject, asked FROM read_receipt_request
+        WHERE email_receiver=$1 AND email_message_id=$2
+    `
+	getAskedReadReceiptRequestsQuery = `
+        SELECT email_receiver, email_message_id, mxid, mx_room, timestamp, notify_to, to_sender, subject, asked FROM read_receipt_request
+        WHERE mx_room=$1 AND asked=true
+        ORDER BY timestamp ASC
+    `
+	insertReadReceiptRequestQuery = `
+        INSERT INTO read_receipt_request (email_receiver, email_message_id, mxid, mx_room, timestamp, notify_to, to_sender, subject, asked)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    `
+	markReadReceiptRequestAskedQuery = `UPDATE read_receipt_request SET asked=true WHERE email_receiver=$1 AND email_message_id=$2`
+	deleteReadReceiptRequestQuery    = `DELETE FROM read_receipt_request WHERE email_receiver=$1 AND email_message_id=$2`
+)
+
+type ReadReceiptRequestQuery struct {
+	*dbutil.QueryHelper[*ReadReceiptRequest]
+}
+
+// GetByEmailMessageID returns the read receipt request of an email, or nil if
+// it has been answered.
+func (rrq *ReadReceiptRequestQuery) GetByEmailMessageID(ctx context.Context, receiver, messageID string) (*ReadReceiptRequest, error) {
+	return rrq.QueryOne(ctx, getReadReceiptRequestQuery, receiver, messageID)
+}
+
+// GetAllBefore returns the unanswered read receipt requests of messages in
+// the room that were bridged at or before the given time.
+func (rrq *ReadReceiptRequestQuery) GetAllBefore(ctx context.Context, roomID id.RoomID, timestamp uint64) ([]*ReadReceiptRequest, error) {
+	return rrq.QueryMany(ctx, getReadReceiptRequestsBeforeQuery, roomID, int64(timestamp))
+}
+
+// GetAllAsked returns the requests in the room that the user was asked about.
+func (rrq *ReadReceiptRequestQuery) GetAllAsked(ctx context.Context, roomID id.RoomID) ([]*ReadReceiptRequest, error) {
+	return rrq.QueryMany(ctx, getAskedReadReceiptRequestsQuery, roomID)
+}
+
+// ReadReceiptRequest is an incoming email with a Disposition-Notification-To
+// header that hasn't been answered yet.
+type ReadReceiptRequest struct {
+	qh *dbutil.QueryHelper[*ReadReceiptRequest]
+
+	EmailReceiver  string
+	EmailMessageID string
+
+	MXID      id.EventID
+	RoomID    id.RoomID
+	Timestamp uint64
+
+	NotifyTo string
+	// ToSender is true if NotifyTo is the sender of the email. Read receipts
+	// to other addresses are never sent without asking.
+	ToSender bool
+	Subject  string
+	// Asked is true if the user was asked whether to send the read receipt.
+	Asked bool
+}
+
+func newReadReceiptRequest(qh *dbutil.QueryHelper[*ReadReceiptRequest]) *ReadReceiptRequest {
+	return &ReadReceiptRequest{qh: qh}
+}
+
+func (rr *ReadReceiptRequest) Scan(row dbutil.Scannable) (*ReadReceiptRequest, error) {
+	return dbutil.ValueOrErr(rr, row.Scan(
+		&rr.EmailReceiver,
+		&rr.EmailMessageID,
+		&rr.MXID,
+		&rr.RoomID,
+		&rr.Timestamp,
+		&rr.NotifyTo,
+		&rr.ToSender,
+		&rr.Subject,
+		&rr.Asked,
+	))
+}
+
+func (rr *ReadReceiptRequest) sqlVariables() []any {
+	return []any{rr.EmailReceiver, rr.EmailMessageID, rr.MXID, rr.RoomID, rr.Timestamp, rr.NotifyTo, rr.ToSender, rr.Subject, rr.Asked}
+}
+
+func (rr *ReadReceiptRequest) Insert(ctx context.Context) error {
+	return rr.qh.Exec(ctx, insertReadReceiptRequestQuery, rr.sqlVariables()...)
+}
+
+func (rr *ReadReceiptRequest) MarkAsked(ctx context.Context) error {
+	rr.Asked = true
+	return rr.qh.Exec(ctx, markReadReceiptRequestAskedQuery, rr.EmailReceiver, rr.EmailMessageID)
+}
+
+func (rr *ReadReceiptRequest) Delete(ctx context.Context) error {
+	return rr.qh.Exec(ctx, deleteReadReceiptRequestQuery, rr.EmailReceiver, rr.EmailMessageID)
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getSentMessageQuery    = `SELECT mxid, text, sent_at FROM sent_message WHERE mxid=$1`
+	insertSentMessageQuery = `INSERT INTO sent_message (mxid, text, sent_at) VALUES ($1, $2, $3)`
+	updateSentMessageQuery = `UPDATE sent_message SET text=$2 WHERE mxid=$1`
+)
+
+type SentMessageQuery struct {
+	*dbutil.QueryHelper[*SentMessage]
+}
+
+func (smq *SentMessageQuery) GetByMXID(ctx context.Context, mxid id.EventID) (*SentMessage, error) {
+	return smq.QueryOne(ctx, getSentMessageQuery, mxid)
+}
+
+// SentMessage is the text of an email sent from Matrix, used for showing what
+// changed when the message is edited.
+type SentMessage struct {
+	qh *dbutil.QueryHelper[*SentMessage]
+
+	MXID id.EventID
+	// Text is the latest version of the message, including edits.
+	Text   string
+	SentAt time.Time
+}
+
+func newSentMessage(qh *dbutil.QueryHelper[*SentMessage]) *SentMessage {
+	return &SentMessage{qh: qh}
+}
+
+func (sm *SentMessage) Scan(row dbutil.Scannable) (*SentMessage, error) {
+	var sentAt int64
+	err := row.Scan(&sm.MXID, &sm.Text, &sentAt)
+	if err != nil {
+		return nil, err
+	}
+	sm.SentAt = time.UnixMilli(sentAt)
+	return sm, nil
+}
+
+func (sm *SentMessage) Insert(ctx context.Context) error {
+	return sm.qh.Exec(ctx, insertSentMessageQuery, sm.MXID, sm.Text, sm.SentAt.UnixMilli())
+}
+
+// UpdateText saves the text of the message after an edit.
+func (sm *SentMessage) UpdateText(ctx context.Context) error {
+	return sm.qh.Exec(ctx, updateSentMessageQuery, sm.MXID, sm.Text)
+}
@@ -0,0 +1,3 @@
+-- v14: Store IMAP and SMTP server addresses for users
+ALTER TABLE "user" ADD COLUMN imap_server TEXT;
+ALTER TABLE "user" ADD COLUMN smtp_server TEXT;
@@ -0,0 +1,2 @@
+-- v15: Store email subject of portals
+ALTER TABLE portal ADD COLUMN subject TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- v16: Store email Message-IDs for threading
+ALTER TABLE message ADD COLUMN email_message_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE portal ADD COLUMN new_thread BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,4 @@
+-- v17: Store CardDAV contact sync settings for users
+ALTER TABLE "user" ADD COLUMN carddav_url TEXT;
+ALTER TABLE "user" ADD COLUMN carddav_username TEXT;
+ALTER TABLE "user" ADD COLUMN carddav_password TEXT;
@@ -0,0 +1,3 @@
+-- v18: Track flagged messages and whether the bridge favourited the portal
+ALTER TABLE message ADD COLUMN flagged BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE portal ADD COLUMN favourite_set BOOLEAN NOT NULL DEFAULT false;
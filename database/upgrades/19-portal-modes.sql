@@ -0,0 +1,3 @@
+-- v19: Add room-per-thread portal mode
+ALTER TABLE "user" ADD COLUMN portal_mode TEXT;
+ALTER TABLE message ADD COLUMN email_thread_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- v20: Add mailing list portals
+ALTER TABLE portal ADD COLUMN list_post TEXT NOT NULL DEFAULT '';
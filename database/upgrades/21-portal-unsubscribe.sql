@@ -0,0 +1,3 @@
+-- v21: Store unsubscription headers of portals
+ALTER TABLE portal ADD COLUMN list_unsubscribe TEXT NOT NULL DEFAULT '';
+ALTER TABLE portal ADD COLUMN list_unsubscribe_post TEXT NOT NULL DEFAULT '';
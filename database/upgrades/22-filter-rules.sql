@@ -0,0 +1,13 @@
+-- v22: Add per-user filter rules
+CREATE TABLE filter_rule (
+    user_mxid TEXT    NOT NULL,
+    priority  INTEGER NOT NULL,
+    field     TEXT    NOT NULL,
+    pattern   TEXT    NOT NULL,
+    action    TEXT    NOT NULL,
+    target    TEXT    NOT NULL DEFAULT '',
+
+    PRIMARY KEY (user_mxid, priority),
+    CONSTRAINT filter_rule_user_fkey FOREIGN KEY (user_mxid)
+        REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
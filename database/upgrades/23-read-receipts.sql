@@ -0,0 +1,18 @@
+-- v23: Add read receipt requests and per-user read receipt policy
+ALTER TABLE "user" ADD COLUMN read_receipt_policy TEXT;
+
+CREATE TABLE read_receipt_request (
+    email_receiver   TEXT    NOT NULL,
+    email_message_id TEXT    NOT NULL,
+    mxid             TEXT    NOT NULL,
+    mx_room          TEXT    NOT NULL,
+    timestamp        BIGINT  NOT NULL,
+    notify_to        TEXT    NOT NULL,
+    subject          TEXT    NOT NULL,
+    to_sender        BOOLEAN NOT NULL DEFAULT false,
+    asked            BOOLEAN NOT NULL DEFAULT false,
+
+    PRIMARY KEY (email_receiver, email_message_id),
+    CONSTRAINT read_receipt_request_mxid_fkey FOREIGN KEY (mxid)
+        REFERENCES message(mxid) ON DELETE CASCADE
+);
@@ -0,0 +1,18 @@
+-- v24: Add outbox for retrying failed email submissions
+CREATE TABLE outbox (
+    mxid             TEXT    PRIMARY KEY,
+    mx_room          TEXT    NOT NULL,
+    user_mxid        TEXT    NOT NULL,
+    email_message_id TEXT    NOT NULL,
+    email_thread_id  TEXT    NOT NULL,
+    edit_target      TEXT    NOT NULL DEFAULT '',
+    recipients       TEXT    NOT NULL,
+    raw              bytea   NOT NULL,
+    attempts         INTEGER NOT NULL DEFAULT 0,
+    created_at       BIGINT  NOT NULL,
+    next_attempt     BIGINT  NOT NULL,
+    error_notice     TEXT    NOT NULL DEFAULT '',
+
+    CONSTRAINT outbox_user_fkey FOREIGN KEY (user_mxid)
+        REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+-- v25: Add scheduled send time to outbox
+ALTER TABLE outbox ADD COLUMN scheduled_for BIGINT;
@@ -0,0 +1,2 @@
+-- v26: Add per-user undo send delay
+ALTER TABLE "user" ADD COLUMN undo_send_delay TEXT;
@@ -0,0 +1,11 @@
+-- v27: Remember the text of sent email for edit corrections
+ALTER TABLE outbox ADD COLUMN text TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE sent_message (
+    mxid    TEXT   PRIMARY KEY,
+    text    TEXT   NOT NULL,
+    sent_at BIGINT NOT NULL,
+
+    CONSTRAINT sent_message_mxid_fkey FOREIGN KEY (mxid)
+        REFERENCES message(mxid) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+-- v28: Add per-user quoted text setting
+ALTER TABLE "user" ADD COLUMN quoted_text TEXT;
@@ -9,12 +9,12 @@ import (
 )
 
 const (
-	getUserBaseQuery           = `SELECT mxid, email_address, password, management_room, space_room FROM "user" `
+	getUserBaseQuery           = `SELECT mxid, email_address, password, imap_server, smtp_server, management_room, space_room, carddav_url, carddav_username, carddav_password, portal_mode, read_receipt_policy, undo_send_delay, quoted_text FROM "user" `
 	getUserByMXIDQuery         = getUserBaseQuery + `WHERE mxid=$1`
 	getUserByEmailAddressQuery = getUserBaseQuery + `WHERE email_address=$1`
 	getAllLoggedInUsersQuery   = getUserBaseQuery + `WHERE email_address IS NOT NULL`
-	insertUserQuery            = `INSERT INTO "user" (mxid, email_address, password, management_room, space_room) VALUES ($1, $2, $3, $4, $5)`
-	updateUserQuery            = `UPDATE "user" SET email_address=$2, password=$3, management_room=$4, space_room=$5 WHERE mxid=$1`
+	insertUserQuery            = `INSERT INTO "user" (mxid, email_address, password, imap_server, smtp_server, management_room, space_room, carddav_url, carddav_username, carddav_password, portal_mode, read_receipt_policy, undo_send_delay, quoted_text) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
+	updateUserQuery            = `UPDATE "user" SET email_address=$2, password=$3, imap_server=$4, smtp_server=$5, management_room=$6, space_room=$7, carddav_url=$8, carddav_username=$9, carddav_password=$10, portal_mode=$11, read_receipt_policy=$12, undo_send_delay=$13, quoted_text=$14 WHERE mxid=$1`
 )
 
 type UserQuery struct {
@@ -39,8 +39,19 @@ type User struct {
 	MXID           id.UserID
 	EmailAddress   string
 	Password       string
+	IMAPServer     string
+	SMTPServer     string
 	ManagementRoom id.RoomID
 	SpaceRoom      id.RoomID
+
+	CardDAVURL      string
+	CardDAVUsername string
+	CardDAVPassword string
+
+	PortalMode        string
+	ReadReceiptPolicy string
+	UndoSendDelay     string
+	QuotedText        string
 }
 
 func newUser(qh *dbutil.QueryHelper[*User]) *User {
@@ -50,21 +61,40 @@ func newUser(qh *dbutil.QueryHelper[*User]) *User {
 }
 
 func (u *User) Scan(row dbutil.Scannable) (*User, error) {
-	var emailAddress, password, managementRoom, spaceRoom sql.NullString
+	var emailAddress, password, imapServer, smtpServer, managementRoom, spaceRoom sql.NullString
+	var carddavURL, carddavUsername, carddavPassword, portalMode, readReceiptPolicy, undoSendDelay, quotedText sql.NullString
 	err := row.Scan(
 		&u.MXID,
 		&emailAddress,
 		&password,
+		&imapServer,
+		&smtpServer,
 		&managementRoom,
 		&spaceRoom,
+		&carddavURL,
+		&carddavUsername,
+		&carddavPassword,
+		&portalMode,
+		&readReceiptPolicy,
+		&undoSendDelay,
+		&quotedText,
 	)
 	if err != nil {
 		return nil, err
 	}
 	u.EmailAddress = emailAddress.String
 	u.Password = password.String
+	u.IMAPServer = imapServer.String
+	u.SMTPServer = smtpServer.String
 	u.ManagementRoom = id.RoomID(managementRoom.String)
 	u.SpaceRoom = id.RoomID(spaceRoom.String)
+	u.CardDAVURL = carddavURL.String
+	u.CardDAVUsername = carddavUsername.String
+	u.CardDAVPassword = carddavPassword.String
+	u.PortalMode = portalMode.String
+	u.ReadReceiptPolicy = readReceiptPolicy.String
+	u.UndoSendDelay = undoSendDelay.String
+	u.QuotedText = quotedText.String
 	return u, nil
 }
 
@@ -73,8 +103,17 @@ func (u *User) sqlVariables() []any {
 		u.MXID,
 		dbutil.StrPtr(u.EmailAddress),
 		dbutil.StrPtr(u.Password),
+		dbutil.StrPtr(u.IMAPServer),
+		dbutil.StrPtr(u.SMTPServer),
 		dbutil.StrPtr(u.ManagementRoom),
 		dbutil.StrPtr(u.SpaceRoom),
+		dbutil.StrPtr(u.CardDAVURL),
+		dbutil.StrPtr(u.CardDAVUsername),
+		dbutil.StrPtr(u.CardDAVPassword),
+		dbutil.StrPtr(u.PortalMode),
+		dbutil.StrPtr(u.ReadReceiptPolicy),
+		dbutil.StrPtr(u.UndoSendDelay),
+		dbutil.StrPtr(u.QuotedText),
 	}
 }
 
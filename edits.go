@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"imap-bridge/config"
+	"imap-bridge/database"
+)
+
+// checkEdit returns an error if the edit mode or window don't allow editing
+// the target message.
+func (portal *Portal) checkEdit(ctx context.Context, target *database.Message) error {
+	if portal.bridge.Config.Bridge.EditMode == config.EditModeReject {
+		return errEditsRejected
+	}
+	window := portal.bridge.Config.Bridge.EditWindow
+	if window <= 0 {
+		return nil
+	}
+	sentAt := time.UnixMilli(int64(target.Timestamp))
+	sent, err := portal.bridge.DB.SentMessage.GetByMXID(ctx, target.MXID)
+	if err != nil {
+		return err
+	} else if sent != nil {
+		sentAt = sent.SentAt
+	}
+	if time.Since(sentAt) > window {
+		return errEditTooOld
+	}
+	return nil
+}
+
+// correctionText returns the body of a correction email, which shows the
+// changes from the previously sent version of the message.
+func (portal *Portal) correctionText(ctx context.Context, target *database.Message, newText string) string {
+	sent, err := portal.bridge.DB.SentMessage.GetByMXID(ctx, target.MXID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get previous text of edited message")
+	}
+	if sent == nil || sent.Text == "" {
+		return "Correction:\n\n" + newText
+	}
+	return "Correction:\n\n" + lineDiff(sent.Text, newText) + "\n\nCorrected message:\n\n" + newText
+}
+
+// lineDiff returns a line-based diff of two texts, with removed lines
+// prefixed with "- " and added lines with "+ ". Unchanged lines are omitted.
+func lineDiff(oldText, newText string) string {
+	oldLines := strings.Split(oldText, "\n")
+	newLines := strings.Split(newText, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of
+	// oldLines[i:] and newLines[j:].
+	lcs := make([][]int, len(oldLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var out []string
+	i, j := 0, 0
+	for i < len(oldLines) || j < len(newLines) {
+		switch {
+		case i < len(oldLines) && j < len(newLines) && oldLines[i] == newLines[j]:
+			i++
+			j++
+		case i < len(oldLines) && (j == len(newLines) || lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "- "+oldLines[i])
+			i++
+		default:
+			out = append(out, "+ "+newLines[j])
+			j++
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// storeSentText remembers the text of a sent message, or the new text of an
+// edited message, for showing the changes in later corrections.
+func (portal *Portal) storeSentText(ctx context.Context, target *database.Message, msg *database.OutboxMessage) {
+	log := zerolog.Ctx(ctx)
+	if target == nil {
+		sent := portal.bridge.DB.SentMessage.New()
+		sent.MXID = msg.MXID
+		sent.Text = msg.Text
+		sent.SentAt = time.Now()
+		if err := sent.Insert(ctx); err != nil {
+			log.Err(err).Msg("Failed to save text of sent message")
+		}
+		return
+	}
+	sent, err := portal.bridge.DB.SentMessage.GetByMXID(ctx, target.MXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get text of edited message")
+		return
+	} else if sent == nil {
+		// The message was sent before texts were saved
+		sent = portal.bridge.DB.SentMessage.New()
+		sent.MXID = target.MXID
+		sent.Text = msg.Text
+		sent.SentAt = time.UnixMilli(int64(target.Timestamp))
+		err = sent.Insert(ctx)
+	} else {
+		sent.Text = msg.Text
+		err = sent.UpdateText(ctx)
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to save text of edited message")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+
+	"imap-bridge/config"
+	"imap-bridge/pkg/emailmeow/events"
+)
+
+// convertEmailHTML converts the HTML body of an email to Matrix HTML. Images
+// that are attached to the email and referenced with cid: URLs are uploaded
+// to the media repository, and remote images are handled as configured.
+// If splitQuote is true, the quoted previous messages and signature are
+// returned separately.
+func (portal *Portal) convertEmailHTML(ctx context.Context, intent *appservice.IntentAPI, msg *events.Message, splitQuote bool) (formatted, quoted string, err error) {
+	doc, err := html.Parse(strings.NewReader(msg.HTML))
+	if err != nil {
+		return "", "", err
+	}
+	body := findElement(doc, atom.Body)
+	if body == nil {
+		body = doc
+	}
+	var quote *html.Node
+	if splitQuote {
+		quote = splitQuotedHTML(body)
+	}
+	uploaded := make(map[string]id.ContentURIString)
+	formatted, err = portal.renderEmailHTML(ctx, intent, msg, body, uploaded)
+	if err != nil || quote == nil {
+		return
+	}
+	quoted, err = portal.renderEmailHTML(ctx, intent, msg, quote, uploaded)
+	return
+}
+
+func (portal *Portal) renderEmailHTML(ctx context.Context, intent *appservice.IntentAPI, msg *events.Message, root *html.Node, uploaded map[string]id.ContentURIString) (string, error) {
+	sanitizeEmailHTML(root)
+	var images []*html.Node
+	walkElements(root, func(node *html.Node) {
+		if node.DataAtom == atom.Img {
+			images = append(images, node)
+		}
+	})
+	for _, img := range images {
+		portal.convertEmailImage(ctx, intent, msg, img, uploaded)
+	}
+	removeEmptyElements(root)
+	trimTrailingBreaks(root)
+	var buf strings.Builder
+	for child := root.FirstChild; child != nil; child = child.NextSibling {
+		err := html.Render(&buf, child)
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func (portal *Portal) convertEmailImage(ctx context.Context, intent *appservice.IntentAPI, msg *events.Message, img *html.Node, uploaded map[string]id.ContentURIString) {
+	src := strings.TrimSpace(getAttr(img, "src"))
+	alt := getAttr(img, "alt")
+	scheme, rest, _ := strings.Cut(src, ":")
+	switch strings.ToLower(scheme) {
+	case "cid":
+		contentID, err := url.PathUnescape(rest)
+		if err != nil {
+			contentID = rest
+		}
+		part := msg.GetInlinePart(contentID)
+		if part == nil {
+			replaceWithText(img, alt)
+			return
+		} else if portal.Encrypted {
+			// Images in HTML can't refer to encrypted media
+			if alt == "" {
+				alt = part.Filename
+			}
+			replaceWithText(img, alt)
+			return
+		}
+		mxc, ok := uploaded[contentID]
+		if !ok {
+			resp, err := intent.UploadBytesWithName(ctx, part.Data, part.ContentType, part.Filename)
+			if err != nil {
+				zerolog.Ctx(ctx).Err(err).Str("content_id", contentID).Msg("Failed to upload inline image")
+				replaceWithText(img, alt)
+				return
+			}
+			mxc = resp.ContentURI.CUString()
+			uploaded[contentID] = mxc
+		}
+		setAttr(img, "src", string(mxc))
+	case "http", "https":
+		if portal.bridge.Config.Bridge.RemoteImages != config.RemoteImagesLink {
+			img.Parent.RemoveChild(img)
+			return
+		}
+		if alt == "" {
+			alt = "image"
+		}
+		link := &html.Node{
+			Type:     html.ElementNode,
+			Data:     "a",
+			DataAtom: atom.A,
+			Attr:     []html.Attribute{{Key: "href", Val: src}},
+		}
+		link.AppendChild(&html.Node{Type: html.TextNode, Data: alt})
+		img.Parent.InsertBefore(link, img)
+		img.Parent.RemoveChild(img)
+	default:
+		replaceWithText(img, alt)
+	}
+}
+
+// replaceWithText replaces an element with a text node, or removes it if the
+// text is empty.
+func replaceWithText(node *html.Node, text string) {
+	if text != "" {
+		node.Parent.InsertBefore(&html.Node{Type: html.TextNode, Data: text}, node)
+	}
+	node.Parent.RemoveChild(node)
+}
+
+func findElement(node *html.Node, tag atom.Atom) (found *html.Node) {
+	walkElements(node, func(node *html.Node) {
+		if found == nil && node.DataAtom == tag {
+			found = node
+		}
+	})
+	return
+}
+
+func walkElements(node *html.Node, fn func(*html.Node)) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode {
+			fn(child)
+		}
+		walkElements(child, fn)
+	}
+}
+
+func getAttr(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(node *html.Node, key, value string) {
+	for i, attr := range node.Attr {
+		if attr.Key == key {
+			node.Attr[i].Val = value
+			return
+		}
+	}
+	node.Attr = append(node.Attr, html.Attribute{Key: key, Val: value})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"imap-bridge/database"
+	"imap-bridge/pkg/emailmeow"
+	"imap-bridge/pkg/emailmeow/events"
+)
+
+type filterAction string
+
+const (
+	filterActionIgnore filterAction = "ignore"
+	filterActionRoom   filterAction = "room"
+	filterActionSilent filterAction = "silent"
+	filterActionRead   filterAction = "read"
+	filterActionMove   filterAction = "move"
+)
+
+const (
+	filterFieldFrom    = "from"
+	filterFieldTo      = "to"
+	filterFieldSubject = "subject"
+	filterFieldListID  = "list-id"
+	filterFieldSize    = "size"
+	// filterFieldHeaderPrefix is followed by the name of the header to match,
+	// e.g. header:X-Mailer
+	filterFieldHeaderPrefix = "header:"
+)
+
+var (
+	errInvalidFilterField  = errors.New("unknown field")
+	errInvalidFilterAction = errors.New("unknown action")
+	errFilterTargetMissing = errors.New("action requires a target")
+)
+
+// filterRule is a database rule with its pattern compiled for matching.
+type filterRule struct {
+	*database.FilterRule
+
+	glob *regexp.Regexp
+	// Size rules match messages larger than minSize or smaller than maxSize
+	minSize, maxSize int64
+}
+
+// compileGlob converts a glob pattern where * matches any number of characters
+// and ? matches a single character into a case-insensitive regex.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	escaped := regexp.QuoteMeta(pattern)
+	escaped = strings.ReplaceAll(escaped, `\*`, ".*")
+	escaped = strings.ReplaceAll(escaped, `\?`, ".")
+	return regexp.Compile("(?is)^" + escaped + "$")
+}
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"b": 1,
+	"k": 1024,
+	"m": 1024 * 1024,
+}
+
+// parseSizePattern parses size patterns like >5M or <10k.
+func parseSizePattern(pattern string) (minSize, maxSize int64, err error) {
+	if len(pattern) < 2 || (pattern[0] != '<' && pattern[0] != '>') {
+		return 0, 0, fmt.Errorf("size must be in the form >N or <N")
+	}
+	numberPart := strings.ToLower(pattern[1:])
+	unitIdx := strings.IndexFunc(numberPart, func(r rune) bool { return r < '0' || r > '9' })
+	unit := ""
+	if unitIdx >= 0 {
+		unit = strings.TrimSuffix(numberPart[unitIdx:], "b")
+		if unit == "" {
+			unit = "b"
+		}
+		numberPart = numberPart[:unitIdx]
+	}
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown size unit %q", unit)
+	}
+	number, err := strconv.ParseInt(numberPart, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid size: %w", err)
+	}
+	if pattern[0] == '>' {
+		return number * multiplier, -1, nil
+	}
+	return -1, number * multiplier, nil
+}
+
+func compileFilterRule(rule *database.FilterRule) (*filterRule, error) {
+	compiled := &filterRule{FilterRule: rule}
+	switch {
+	case rule.Field == filterFieldSize:
+		var err error
+		compiled.minSize, compiled.maxSize, err = parseSizePattern(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+	case rule.Field == filterFieldFrom, rule.Field == filterFieldTo, rule.Field == filterFieldSubject,
+		rule.Field == filterFieldListID,
+		strings.HasPrefix(rule.Field, filterFieldHeaderPrefix) && len(rule.Field) > len(filterFieldHeaderPrefix):
+		var err error
+		compiled.glob, err = compileGlob(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", errInvalidFilterField, rule.Field)
+	}
+	switch filterAction(rule.Action) {
+	case filterActionIgnore, filterActionSilent, filterActionRead:
+	case filterActionRoom, filterActionMove:
+		if rule.Target == "" {
+			return nil, fmt.Errorf("%s %w", rule.Action, errFilterTargetMissing)
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", errInvalidFilterAction, rule.Action)
+	}
+	return compiled, nil
+}
+
+func (rule *filterRule) matchesAny(values ...string) bool {
+	for _, value := range values {
+		if rule.glob.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *filterRule) Matches(msg *events.Message) bool {
+	switch {
+	case rule.Field == filterFieldFrom:
+		return rule.matchesAny(msg.Info.Sender)
+	case rule.Field == filterFieldTo:
+		return rule.matchesAny(msg.Info.Recipients...)
+	case rule.Field == filterFieldSubject:
+		return rule.matchesAny(msg.Info.ThreadName)
+	case rule.Field == filterFieldListID:
+		return msg.Info.List != nil && rule.matchesAny(msg.Info.List.ID)
+	case rule.Field == filterFieldSize:
+		size := int64(len(msg.Raw))
+		return (rule.minSize >= 0 && size > rule.minSize) || (rule.maxSize >= 0 && size < rule.maxSize)
+	case strings.HasPrefix(rule.Field, filterFieldHeaderPrefix):
+		return rule.matchesAny(msg.Header.Values(strings.TrimPrefix(rule.Field, filterFieldHeaderPrefix))...)
+	default:
+		return false
+	}
+}
+
+func (user *User) getFilterRules() []*filterRule {
+	user.filterRulesLock.Lock()
+	defer user.filterRulesLock.Unlock()
+	if user.filterRules != nil {
+		return user.filterRules
+	}
+	dbRules, err := user.bridge.DB.FilterRule.GetAllByUser(context.TODO(), user.MXID)
+	if err != nil {
+		user.log.Err(err).Msg("Failed to load filter rules")
+		return nil
+	}
+	user.filterRules = make([]*filterRule, 0, len(dbRules))
+	for _, dbRule := range dbRules {
+		rule, err := compileFilterRule(dbRule)
+		if err != nil {
+			user.log.Warn().Err(err).Int("filter_rule", dbRule.Priority).Msg("Ignoring invalid filter rule")
+			continue
+		}
+		user.filterRules = append(user.filterRules, rule)
+	}
+	return user.filterRules
+}
+
+// invalidateFilterRules makes the next message reload the rules from the database.
+func (user *User) invalidateFilterRules() {
+	user.filterRulesLock.Lock()
+	user.filterRules = nil
+	user.filterRulesLock.Unlock()
+}
+
+// matchFilterRule returns the first filter rule matching the message. Rules
+// only apply to incoming mail, not to mail the user sent from other clients.
+func (user *User) matchFilterRule(msg *events.Message) *filterRule {
+	if msg.Sent {
+		return nil
+	}
+	for _, rule := range user.getFilterRules() {
+		if rule.Matches(msg) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (user *User) getClient() *emailmeow.Client {
+	user.Lock()
+	defer user.Unlock()
+	return user.Client
+}
+
+func (user *User) markSeen(log zerolog.Logger, uid uint32) {
+	cli := user.getClient()
+	if cli == nil {
+		return
+	}
+	err := cli.MarkSeen(context.TODO(), uid)
+	if err != nil {
+		log.Err(err).Msg("Failed to mark message as read on server")
+	}
+}
+
+func (user *User) moveMessage(log zerolog.Logger, uid uint32, mailbox string) {
+	cli := user.getClient()
+	if cli == nil {
+		return
+	}
+	err := cli.MoveMessage(context.TODO(), uid, mailbox)
+	if err != nil {
+		log.Err(err).Msg("Failed to move message on server")
+	}
+}
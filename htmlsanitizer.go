@@ -0,0 +1,359 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// droppedElements are removed from email HTML together with their content.
+var droppedElements = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Title:    true,
+	atom.Meta:     true,
+	atom.Link:     true,
+	atom.Style:    true,
+	atom.Script:   true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Iframe:   true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Svg:      true,
+	atom.Math:     true,
+	atom.Input:    true,
+	atom.Select:   true,
+	atom.Textarea: true,
+	atom.Button:   true,
+	atom.Audio:    true,
+	atom.Video:    true,
+	atom.Map:      true,
+}
+
+// renamedElements are replaced with the closest element that Matrix allows.
+var renamedElements = map[atom.Atom]atom.Atom{
+	atom.S:          atom.Del,
+	atom.Strike:     atom.Del,
+	atom.Ins:        atom.U,
+	atom.Tt:         atom.Code,
+	atom.Kbd:        atom.Code,
+	atom.Samp:       atom.Code,
+	atom.Var:        atom.I,
+	atom.Cite:       atom.I,
+	atom.Dfn:        atom.I,
+	atom.Mark:       atom.Strong,
+	atom.Center:     atom.Div,
+	atom.Section:    atom.Div,
+	atom.Article:    atom.Div,
+	atom.Header:     atom.Div,
+	atom.Footer:     atom.Div,
+	atom.Main:       atom.Div,
+	atom.Nav:        atom.Div,
+	atom.Aside:      atom.Div,
+	atom.Address:    atom.Div,
+	atom.Figure:     atom.Div,
+	atom.Figcaption: atom.Div,
+	atom.Dl:         atom.Div,
+	atom.Dt:         atom.Div,
+	atom.Dd:         atom.Blockquote,
+	atom.Form:       atom.Div,
+	atom.Fieldset:   atom.Div,
+}
+
+// allowedAttributes lists the elements allowed in Matrix HTML and the
+// attributes allowed on each of them.
+var allowedAttributes = map[atom.Atom][]string{
+	atom.Font:       {"color", "data-mx-bg-color", "data-mx-color"},
+	atom.Del:        nil,
+	atom.H1:         nil,
+	atom.H2:         nil,
+	atom.H3:         nil,
+	atom.H4:         nil,
+	atom.H5:         nil,
+	atom.H6:         nil,
+	atom.Blockquote: nil,
+	atom.P:          nil,
+	atom.A:          {"href"},
+	atom.Ul:         nil,
+	atom.Ol:         {"start"},
+	atom.Sup:        nil,
+	atom.Sub:        nil,
+	atom.Li:         nil,
+	atom.B:          nil,
+	atom.I:          nil,
+	atom.U:          nil,
+	atom.Strong:     nil,
+	atom.Em:         nil,
+	atom.Code:       nil,
+	atom.Hr:         nil,
+	atom.Br:         nil,
+	atom.Div:        nil,
+	atom.Table:      nil,
+	atom.Thead:      nil,
+	atom.Tbody:      nil,
+	atom.Tr:         nil,
+	atom.Th:         nil,
+	atom.Td:         nil,
+	atom.Caption:    nil,
+	atom.Pre:        nil,
+	atom.Span:       {"data-mx-bg-color", "data-mx-color"},
+	atom.Img:        {"src", "alt", "title", "width", "height"},
+	atom.Details:    nil,
+	atom.Summary:    nil,
+}
+
+// allowedLinkSchemes are the URL schemes kept in links.
+var allowedLinkSchemes = []string{"https", "http", "mailto", "ftp", "magnet"}
+
+// keptEmptyElements aren't removed when they have no content.
+var keptEmptyElements = map[atom.Atom]bool{
+	atom.Br:  true,
+	atom.Hr:  true,
+	atom.Img: true,
+	atom.Td:  true,
+	atom.Th:  true,
+	atom.Tr:  true,
+}
+
+// sanitizeEmailHTML reduces email HTML to the elements and attributes that
+// Matrix clients support. Hidden elements and tracking pixels are removed,
+// and tables used for layout are turned into plain blocks. Images are kept
+// with their original source, which must be converted separately.
+func sanitizeEmailHTML(root *html.Node) {
+	sanitizeChildren(root, false)
+	collapseWhitespace(root)
+}
+
+func sanitizeChildren(parent *html.Node, inLayoutTable bool) {
+	for child := parent.FirstChild; child != nil; {
+		next := child.NextSibling
+		sanitizeNode(child, inLayoutTable)
+		child = next
+	}
+}
+
+func sanitizeNode(node *html.Node, inLayoutTable bool) {
+	if node.Type == html.TextNode {
+		return
+	} else if node.Type != html.ElementNode {
+		node.Parent.RemoveChild(node)
+		return
+	}
+	if droppedElements[node.DataAtom] || isHiddenElement(node) || isTrackingPixel(node) {
+		node.Parent.RemoveChild(node)
+		return
+	}
+	switch node.DataAtom {
+	case atom.Table:
+		inLayoutTable = isLayoutTable(node)
+		if inLayoutTable {
+			renameElement(node, atom.Div)
+		}
+	case atom.Thead, atom.Tbody, atom.Tfoot:
+		if inLayoutTable {
+			sanitizeChildren(node, inLayoutTable)
+			unwrapElement(node)
+			return
+		} else if node.DataAtom == atom.Tfoot {
+			renameElement(node, atom.Tbody)
+		}
+	case atom.Tr, atom.Td, atom.Th, atom.Caption:
+		if inLayoutTable {
+			renameElement(node, atom.Div)
+		}
+	}
+	if renamed, ok := renamedElements[node.DataAtom]; ok {
+		renameElement(node, renamed)
+	}
+	attrs, allowed := allowedAttributes[node.DataAtom]
+	sanitizeChildren(node, inLayoutTable)
+	if !allowed {
+		unwrapElement(node)
+		return
+	}
+	filterAttributes(node, attrs)
+	if node.DataAtom == atom.A && getAttr(node, "href") == "" {
+		unwrapElement(node)
+	}
+}
+
+func filterAttributes(node *html.Node, allowed []string) {
+	filtered := node.Attr[:0]
+	for _, attr := range node.Attr {
+		if attr.Namespace != "" || !containsString(allowed, attr.Key) {
+			continue
+		} else if attr.Key == "href" && !isAllowedLink(attr.Val) {
+			continue
+		}
+		filtered = append(filtered, attr)
+	}
+	node.Attr = filtered
+}
+
+func isAllowedLink(href string) bool {
+	scheme, _, found := strings.Cut(strings.TrimSpace(href), ":")
+	return found && containsString(allowedLinkSchemes, strings.ToLower(scheme))
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// isLayoutTable guesses whether a table is used for positioning content,
+// which is how most HTML email is built, rather than for tabular data.
+func isLayoutTable(table *html.Node) bool {
+	if strings.EqualFold(getAttr(table, "role"), "presentation") {
+		return true
+	}
+	var hasHeaders, hasNestedTables bool
+	walkElements(table, func(node *html.Node) {
+		switch node.DataAtom {
+		case atom.Th, atom.Caption:
+			hasHeaders = true
+		case atom.Table:
+			hasNestedTables = true
+		}
+	})
+	return hasNestedTables || !hasHeaders
+}
+
+// isHiddenElement returns true for elements that mail clients don't show,
+// like the preview text that newsletters put at the top.
+func isHiddenElement(node *html.Node) bool {
+	if _, ok := getAttrOK(node, "hidden"); ok {
+		return true
+	}
+	style := parseStyle(getAttr(node, "style"))
+	return style["display"] == "none" || style["visibility"] == "hidden" ||
+		style["max-height"] == "0" || style["max-height"] == "0px" ||
+		style["opacity"] == "0"
+}
+
+// isTrackingPixel returns true for images that are too small to see, which
+// are used to track when the email is opened.
+func isTrackingPixel(node *html.Node) bool {
+	if node.DataAtom != atom.Img {
+		return false
+	}
+	style := parseStyle(getAttr(node, "style"))
+	isTiny := func(attr, styleKey string) bool {
+		value := getAttr(node, attr)
+		if value == "" {
+			value = style[styleKey]
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), "px"))
+		return err == nil && size <= 1
+	}
+	return isTiny("width", "width") || isTiny("height", "height")
+}
+
+func parseStyle(style string) map[string]string {
+	parsed := make(map[string]string)
+	for _, decl := range strings.Split(style, ";") {
+		key, value, found := strings.Cut(decl, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important"))
+		parsed[strings.ToLower(strings.TrimSpace(key))] = strings.ToLower(value)
+	}
+	return parsed
+}
+
+func getAttrOK(node *html.Node, key string) (string, bool) {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+func renameElement(node *html.Node, tag atom.Atom) {
+	node.DataAtom = tag
+	node.Data = tag.String()
+}
+
+// unwrapElement replaces an element with its children.
+func unwrapElement(node *html.Node) {
+	for child := node.FirstChild; child != nil; child = node.FirstChild {
+		node.RemoveChild(child)
+		node.Parent.InsertBefore(child, node)
+	}
+	node.Parent.RemoveChild(node)
+}
+
+var whitespaceReplacer = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ", "\t", " ")
+
+// collapseWhitespace joins the line breaks and indentation of the HTML source
+// outside of preformatted text. They're ignored when rendering the HTML, but
+// not when converting it to plain text.
+func collapseWhitespace(node *html.Node) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case child.Type == html.TextNode:
+			text := whitespaceReplacer.Replace(child.Data)
+			for strings.Contains(text, "  ") {
+				text = strings.ReplaceAll(text, "  ", " ")
+			}
+			child.Data = text
+		case child.Type == html.ElementNode && child.DataAtom != atom.Pre:
+			collapseWhitespace(child)
+		}
+	}
+}
+
+// removeEmptyElements removes elements that have no text or images left
+// after sanitizing, like the spacer cells of layout tables. Divs that only
+// wrap another div are also unwrapped.
+func removeEmptyElements(parent *html.Node) {
+	for child := parent.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type == html.ElementNode {
+			removeEmptyElements(child)
+			if !keptEmptyElements[child.DataAtom] && isEmptyElement(child) {
+				parent.RemoveChild(child)
+			} else if child.DataAtom == atom.Div && isOnlyChildDiv(child) {
+				unwrapElement(child)
+			}
+		}
+		child = next
+	}
+}
+
+func isOnlyChildDiv(node *html.Node) bool {
+	var div *html.Node
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case child.Type == html.TextNode && strings.TrimSpace(child.Data) == "":
+		case child.Type == html.ElementNode && child.DataAtom == atom.Div && div == nil:
+			div = child
+		default:
+			return false
+		}
+	}
+	return div != nil
+}
+
+func isEmptyElement(node *html.Node) bool {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		switch child.Type {
+		case html.TextNode:
+			if strings.TrimSpace(strings.ReplaceAll(child.Data, "\u00a0", " ")) != "" {
+				return false
+			}
+		case html.ElementNode:
+			if child.DataAtom != atom.Br {
+				return false
+			}
+		}
+	}
+	return true
+}
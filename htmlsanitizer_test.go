@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var updateGolden = flag.Bool("update", false, "update the .golden files in testdata")
+
+// sanitizeTestHTML runs the same steps as renderEmailHTML, except converting
+// images, which needs a portal and a homeserver.
+func sanitizeTestHTML(t *testing.T, input string) string {
+	t.Helper()
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to parse HTML: %v", err)
+	}
+	body := findElement(doc, atom.Body)
+	sanitizeEmailHTML(body)
+	removeEmptyElements(body)
+	trimTrailingBreaks(body)
+	var buf strings.Builder
+	for child := body.FirstChild; child != nil; child = child.NextSibling {
+		if err = html.Render(&buf, child); err != nil {
+			t.Fatalf("failed to render HTML: %v", err)
+		}
+	}
+	return strings.TrimSpace(buf.String()) + "\n"
+}
+
+func TestSanitizeEmailHTML(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(inputs) == 0 {
+		t.Fatal("no test inputs found")
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".html")
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := sanitizeTestHTML(t, string(data))
+			goldenPath := strings.TrimSuffix(input, ".html") + ".golden"
+			if *updateGolden {
+				if err = os.WriteFile(goldenPath, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("failed to read golden file (run with -update to create it): %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("output doesn't match %s:\n%s", goldenPath, got)
+			}
+		})
+	}
+}
+
+// parseFragment parses HTML into the children of a body element.
+func parseFragment(t *testing.T, input string) *html.Node {
+	t.Helper()
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(input), body)
+	if err != nil {
+		t.Fatalf("failed to parse HTML: %v", err)
+	}
+	for _, node := range nodes {
+		body.AppendChild(node)
+	}
+	return body
+}
+
+func renderChildren(t *testing.T, parent *html.Node) string {
+	t.Helper()
+	var buf strings.Builder
+	for child := parent.FirstChild; child != nil; child = child.NextSibling {
+		if err := html.Render(&buf, child); err != nil {
+			t.Fatalf("failed to render HTML: %v", err)
+		}
+	}
+	return buf.String()
+}
+
+func TestIsLayoutTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"presentation role", `<table role="presentation"><tr><th>Header</th></tr></table>`, true},
+		{"no headers", `<table><tr><td>Text</td><td>More text</td></tr></table>`, true},
+		{"nested table", `<table><tr><th>Header</th></tr><tr><td><table><tr><td>x</td></tr></table></td></tr></table>`, true},
+		{"headers", `<table><thead><tr><th>Item</th><th>Price</th></tr></thead><tr><td>Cable</td><td>$9</td></tr></table>`, false},
+		{"caption", `<table><caption>Summary</caption><tr><td>Total</td><td>$9</td></tr></table>`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := findElement(parseFragment(t, test.input), atom.Table)
+			if got := isLayoutTable(table); got != test.want {
+				t.Errorf("expected %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestIsTrackingPixel(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{`<img src="https://example.com/open.gif" width="1" height="1">`, true},
+		{`<img src="https://example.com/open.gif" width="0" height="0">`, true},
+		{`<img src="https://example.com/open.gif" height="1">`, true},
+		{`<img src="https://example.com/open.gif" style="width:1px;height:1px">`, true},
+		{`<img src="https://example.com/open.gif" style="height: 1px !important; width: 1px !important">`, true},
+		{`<img src="https://example.com/open.gif" width="1px">`, true},
+		{`<img src="https://example.com/logo.png" width="600" height="80">`, false},
+		{`<img src="https://example.com/logo.png" width="100%">`, false},
+		{`<img src="https://example.com/logo.png">`, false},
+		{`<div style="width:1px;height:1px"></div>`, false},
+	}
+	for _, test := range tests {
+		node := parseFragment(t, test.input).FirstChild
+		if got := isTrackingPixel(node); got != test.want {
+			t.Errorf("%s: expected %t, got %t", test.input, test.want, got)
+		}
+	}
+}
+
+func TestRemoveEmptyElements(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty paragraph", `<p></p><p>Text</p>`, `<p>Text</p>`},
+		{"non-breaking spaces", `<p>&nbsp; &nbsp;</p><p>Text</p>`, `<p>Text</p>`},
+		{"only line breaks", `<div><br><br></div><p>Text</p>`, `<p>Text</p>`},
+		{"nested empty elements", `<div><p><span> </span></p></div>Text`, `Text`},
+		{"images are content", `<div><img src="a.png"></div>`, `<div><img src="a.png"/></div>`},
+		{"table cells are kept", `<table><tbody><tr><td></td><td>x</td></tr></tbody></table>`, `<table><tbody><tr><td></td><td>x</td></tr></tbody></table>`},
+		{"nested divs are unwrapped", `<div><div><div><p>Text</p></div></div></div>`, `<div><p>Text</p></div>`},
+		{"divs with siblings are kept", `<div><div>a</div><div>b</div></div>`, `<div><div>a</div><div>b</div></div>`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := parseFragment(t, test.input)
+			removeEmptyElements(body)
+			if got := renderChildren(t, body); got != test.want {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
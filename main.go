@@ -48,6 +48,9 @@ type IMAPBridge struct {
 	puppets             map[string]*Puppet
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
+
+	provisioning *ProvisioningAPI
+	outbox       *outbox
 }
 
 var _ bridge.ChildOverride = (*IMAPBridge)(nil)
@@ -69,15 +72,21 @@ func (br *IMAPBridge) Init() {
 
 	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
 	br.RegisterCommands()
+	br.outbox = newOutbox(br)
 
 	ss := br.Config.Bridge.Provisioning.SharedSecret
 	if len(ss) > 0 && ss != "disable" {
-		// TODO: br.provisioning = &ProvisioningAPI{bridge: br, log: br.ZLog.With().Str("component", "provisioning").Logger()}
+		br.provisioning = &ProvisioningAPI{bridge: br, log: br.ZLog.With().Str("component", "provisioning").Logger()}
 	}
 }
 
 func (br *IMAPBridge) Start() {
+	if br.provisioning != nil {
+		br.ZLog.Debug().Msg("Initializing provisioning API")
+		br.provisioning.Init()
+	}
 	go br.StartUsers()
+	go br.outbox.loop(context.Background())
 }
 
 func (br *IMAPBridge) Stop() {
@@ -122,14 +131,26 @@ func (br *IMAPBridge) CreatePrivatePortal(roomID id.RoomID, brInviter bridge.Use
 		Str("action", "create private portal").
 		Stringer("target_room_id", roomID).
 		Stringer("inviter_mxid", brInviter.GetMXID()).
-		Str("inviter_email_address", puppet.EmailAddress).
+		Str("email_address", puppet.EmailAddress).
 		Logger()
 	log.Debug().Msg("Creating private chat portal")
 
-	key := database.NewPortalKey(puppet.EmailAddress, inviter.EmailAddress)
-	portal := br.GetPortalByThreadID(key)
+	intent := puppet.DefaultIntent()
 	ctx := log.WithContext(context.TODO())
 
+	if !inviter.IsLoggedIn() {
+		log.Debug().Msg("Inviter is not logged in, rejecting private chat invite")
+		_, _ = intent.SendNotice(ctx, roomID, "You must be logged in to start email conversations")
+		_, _ = intent.LeaveRoom(ctx, roomID)
+		return
+	}
+	portal := inviter.GetPortalByEmailAddress(puppet.EmailAddress)
+	if portal == nil {
+		log.Error().Msg("Failed to get private chat portal")
+		_, _ = intent.LeaveRoom(ctx, roomID)
+		return
+	}
+
 	if len(portal.MXID) == 0 {
 		br.createPrivatePortalFromInvite(ctx, roomID, inviter, puppet, portal)
 		return
@@ -144,7 +165,6 @@ func (br *IMAPBridge) CreatePrivatePortal(roomID id.RoomID, brInviter bridge.Use
 		br.createPrivatePortalFromInvite(ctx, roomID, inviter, puppet, portal)
 		return
 	}
-	intent := puppet.DefaultIntent()
 	errorMessage := fmt.Sprintf("You already have a private chat portal with me at [%[1]s](https://matrix.to/#/%[1]s)", portal.MXID)
 	errorContent := format.RenderMarkdown(errorMessage, true, false)
 	_, _ = intent.SendMessageEvent(ctx, roomID, event.EventMessage, errorContent)
@@ -192,8 +212,13 @@ func (br *IMAPBridge) createPrivatePortalFromInvite(ctx context.Context, roomID
 		br.AS.StateStore.SetMembership(ctx, roomID, br.Bot.UserID, event.MembershipJoin)
 		portal.Encrypted = true
 	}
+	err = portal.Update(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to save portal room ID")
+	}
+	portal.log = portal.log.With().Stringer("room_id", roomID).Logger()
 	portal.UpdateDMInfo(ctx, true)
-	_, _ = intent.SendNotice(ctx, roomID, "Private chat portal created")
+	_, _ = intent.SendNotice(ctx, roomID, "Private chat portal created. Your first message will be sent as a new email.")
 	log.Info().Msg("Created private chat portal after invite")
 }
 
@@ -206,11 +231,18 @@ func main() {
 
 		portalsByMXID: make(map[id.RoomID]*Portal),
 		portalsByID:   make(map[database.PortalKey]*Portal),
+
+		puppets:             make(map[string]*Puppet),
+		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
 	}
 	br.Bridge = bridge.Bridge{
-		Name:        "imap-bridge",
-		Description: "Your bridge description here.",
-		Version:     "0.1.0",
+		Name:              "imap-bridge",
+		Description:       "A Matrix-Email bridge based on IMAP and SMTP.",
+		URL:               "https://github.com/medanisjbara/imap",
+		Version:           "0.1.0",
+		ProtocolName:      "Email",
+		BeeperServiceName: "email",
+		BeeperNetworkName: "email",
 
 		ConfigUpgrader: &configupgrade.StructUpgrader{
 			SimpleUpgrader: configupgrade.SimpleUpgrader(config.DoUpgrade),
@@ -27,6 +27,8 @@ import (
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+
+	"imap-bridge/database"
 )
 
 var (
@@ -37,6 +39,7 @@ var (
 	errCantRelayReactions          = errors.New("user is not logged in and reactions can't be relayed")
 	errMNoticeDisabled             = errors.New("bridging m.notice messages is disabled")
 	errUnexpectedParsedContentType = errors.New("unexpected parsed content type")
+	errPortalNotFound              = errors.New("failed to get portal")
 
 	errRedactionTargetNotFound          = errors.New("redaction target message was not found")
 	errRedactionTargetSentBySomeoneElse = errors.New("redaction target message was sent by someone else")
@@ -46,6 +49,11 @@ var (
 	errFailedToGetEditTarget            = errors.New("failed to get edit target message")
 	errEditDifferentSender              = errors.New("can't edit message sent by another user")
 	errEditTooOld                       = errors.New("message is too old to be edited")
+	errEditsRejected                    = errors.New("edits are not bridged to email")
+	errListPostingNotAllowed            = errors.New("the mailing list doesn't accept posts")
+	errNoDoublePuppet                   = errors.New("double puppeting is not enabled")
+	errDeliveryFailed                   = errors.New("delivery failed")
+	errCantUnsendEmail                  = errors.New("email can't be unsent after it has been sent")
 
 	errMessageTakingLong     = errors.New("bridging the message is taking longer than usual")
 	errTimeoutBeforeHandling = errors.New("message timed out before handling was started")
@@ -61,8 +69,23 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, false, ""
 	case errors.Is(err, errEditDifferentSender),
 		errors.Is(err, errEditTooOld),
-		errors.Is(err, errEditUnknownTarget):
+		errors.Is(err, errEditsRejected),
+		errors.Is(err, errEditUnknownTarget),
+		errors.Is(err, errListPostingNotAllowed),
+		errors.Is(err, errCantUnsendEmail),
+		errors.Is(err, errAttachmentTooLarge):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, errDeliveryFailed),
+		errors.Is(err, errEmailRejected),
+		errors.Is(err, errOutboxGaveUp):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, errMessageScheduled),
+		errors.Is(err, errSendDelayed):
+		return event.MessageStatusGenericError, event.MessageStatusPending, true, false, err.Error()
+	case errors.Is(err, errOutboxBusy):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, errSendRetrying):
+		return event.MessageStatusGenericError, event.MessageStatusPending, false, true, err.Error()
 	case errors.Is(err, errTimeoutBeforeHandling):
 		return event.MessageStatusTooOld, event.MessageStatusRetriable, true, true, "the message was too old when it reached the bridge, so it was not handled"
 	case errors.Is(err, context.DeadlineExceeded):
@@ -72,7 +95,9 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 	case errors.Is(err, errRedactionTargetNotFound),
 		errors.Is(err, errReactionTargetNotFound),
 		errors.Is(err, errRedactionTargetSentBySomeoneElse),
-		errors.Is(err, errUnreactTargetSentBySomeoneElse):
+		errors.Is(err, errUnreactTargetSentBySomeoneElse),
+		errors.Is(err, errOutboxRemoved),
+		errors.Is(err, errSendCancelled):
 		return event.MessageStatusGenericError, event.MessageStatusFail, true, false, ""
 	case errors.Is(err, errUserNotConnected):
 		return event.MessageStatusGenericError, event.MessageStatusRetriable, true, true, ""
@@ -162,6 +187,24 @@ func (portal *Portal) sendStatusEvent(ctx context.Context, evtID, lastRetry id.E
 	}
 }
 
+// sendDeliveryFailure marks a message that was sent successfully as failed
+// after the mail bounced.
+func (portal *Portal) sendDeliveryFailure(ctx context.Context, msg *database.Message, err error) {
+	portal.sendStatusEvent(ctx, msg.MXID, "", err, nil)
+	if !portal.bridge.Config.Bridge.MessageErrorNotices {
+		return
+	}
+	content := &event.MessageEventContent{
+		MsgType:   event.MsgNotice,
+		Body:      fmt.Sprintf("\u26a0 Your message could not be delivered: %v", err),
+		RelatesTo: (&event.RelatesTo{}).SetReplyTo(msg.MXID),
+	}
+	_, err = portal.sendMainIntentMessage(ctx, content)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to send delivery failure notice")
+	}
+}
+
 func (portal *Portal) sendDeliveryReceipt(ctx context.Context, eventID id.EventID) {
 	if portal.bridge.Config.Bridge.DeliveryReceipts {
 		err := portal.bridge.Bot.SendReceipt(ctx, portal.MXID, eventID, event.ReceiptTypeRead, nil)
@@ -189,7 +232,7 @@ func (portal *Portal) sendMessageMetrics(ctx context.Context, evt *event.Event,
 	}
 	if err != nil {
 		logEvt := log.Error()
-		if part == "Ignoring" {
+		if part == "Ignoring" || errors.Is(err, errMessageScheduled) || errors.Is(err, errSendDelayed) {
 			logEvt = log.Debug()
 		}
 		logEvt.Err(err).Msg("Sending message metrics for event")
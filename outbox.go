@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"imap-bridge/database"
+	"imap-bridge/pkg/emailmeow"
+)
+
+const (
+	outboxMinRetryDelay = 30 * time.Second
+	outboxMaxRetryDelay = 30 * time.Minute
+)
+
+var (
+	errSendRetrying  = errors.New("sending failed, will retry")
+	errOutboxGaveUp  = errors.New("gave up sending")
+	errEmailRejected = errors.New("the mail server rejected the message")
+	errOutboxBusy    = errors.New("message is already being sent")
+	errOutboxRemoved = errors.New("message was removed from the outbox")
+	errSendDelayed   = errors.New("sending is delayed so that it can be undone")
+	errSendCancelled = errors.New("sending was cancelled")
+)
+
+// outboxRetryDelay returns how long to wait after the given number of failed
+// attempts, doubling the delay after each attempt.
+func outboxRetryDelay(attempts int) time.Duration {
+	delay := outboxMinRetryDelay
+	for i := 1; i < attempts && delay < outboxMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, outboxMaxRetryDelay)
+}
+
+// outbox retries queued email whose submission failed with a temporary error.
+type outbox struct {
+	bridge *IMAPBridge
+	log    zerolog.Logger
+	wakeup chan struct{}
+
+	inFlight     map[id.EventID]struct{}
+	inFlightLock sync.Mutex
+}
+
+func newOutbox(br *IMAPBridge) *outbox {
+	return &outbox{
+		bridge:   br,
+		log:      br.ZLog.With().Str("component", "outbox").Logger(),
+		wakeup:   make(chan struct{}, 1),
+		inFlight: make(map[id.EventID]struct{}),
+	}
+}
+
+// wake makes the loop recalculate when the next message is due.
+func (ob *outbox) wake() {
+	select {
+	case ob.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// claim marks a message as being submitted. It returns false if another
+// goroutine is already submitting it.
+func (ob *outbox) claim(evtID id.EventID) bool {
+	ob.inFlightLock.Lock()
+	defer ob.inFlightLock.Unlock()
+	if _, ok := ob.inFlight[evtID]; ok {
+		return false
+	}
+	ob.inFlight[evtID] = struct{}{}
+	return true
+}
+
+func (ob *outbox) release(evtID id.EventID) {
+	ob.inFlightLock.Lock()
+	delete(ob.inFlight, evtID)
+	ob.inFlightLock.Unlock()
+}
+
+func (ob *outbox) loop(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		next, err := ob.bridge.DB.Outbox.GetNextAttempt(ctx)
+		if err != nil {
+			ob.log.Err(err).Msg("Failed to get next outbox attempt time")
+			next = time.Now().Add(outboxMinRetryDelay)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var timerC <-chan time.Time
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+			timerC = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ob.wakeup:
+			continue
+		case <-timerC:
+		}
+		msgs, err := ob.bridge.DB.Outbox.GetDue(ctx, time.Now())
+		if err != nil {
+			ob.log.Err(err).Msg("Failed to get due outbox messages")
+			continue
+		}
+		for _, msg := range msgs {
+			ob.retry(ctx, msg)
+		}
+	}
+}
+
+// outboxEvent reconstructs the Matrix event of a queued message for
+// reporting the status of retries.
+func outboxEvent(msg *database.OutboxMessage) *event.Event {
+	return &event.Event{
+		ID:        msg.MXID,
+		RoomID:    msg.RoomID,
+		Sender:    msg.UserMXID,
+		Type:      event.EventMessage,
+		Timestamp: msg.CreatedAt.UnixMilli(),
+		Content:   event.Content{Parsed: &event.MessageEventContent{}},
+	}
+}
+
+func (ob *outbox) retry(ctx context.Context, msg *database.OutboxMessage) {
+	log := ob.log.With().
+		Stringer("event_id", msg.MXID).
+		Int("attempts", msg.Attempts).
+		Logger()
+	ctx = log.WithContext(ctx)
+	portal := ob.bridge.GetPortalByMXID(msg.RoomID)
+	user := ob.bridge.GetUserByMXIDIfExists(msg.UserMXID)
+	if portal == nil || user == nil {
+		log.Warn().Msg("Portal or sender of queued email not found, dropping message")
+		if err := msg.Delete(ctx); err != nil {
+			log.Err(err).Msg("Failed to delete queued email")
+		}
+		return
+	}
+	log.Debug().Msg("Retrying queued email")
+	ms := &metricSender{
+		portal:         portal,
+		timings:        &messageTimings{},
+		ctx:            ctx,
+		retryNum:       msg.Attempts,
+		previousNotice: msg.ErrorNotice,
+	}
+	err := portal.submitOutboxMessage(ctx, user, msg)
+	if errors.Is(err, errOutboxBusy) || errors.Is(err, errOutboxRemoved) {
+		return
+	}
+	retrying := errors.Is(err, errSendRetrying)
+	ms.sendMessageMetrics(outboxEvent(msg), err, "Error sending", !retrying)
+	if retrying {
+		ob.saveErrorNotice(ctx, msg, ms.getNoticeID())
+	}
+}
+
+// saveErrorNotice remembers the error notice of a message, so that the next
+// attempt edits it instead of sending a new one, and success removes it.
+func (ob *outbox) saveErrorNotice(ctx context.Context, msg *database.OutboxMessage, noticeID id.EventID) {
+	if noticeID == msg.ErrorNotice {
+		return
+	}
+	msg.ErrorNotice = noticeID
+	err := msg.Update(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save error notice of queued email")
+	}
+}
+
+// getSMTPClient returns a client for submitting mail. Mail can be submitted
+// even if the IMAP connection is currently down.
+func (user *User) getSMTPClient() *emailmeow.Client {
+	if cli := user.getClient(); cli != nil {
+		return cli
+	}
+	user.Lock()
+	address, password, settings := user.EmailAddress, user.Password, user.serverSettings()
+	user.Unlock()
+	if address == "" || password == "" {
+		return nil
+	}
+	return user.newClient(address, password, settings)
+}
+
+// submitOutboxMessage tries to submit a queued email. If the attempt fails
+// with a temporary error before the outbox deadline, the message stays in the
+// outbox and the returned error wraps errSendRetrying.
+func (portal *Portal) submitOutboxMessage(ctx context.Context, sender *User, msg *database.OutboxMessage) error {
+	if !portal.bridge.outbox.claim(msg.MXID) {
+		return errOutboxBusy
+	}
+	defer portal.bridge.outbox.release(msg.MXID)
+	log := zerolog.Ctx(ctx)
+
+	// The message may have been cancelled after it was loaded
+	current, err := portal.bridge.DB.Outbox.GetByMXID(ctx, msg.MXID)
+	if err != nil {
+		return fmt.Errorf("failed to check outbox: %w", err)
+	} else if current == nil {
+		return errOutboxRemoved
+	}
+	if cli := sender.getSMTPClient(); cli == nil {
+		err = errUserNotConnected
+	} else {
+		err = cli.Submit(ctx, msg.Recipients, msg.Raw)
+	}
+	// The message handling deadline may have cancelled ctx, but the outbox
+	// must still be updated.
+	ctx = context.WithoutCancel(ctx)
+	msg.Attempts++
+	if err == nil {
+		log.Debug().Str("email_message_id", msg.EmailMessageID).Int("attempts", msg.Attempts).Msg("Email sent successfully")
+		if err = msg.Delete(ctx); err != nil {
+			log.Err(err).Msg("Failed to delete sent email from outbox")
+		}
+		portal.storeSentMessage(ctx, sender, msg)
+		return nil
+	}
+
+	nextAttempt := time.Now().Add(outboxRetryDelay(msg.Attempts))
+	if emailmeow.IsPermanentError(err) {
+		err = fmt.Errorf("%w: %w", errEmailRejected, err)
+	} else if nextAttempt.Before(msg.SendAt().Add(portal.bridge.Config.Bridge.OutboxDeadline)) {
+		msg.NextAttempt = nextAttempt
+		if updateErr := msg.Update(ctx); updateErr != nil {
+			log.Err(updateErr).Msg("Failed to save outbox retry state")
+		}
+		portal.bridge.outbox.wake()
+		return fmt.Errorf("%w: %w", errSendRetrying, err)
+	} else if msg.Attempts > 1 {
+		err = fmt.Errorf("%w after %d attempts: %w", errOutboxGaveUp, msg.Attempts, err)
+	}
+	if deleteErr := msg.Delete(ctx); deleteErr != nil {
+		log.Err(deleteErr).Msg("Failed to delete failed email from outbox")
+	}
+	return err
+}
+
+// storeSentMessage records a submitted email in the message table, or bumps
+// the edit target if the email was sent for an edit.
+func (portal *Portal) storeSentMessage(ctx context.Context, sender *User, msg *database.OutboxMessage) {
+	log := zerolog.Ctx(ctx)
+	now := uint64(time.Now().UnixMilli())
+	if msg.EditTarget != "" {
+		target, err := portal.bridge.DB.Message.GetByMXID(ctx, msg.EditTarget)
+		if err != nil {
+			log.Err(err).Msg("Failed to get edit target message")
+		} else if target != nil {
+			portal.storeSentText(ctx, target, msg)
+			err = target.SetTimestamp(ctx, now)
+			if err != nil {
+				log.Err(err).Msg("Failed to update message timestamp in database after editing")
+			}
+		}
+		return
+	}
+	// Make sure the sender's ghost exists, as messages reference it
+	portal.bridge.GetPuppetByEmailAddress(sender.EmailAddress)
+	portal.storeMessageInDB(ctx, msg.MXID, sender.EmailAddress, now, 0, emailThreading{
+		MessageID: msg.EmailMessageID,
+		ThreadID:  msg.EmailThreadID,
+	})
+	portal.storeSentText(ctx, nil, msg)
+}
+
+// handleMatrixRedaction cancels a queued email if its Matrix message is
+// redacted before the email is sent.
+func (portal *Portal) handleMatrixRedaction(ctx context.Context, sender *User, evt *event.Event) {
+	ms := metricSender{portal: portal, timings: &messageTimings{}, ctx: ctx}
+	redacts := evt.Redacts
+	if redacts == "" {
+		redacts = evt.Content.AsRedaction().Redacts
+	}
+	log := zerolog.Ctx(ctx).With().Stringer("redacts", redacts).Logger()
+	ctx = log.WithContext(ctx)
+
+	msg, err := portal.bridge.DB.Outbox.GetByMXID(ctx, redacts)
+	if err != nil {
+		log.Err(err).Msg("Failed to get redaction target from outbox")
+		ms.sendMessageMetrics(evt, err, "Error getting redaction target", true)
+		return
+	} else if msg == nil || msg.RoomID != portal.MXID {
+		if sent, err := portal.bridge.DB.Message.GetByMXID(ctx, redacts); err == nil && sent != nil {
+			ms.sendMessageMetrics(evt, errCantUnsendEmail, "Ignoring", true)
+		} else {
+			ms.sendMessageMetrics(evt, errRedactionTargetNotFound, "Ignoring", true)
+		}
+		return
+	} else if msg.UserMXID != sender.MXID {
+		ms.sendMessageMetrics(evt, errRedactionTargetSentBySomeoneElse, "Ignoring", true)
+		return
+	} else if !portal.bridge.outbox.claim(msg.MXID) {
+		ms.sendMessageMetrics(evt, errOutboxBusy, "Error cancelling", true)
+		return
+	}
+	defer portal.bridge.outbox.release(msg.MXID)
+	err = msg.Delete(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to delete cancelled email from outbox")
+		ms.sendMessageMetrics(evt, err, "Error cancelling", true)
+		return
+	}
+	log.Debug().Str("email_message_id", msg.EmailMessageID).Msg("Cancelled queued email")
+	portal.sendStatusEvent(ctx, msg.MXID, "", errSendCancelled, nil)
+	if msg.ErrorNotice != "" {
+		_, _ = portal.MainIntent().RedactEvent(ctx, portal.MXID, msg.ErrorNotice, mautrix.ReqRedact{
+			Reason: "message cancelled",
+		})
+	}
+	ms.sendMessageMetrics(evt, nil, "", true)
+}
@@ -0,0 +1,154 @@
+// Package carddav is a minimal read-only CardDAV (RFC 6352) client used for
+// syncing contact names and photos.
+package carddav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const addressbookQuery = `<?xml version="1.0" encoding="utf-8"?>
+<C:addressbook-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+  <D:prop>
+    <D:getetag/>
+    <C:address-data/>
+  </D:prop>
+</C:addressbook-query>`
+
+// maxPhotoSize is the largest photo that will be downloaded from a PHOTO URL.
+const maxPhotoSize = 5 * 1024 * 1024
+
+// maxRedirects is the number of redirects followed for authenticated requests.
+const maxRedirects = 10
+
+var (
+	ErrUnexpectedStatus    = errors.New("unexpected HTTP status")
+	ErrCrossOriginRedirect = errors.New("refusing to follow redirect to another server")
+)
+
+// Client fetches contacts from a single CardDAV address book.
+type Client struct {
+	// URL is the address book collection URL.
+	URL      string
+	Username string
+	Password string
+
+	// HTTPClient is used for all requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+func NewClient(addressBookURL, username, password string) *Client {
+	return &Client{
+		URL:      addressBookURL,
+		Username: username,
+		Password: password,
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// isSameOrigin checks whether the URL has the same scheme and host as the
+// address book, which means that it's safe to send credentials to it.
+func (c *Client) isSameOrigin(target *url.URL) bool {
+	base, err := url.Parse(c.URL)
+	return err == nil && strings.EqualFold(base.Scheme, target.Scheme) && strings.EqualFold(base.Host, target.Host)
+}
+
+// do sends a request, adding credentials only if the request goes to the
+// address book's server. Authenticated requests don't follow redirects to
+// other servers.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if (c.Username == "" && c.Password == "") || !c.isSameOrigin(req.URL) {
+		return c.httpClient().Do(req)
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+	client := *c.httpClient()
+	client.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+		if !c.isSameOrigin(next.URL) {
+			return fmt.Errorf("%w: %s", ErrCrossOriginRedirect, next.URL.Host)
+		} else if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+	return client.Do(req)
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				AddressData string `xml:"urn:ietf:params:xml:ns:carddav address-data"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// Contacts fetches all contacts in the address book.
+func (c *Client) Contacts(ctx context.Context) ([]*Contact, error) {
+	req, err := http.NewRequestWithContext(ctx, "REPORT", c.URL, strings.NewReader(addressbookQuery))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "1")
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("%w %d from address book query", ErrUnexpectedStatus, resp.StatusCode)
+	}
+	var ms multistatus
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	var contacts []*Contact
+	for _, item := range ms.Responses {
+		for _, propstat := range item.Propstat {
+			if propstat.Prop.AddressData != "" && (propstat.Status == "" || strings.Contains(propstat.Status, " 200 ")) {
+				contacts = append(contacts, ParseVCards(propstat.Prop.AddressData)...)
+			}
+		}
+	}
+	return contacts, nil
+}
+
+// DownloadPhoto fetches a photo that the vCard only links to. The address
+// book credentials are only sent if the photo is on the same server.
+func (c *Client) DownloadPhoto(ctx context.Context, photoURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, photoURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to prepare request: %w", err)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%w %d from photo download", ErrUnexpectedStatus, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPhotoSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read photo: %w", err)
+	} else if len(data) > maxPhotoSize {
+		return nil, "", fmt.Errorf("photo is larger than %d bytes", maxPhotoSize)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,232 @@
+package carddav
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testPhoto = []byte("\x89PNG\r\n\x1a\nphoto")
+
+const multistatusTemplate = `<?xml version="1.0" encoding="utf-8"?>
+<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+  <D:response>
+    <D:href>/addressbook/alice.vcf</D:href>
+    <D:propstat>
+      <D:prop>
+        <D:getetag>"1"</D:getetag>
+        <C:address-data>BEGIN:VCARD
+VERSION:3.0
+UID:alice
+FN:Alice Example
+EMAIL;TYPE=work:alice@example.com
+PHOTO;VALUE=uri:%s/photos/alice.png
+END:VCARD
+</C:address-data>
+      </D:prop>
+      <D:status>HTTP/1.1 200 OK</D:status>
+    </D:propstat>
+  </D:response>
+  <D:response>
+    <D:href>/addressbook/missing.vcf</D:href>
+    <D:propstat>
+      <D:prop>
+        <C:address-data>BEGIN:VCARD
+VERSION:3.0
+FN:Not Found
+EMAIL:missing@example.com
+END:VCARD
+</C:address-data>
+      </D:prop>
+      <D:status>HTTP/1.1 404 Not Found</D:status>
+    </D:propstat>
+  </D:response>
+</D:multistatus>`
+
+// newAddressBook starts a CardDAV stand-in that requires the given
+// credentials. The vCard in the address book links to a photo on photoHost.
+func newAddressBook(t *testing.T, photoHost func() string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "REPORT" && r.URL.Path == "/addressbook/":
+			body, _ := io.ReadAll(r.Body)
+			if !bytes.Contains(body, []byte("addressbook-query")) || r.Header.Get("Depth") != "1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusMultiStatus)
+			_, _ = fmt.Fprintf(w, multistatusTemplate, photoHost())
+		case r.Method == http.MethodGet && r.URL.Path == "/photos/alice.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(testPhoto)
+		case r.Method == http.MethodGet && r.URL.Path == "/photos/moved.png":
+			http.Redirect(w, r, "/photos/alice.png", http.StatusFound)
+		case r.Method == http.MethodGet && r.URL.Path == "/photos/external.png":
+			http.Redirect(w, r, photoHost()+"/photos/alice.png", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newPhotoHost starts a third-party server that records whether it received
+// credentials.
+func newPhotoHost(t *testing.T, gotAuth *bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			*gotAuth = true
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(testPhoto)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestContacts(t *testing.T) {
+	var addressBook *httptest.Server
+	addressBook = newAddressBook(t, func() string { return addressBook.URL })
+	client := NewClient(addressBook.URL+"/addressbook/", "user", "secret")
+	contacts, err := client.Contacts(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get contacts: %v", err)
+	}
+	if len(contacts) != 1 {
+		t.Fatalf("expected 1 contact, got %d", len(contacts))
+	}
+	alice := contacts[0]
+	if alice.UID != "alice" || alice.Name != "Alice Example" {
+		t.Errorf("unexpected contact %+v", alice)
+	}
+	if len(alice.Emails) != 1 || alice.Emails[0] != "alice@example.com" {
+		t.Errorf("unexpected emails %v", alice.Emails)
+	}
+	if alice.PhotoURL != addressBook.URL+"/photos/alice.png" {
+		t.Errorf("unexpected photo URL %q", alice.PhotoURL)
+	}
+}
+
+func TestContactsWrongPassword(t *testing.T) {
+	var addressBook *httptest.Server
+	addressBook = newAddressBook(t, func() string { return addressBook.URL })
+	client := NewClient(addressBook.URL+"/addressbook/", "user", "wrong")
+	_, err := client.Contacts(context.Background())
+	if !errors.Is(err, ErrUnexpectedStatus) {
+		t.Errorf("expected unexpected status error, got %v", err)
+	}
+}
+
+func TestDownloadPhoto(t *testing.T) {
+	var addressBook *httptest.Server
+	addressBook = newAddressBook(t, func() string { return addressBook.URL })
+	client := NewClient(addressBook.URL+"/addressbook/", "user", "secret")
+	for _, path := range []string{"/photos/alice.png", "/photos/moved.png"} {
+		data, contentType, err := client.DownloadPhoto(context.Background(), addressBook.URL+path)
+		if err != nil {
+			t.Fatalf("failed to download %s: %v", path, err)
+		}
+		if !bytes.Equal(data, testPhoto) || contentType != "image/png" {
+			t.Errorf("unexpected photo from %s: %q (%s)", path, data, contentType)
+		}
+	}
+}
+
+func TestDownloadPhotoFromOtherServer(t *testing.T) {
+	var gotAuth bool
+	photoHost := newPhotoHost(t, &gotAuth)
+	addressBook := newAddressBook(t, func() string { return photoHost.URL })
+	client := NewClient(addressBook.URL+"/addressbook/", "user", "secret")
+	data, _, err := client.DownloadPhoto(context.Background(), photoHost.URL+"/photos/alice.png")
+	if err != nil {
+		t.Fatalf("failed to download photo: %v", err)
+	}
+	if !bytes.Equal(data, testPhoto) {
+		t.Errorf("unexpected photo %q", data)
+	}
+	if gotAuth {
+		t.Error("credentials were sent to another server")
+	}
+}
+
+func TestDownloadPhotoRedirectToOtherServer(t *testing.T) {
+	var gotAuth bool
+	photoHost := newPhotoHost(t, &gotAuth)
+	addressBook := newAddressBook(t, func() string { return photoHost.URL })
+	client := NewClient(addressBook.URL+"/addressbook/", "user", "secret")
+	_, _, err := client.DownloadPhoto(context.Background(), addressBook.URL+"/photos/external.png")
+	if !errors.Is(err, ErrCrossOriginRedirect) {
+		t.Errorf("expected cross-origin redirect error, got %v", err)
+	}
+	if gotAuth {
+		t.Error("credentials were sent to another server")
+	}
+}
+
+func TestParseVCards(t *testing.T) {
+	photo := base64.StdEncoding.EncodeToString(testPhoto)
+	data := strings.Join([]string{
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"N:Example;Bob;;;",
+		"item1.EMAIL;TYPE=INTERNET:bob@example.com",
+		"EMAIL:mailto:bob@example.org",
+		"PHOTO;ENCODING=b;TYPE=PNG:" + photo[:8],
+		" " + photo[8:],
+		"END:VCARD",
+		"BEGIN:VCARD",
+		"VERSION:4.0",
+		"FN:Carol\\, the Tester",
+		"EMAIL:carol@example.com",
+		"PHOTO:data:image/png;base64," + photo,
+		"END:VCARD",
+		"BEGIN:VCARD",
+		"VERSION:2.1",
+		"FN:No Email",
+		"END:VCARD",
+		"BEGIN:VCARD",
+		"VERSION:2.1",
+		"FN:Dave",
+		"EMAIL;INTERNET:dave@example.com",
+		"PHOTO;JPEG;ENCODING=BASE64:" + photo,
+		"END:VCARD",
+	}, "\r\n")
+	contacts := ParseVCards(data)
+	if len(contacts) != 3 {
+		t.Fatalf("expected 3 contacts, got %d", len(contacts))
+	}
+	bob, carol, dave := contacts[0], contacts[1], contacts[2]
+	if bob.Name != "Bob Example" {
+		t.Errorf("unexpected name from N: %q", bob.Name)
+	}
+	if len(bob.Emails) != 2 || bob.Emails[0] != "bob@example.com" || bob.Emails[1] != "bob@example.org" {
+		t.Errorf("unexpected emails %v", bob.Emails)
+	}
+	if !bytes.Equal(bob.Photo, testPhoto) || bob.PhotoType != "image/png" {
+		t.Errorf("unexpected folded base64 photo %q (%s)", bob.Photo, bob.PhotoType)
+	}
+	if carol.Name != "Carol, the Tester" {
+		t.Errorf("unexpected escaped name %q", carol.Name)
+	}
+	if !bytes.Equal(carol.Photo, testPhoto) || carol.PhotoType != "image/png" {
+		t.Errorf("unexpected data URI photo %q (%s)", carol.Photo, carol.PhotoType)
+	}
+	if !bytes.Equal(dave.Photo, testPhoto) || dave.PhotoType != "image/jpeg" {
+		t.Errorf("unexpected vCard 2.1 photo %q (%s)", dave.Photo, dave.PhotoType)
+	}
+}
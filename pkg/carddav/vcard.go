@@ -0,0 +1,169 @@
+package carddav
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// Contact is the subset of a vCard used by the bridge.
+type Contact struct {
+	UID    string
+	Name   string
+	Emails []string
+
+	// Photo is the inline photo data. If the vCard only links to the photo,
+	// Photo is nil and PhotoURL is set instead.
+	Photo     []byte
+	PhotoType string
+	PhotoURL  string
+}
+
+type vcardProperty struct {
+	Name   string
+	Params map[string][]string
+	Value  string
+}
+
+// unfoldLines splits a vCard into logical lines, joining folded continuation
+// lines as described in RFC 6350 section 3.2.
+func unfoldLines(data string) []string {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	var lines []string
+	for _, line := range strings.Split(data, "\n") {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func parseProperty(line string) (prop vcardProperty, ok bool) {
+	nameAndParams, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return
+	}
+	parts := strings.Split(nameAndParams, ";")
+	name := parts[0]
+	// Drop the group prefix, e.g. item1.EMAIL
+	if idx := strings.LastIndexByte(name, '.'); idx >= 0 {
+		name = name[idx+1:]
+	}
+	prop.Name = strings.ToUpper(name)
+	prop.Value = value
+	prop.Params = make(map[string][]string)
+	for _, param := range parts[1:] {
+		key, val, hasValue := strings.Cut(param, "=")
+		key = strings.ToUpper(key)
+		if !hasValue {
+			// vCard 2.1 style bare parameter, e.g. PHOTO;JPEG;ENCODING=BASE64
+			prop.Params["TYPE"] = append(prop.Params["TYPE"], key)
+			continue
+		}
+		for _, v := range strings.Split(val, ",") {
+			prop.Params[key] = append(prop.Params[key], strings.Trim(v, `"`))
+		}
+	}
+	return prop, true
+}
+
+func unescapeText(value string) string {
+	if !strings.ContainsRune(value, '\\') {
+		return value
+	}
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+func (prop vcardProperty) param(key string) string {
+	if vals := prop.Params[key]; len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func (contact *Contact) setPhoto(prop vcardProperty) {
+	value := prop.Value
+	encoding := strings.ToUpper(prop.param("ENCODING"))
+	switch {
+	case strings.HasPrefix(value, "data:"):
+		// vCard 4.0: data:image/jpeg;base64,...
+		meta, data, ok := strings.Cut(value[len("data:"):], ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return
+		}
+		contact.Photo = decoded
+		contact.PhotoType = strings.TrimSuffix(meta, ";base64")
+	case encoding == "B" || encoding == "BASE64":
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+		if err != nil {
+			return
+		}
+		contact.Photo = decoded
+		if typ := strings.ToLower(prop.param("TYPE")); typ != "" && !strings.Contains(typ, "/") {
+			contact.PhotoType = "image/" + typ
+		} else {
+			contact.PhotoType = typ
+		}
+	case strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://"):
+		contact.PhotoURL = value
+	}
+}
+
+// ParseVCards parses all vCards in the given data. Cards without an email
+// address are skipped, as they can't be matched to email users.
+func ParseVCards(data string) []*Contact {
+	var contacts []*Contact
+	var current *Contact
+	var structuredName string
+	for _, line := range unfoldLines(data) {
+		prop, ok := parseProperty(line)
+		if !ok {
+			continue
+		}
+		switch prop.Name {
+		case "BEGIN":
+			if strings.EqualFold(prop.Value, "VCARD") {
+				current = &Contact{}
+				structuredName = ""
+			}
+		case "END":
+			if current != nil && strings.EqualFold(prop.Value, "VCARD") {
+				if current.Name == "" {
+					current.Name = structuredName
+				}
+				if len(current.Emails) > 0 {
+					contacts = append(contacts, current)
+				}
+				current = nil
+			}
+		}
+		if current == nil {
+			continue
+		}
+		switch prop.Name {
+		case "UID":
+			current.UID = prop.Value
+		case "FN":
+			current.Name = strings.TrimSpace(unescapeText(prop.Value))
+		case "N":
+			// Family;Given;Additional;Prefix;Suffix
+			parts := strings.Split(prop.Value, ";")
+			if len(parts) >= 2 {
+				structuredName = strings.TrimSpace(unescapeText(parts[1]) + " " + unescapeText(parts[0]))
+			}
+		case "EMAIL":
+			email := strings.TrimSpace(strings.TrimPrefix(prop.Value, "mailto:"))
+			if email != "" {
+				current.Emails = append(current.Emails, email)
+			}
+		case "PHOTO":
+			current.setPhoto(prop)
+		}
+	}
+	return contacts
+}
@@ -0,0 +1,61 @@
+package emailmeow
+
+import (
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+
+	"imap-bridge/pkg/emailmeow/events"
+)
+
+// LoopHeader is added to all mail sent by the bridge. Incoming mail that
+// contains it with the account's address is an echo of bridged mail.
+const LoopHeader = "X-Loop"
+
+// reportType returns the report-type parameter of a RFC 6522 multipart/report
+// message, or an empty string for other messages.
+func reportType(h mail.Header) string {
+	mediaType, params, _ := h.ContentType()
+	if mediaType != "multipart/report" {
+		return ""
+	}
+	return strings.ToLower(params["report-type"])
+}
+
+// detectAutomated checks the RFC 3834 and RFC 2076 headers used to mark
+// automatically generated mail. Precedence: list isn't counted for mailing
+// list messages, as those are bridged into list portals. Reports are checked
+// first, as they usually have an Auto-Submitted header too.
+func detectAutomated(h mail.Header, isList bool) events.AutomatedReason {
+	switch reportType(h) {
+	case "delivery-status":
+		return events.AutomatedDeliveryReport
+	case "disposition-notification":
+		return events.AutomatedDispositionNotification
+	}
+	if autoSubmitted := strings.ToLower(strings.TrimSpace(h.Get("Auto-Submitted"))); autoSubmitted != "" && autoSubmitted != "no" {
+		return events.AutomatedAutoSubmitted
+	}
+	switch strings.ToLower(strings.TrimSpace(h.Get("Precedence"))) {
+	case "bulk", "junk":
+		return events.AutomatedPrecedence
+	case "list":
+		if !isList {
+			return events.AutomatedPrecedence
+		}
+	}
+	if returnPath := h.Get("Return-Path"); returnPath != "" && strings.Trim(strings.TrimSpace(returnPath), "<>") == "" {
+		return events.AutomatedNullReturnPath
+	}
+	return ""
+}
+
+// isLooped returns true if the message was sent by the bridge for this account.
+func (cli *Client) isLooped(h mail.Header) bool {
+	for _, value := range h.Values(LoopHeader) {
+		if NormalizeAddress(value) == NormalizeAddress(cli.emailAddress) {
+			return true
+		}
+	}
+	return false
+}
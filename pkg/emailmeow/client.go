@@ -3,141 +3,162 @@ package emailmeow
 import (
 	"context"
 	"fmt"
-	"io"
+	"net"
+	"net/http"
+	"sync"
 
-	"github.com/MakMoinee/go-mith/pkg/email"
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
-	"github.com/emersion/go-message/mail"
 	"github.com/rs/zerolog"
 )
 
+// ServerSettings contains the addresses of the mail servers used by a Client.
+// Both addresses are in host:port form.
+type ServerSettings struct {
+	IMAPServer string `json:"imap_server"`
+	SMTPServer string `json:"smtp_server"`
+}
+
+// DefaultServerSettings guesses the server settings for the given address
+// using the common imap.<domain> and smtp.<domain> hostnames.
+func DefaultServerSettings(address string) ServerSettings {
+	domain := AddressDomain(address)
+	return ServerSettings{
+		IMAPServer: net.JoinHostPort("imap."+domain, "993"),
+		SMTPServer: net.JoinHostPort("smtp."+domain, "587"),
+	}
+}
+
+// Fill replaces empty fields with the defaults for the given address.
+func (ss ServerSettings) Fill(address string) ServerSettings {
+	defaults := DefaultServerSettings(address)
+	if ss.IMAPServer == "" {
+		ss.IMAPServer = defaults.IMAPServer
+	}
+	if ss.SMTPServer == "" {
+		ss.SMTPServer = defaults.SMTPServer
+	}
+	return ss
+}
+
 type Client struct {
 	emailAddress string
 	password     string
 	Zlog         zerolog.Logger
 
-	EventHandler func(*imapclient.UnilateralDataMailbox)
-
-	emailService email.EmailIntf
+	// EventHandler receives *events.Message, *events.FlagsChanged and
+	// *events.Disconnected events from the receive loop.
+	EventHandler func(evt any)
 
 	imapClient   *imapclient.Client
 	IMAPServer   string
+	SMTPServer   string
 	selectedMbox *imap.SelectData
-	idleCmd      *imapclient.IdleCommand
 	imapOptions  imapclient.Options
 
-	connectionStatus chan (EmailConnectionStatus)
+	// HTTPClient is used for one-click unsubscription requests. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// imapLock is held while a command is sent outside the receive loop.
+	imapLock sync.Mutex
+
+	pendingLock  sync.Mutex
+	numMessages  uint32
+	seenMessages uint32
+	flagUpdates  map[uint32][]imap.Flag
+	wakeup       chan struct{}
+
+	// sent is the connection watching the \Sent mailbox, if the server has one.
+	sent *sentMailbox
+
+	commands      chan *imapCommand
+	stopReceiving context.CancelFunc
+	receiveDone   chan struct{}
 }
 
-func NewClient(address string, password string) *Client {
-	emailService := email.NewEmailService(587, "smtp.gmail.com", address, password)
+func NewClient(address string, password string, settings ServerSettings) *Client {
+	settings = settings.Fill(address)
 	return &Client{
 		emailAddress: address,
 		password:     password,
-		emailService: emailService,
-	}
-}
-
-func (c *Client) SendEmail(ctx context.Context, reciever string, msg string) error {
-	isSent, err := c.emailService.SendEmail(reciever, "Forwarder From Matrix", msg)
-	if err != nil {
-		c.Zlog.Err(err).Msg("Couldn't send email")
-		return err
+		IMAPServer:   settings.IMAPServer,
+		SMTPServer:   settings.SMTPServer,
+		flagUpdates:  make(map[uint32][]imap.Flag),
+		wakeup:       make(chan struct{}, 1),
+		commands:     make(chan *imapCommand),
 	}
-
-	if isSent {
-		c.Zlog.Debug().Msg("Email Sent")
-	} else {
-		c.Zlog.Debug().Msg("Email Not Sent")
-	}
-	return nil
 }
 
 func (cli *Client) Login(ctx context.Context, address string, password string) error {
-	// Check https://github.com/MakMoinee/go-mith/commit/9f22c396ea1adbf24a8721fa29cafea2cea1954f
-	cli.emailService = email.NewEmailService(587, "smtp.gmail.com", address, password)
+	if _, _, err := net.SplitHostPort(cli.SMTPServer); err != nil {
+		return fmt.Errorf("invalid SMTP server address: %w", err)
+	}
 
 	cli.imapOptions = imapclient.Options{
 		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
-			Expunge: func(seqNum uint32) {
-				cli.Zlog.Printf("message %v has been expunged", seqNum)
-			},
-			Mailbox: cli.EventHandler,
+			Expunge: cli.handleExpunge,
+			Mailbox: cli.handleMailbox,
+			Fetch:   cli.handleFetch,
 		},
 	}
 
 	imapcli, err := imapclient.DialTLS(cli.IMAPServer, &cli.imapOptions)
 	if err != nil {
-		cli.Zlog.Err(err).Msg("failed to dial IMAP server: %v")
+		cli.Zlog.Err(err).Msg("failed to dial IMAP server")
 		return err
 	}
 
-	cli.imapClient = imapcli
-
-	if err := cli.imapClient.Login(cli.emailAddress, cli.password).Wait(); err != nil {
-		cli.Zlog.Err(err).Msg("failed to login: %v")
+	if err := imapcli.Login(address, password).Wait(); err != nil {
+		cli.Zlog.Err(err).Msg("failed to login")
+		_ = imapcli.Close()
 		return err
 	}
 
-	mboxIndex, err := cli.imapClient.Select("INBOX", nil).Wait()
+	mboxIndex, err := imapcli.Select("INBOX", nil).Wait()
 	if err != nil {
-		cli.Zlog.Err(err).Msg("failed to select INBOX: %v")
+		cli.Zlog.Err(err).Msg("failed to select INBOX")
+		_ = imapcli.Close()
 		return err
 	}
 
+	cli.emailAddress = address
+	cli.password = password
+	cli.imapClient = imapcli
 	cli.selectedMbox = mboxIndex
+	cli.pendingLock.Lock()
+	cli.numMessages = mboxIndex.NumMessages
+	cli.seenMessages = mboxIndex.NumMessages
+	cli.pendingLock.Unlock()
+	cli.sent = cli.openSentMailbox(address, password)
 
 	return nil
 }
 
-func (c *Client) IsLoggedIn() bool {
-	return c.emailService != nil
-}
-
-func (c *Client) GetCurrentUser() (string, error) {
-	return c.emailAddress, nil
-}
-
-func (cli *Client) handleEvent(evt *imapclient.UnilateralDataMailbox) {
-	if cli.EventHandler != nil {
-		cli.EventHandler(evt)
-	}
-}
-
-func (cli *Client) FetchLastMessagePart() (mail.Part, error) {
-	seqSet := imap.SeqSetNum(cli.selectedMbox.NumMessages)
-	fetchOptions := &imap.FetchOptions{
-		BodySection: []*imap.FetchItemBodySection{{}},
-	}
-	fetchCmd := cli.imapClient.Fetch(seqSet, fetchOptions)
-	defer fetchCmd.Close()
-
-	msg := fetchCmd.Next()
-	if msg == nil {
-		return mail.Part{}, fmt.Errorf("FETCH command did not return any message")
-	}
-
-	var bodySection imapclient.FetchItemDataBodySection
-	for item := msg.Next(); item != nil; item = msg.Next() {
-		if bs, ok := item.(imapclient.FetchItemDataBodySection); ok {
-			bodySection = bs
-			break
-		}
+// Logout stops the receive loop, logs out of the IMAP server and closes the
+// connection.
+func (cli *Client) Logout() error {
+	cli.StopReceiveLoops()
+	if cli.imapClient == nil {
+		return nil
 	}
-
-	mr, err := mail.CreateReader(bodySection.Literal)
+	err := cli.imapClient.Logout().Wait()
 	if err != nil {
-		return mail.Part{}, fmt.Errorf("failed to create mail reader: %v", err)
+		cli.Zlog.Warn().Err(err).Msg("Failed to log out of IMAP server")
 	}
-
-	part, err := mr.NextPart()
-	if err != nil {
-		if err == io.EOF {
-			return mail.Part{}, fmt.Errorf("no parts found in the message")
-		}
-		return mail.Part{}, fmt.Errorf("failed to read message part: %v", err)
+	err = cli.imapClient.Close()
+	cli.imapClient = nil
+	if cli.sent != nil {
+		cli.sent.close(cli.Zlog)
+		cli.sent = nil
 	}
+	return err
+}
+
+func (c *Client) IsLoggedIn() bool {
+	return c.imapClient != nil
+}
 
-	return *part, nil
+func (c *Client) GetCurrentUser() (string, error) {
+	return c.emailAddress, nil
 }
@@ -0,0 +1,75 @@
+package emailmeow
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+
+	"imap-bridge/pkg/emailmeow/events"
+)
+
+// typedValue returns the value of a RFC 3464 field like "rfc822; user@example.com"
+// without the type prefix.
+func typedValue(value string) string {
+	if _, after, found := strings.Cut(value, ";"); found {
+		return strings.TrimSpace(after)
+	}
+	return strings.TrimSpace(value)
+}
+
+// parseDeliveryStatus reads a message/delivery-status body, which consists
+// of a per-message field block followed by a block for each recipient.
+func parseDeliveryStatus(report *events.DeliveryReport, r io.Reader) error {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	first := true
+	for {
+		fields, err := tr.ReadMIMEHeader()
+		if len(fields) > 0 {
+			if first {
+				first = false
+			} else {
+				report.Recipients = append(report.Recipients, events.DeliveryStatus{
+					Recipient:  NormalizeAddress(typedValue(fields.Get("Final-Recipient"))),
+					Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+					Status:     strings.TrimSpace(fields.Get("Status")),
+					Diagnostic: typedValue(fields.Get("Diagnostic-Code")),
+				})
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to parse delivery status: %w", err)
+		}
+	}
+}
+
+// parseOriginalHeaders finds the Message-ID in the returned headers or
+// message of a delivery report.
+func parseOriginalHeaders(report *events.DeliveryReport, r io.Reader) {
+	fields, _ := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if messageID := fields.Get("Message-Id"); messageID != "" {
+		report.OriginalMessageID = strings.Trim(strings.TrimSpace(messageID), "<>")
+	}
+}
+
+// parseDeliveryReportPart handles the machine-readable parts of a
+// multipart/report message. It returns false for other parts, like the
+// human-readable explanation.
+func parseDeliveryReportPart(report *events.DeliveryReport, part *mail.Part) (bool, error) {
+	mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	switch strings.ToLower(mediaType) {
+	case "message/delivery-status", "message/global-delivery-status":
+		return true, parseDeliveryStatus(report, part.Body)
+	case "message/rfc822", "message/global", "text/rfc822-headers", "message/global-headers":
+		parseOriginalHeaders(report, part.Body)
+		return true, nil
+	default:
+		return false, nil
+	}
+}
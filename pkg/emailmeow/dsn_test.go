@@ -0,0 +1,63 @@
+package emailmeow
+
+import (
+	"strings"
+	"testing"
+
+	"imap-bridge/pkg/emailmeow/events"
+)
+
+const bounce = "From: Mail Delivery System <MAILER-DAEMON@mx.example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"Auto-Submitted: auto-replied\r\n" +
+	"Message-ID: <bounce@mx.example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b\"\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.com\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; alice@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"Message-ID: <original@example.com>\r\n" +
+	"Subject: Hello\r\n" +
+	"--b--\r\n"
+
+func TestParseDeliveryReportWithAutoSubmitted(t *testing.T) {
+	msg, err := ParseMessage(strings.NewReader(bounce))
+	if err != nil {
+		t.Fatalf("failed to parse bounce: %v", err)
+	}
+	if msg.Info.Automated != events.AutomatedDeliveryReport {
+		t.Errorf("expected automated reason %q, got %q", events.AutomatedDeliveryReport, msg.Info.Automated)
+	}
+	report := msg.DeliveryReport
+	if report == nil {
+		t.Fatal("delivery report wasn't parsed")
+	}
+	if report.OriginalMessageID != "original@example.com" {
+		t.Errorf("unexpected original message ID %q", report.OriginalMessageID)
+	}
+	if len(report.Recipients) != 1 {
+		t.Fatalf("expected 1 recipient, got %d", len(report.Recipients))
+	}
+	status := report.Recipients[0]
+	if status.Recipient != "alice@example.org" || status.Action != "failed" || status.Status != "5.1.1" {
+		t.Errorf("unexpected recipient status %+v", status)
+	}
+	if msg.Text != "Your message could not be delivered." {
+		t.Errorf("unexpected text %q", msg.Text)
+	}
+}
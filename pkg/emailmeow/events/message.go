@@ -1,10 +1,175 @@
 package events
 
+import (
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
 type MessageInfo struct {
-	Sender   string
-	ThreadID string
+	Sender     string
+	SenderName string
+	Recipients []string
+	ThreadID   string
 
 	ThreadName string
+
+	MessageID  string
+	InReplyTo  []string
+	References []string
+	Timestamp  time.Time
+
+	// Automated is set if the message looks automatically generated.
+	Automated AutomatedReason
+
+	// List is set if the message was sent through a mailing list.
+	List *ListInfo
+	// ListUnsubscribe and ListUnsubscribePost are the raw RFC 2369 and
+	// RFC 8058 unsubscription headers, which newsletters send without List-Id.
+	ListUnsubscribe     string
+	ListUnsubscribePost string
+
+	// DispositionNotificationTo is the address that asked for a RFC 8098
+	// read receipt, if any.
+	DispositionNotificationTo string
+	// DispositionNotificationToSender is true if DispositionNotificationTo
+	// is the Return-Path or From address. RFC 8098 section 2.1 doesn't allow
+	// sending read receipts to other addresses without asking the user.
+	DispositionNotificationToSender bool
+}
+
+// AutomatedReason explains why a message was detected as automatically generated.
+type AutomatedReason string
+
+const (
+	AutomatedAutoSubmitted  AutomatedReason = "auto-submitted"
+	AutomatedPrecedence     AutomatedReason = "precedence"
+	AutomatedNullReturnPath AutomatedReason = "null-return-path"
+	AutomatedDeliveryReport AutomatedReason = "delivery-report"
+	// AutomatedDispositionNotification means that the message is a read
+	// receipt for a previously sent message.
+	AutomatedDispositionNotification AutomatedReason = "disposition-notification"
+	// AutomatedLoop means that the message has the loop protection header of
+	// mail sent by the bridge, i.e. it's an echo of a message sent from Matrix.
+	AutomatedLoop AutomatedReason = "loop"
+)
+
+// ListInfo contains the RFC 2919 and RFC 2369 mailing list headers of a message.
+type ListInfo struct {
+	// ID is the list identifier from List-Id, e.g. dev.lists.example.com
+	ID string
+	// Name is the human-readable description from List-Id.
+	Name string
+	// Post is the address for posting to the list. Empty if the list
+	// doesn't allow posting.
+	Post string
+	// Archive is the URL of the list archive.
+	Archive string
+}
+
+// Message is an email message fetched from the IMAP server.
+type Message struct {
+	Info   MessageInfo
+	Header mail.Header
+
+	Text string
+	HTML string
+	// InlineParts are the parts that the HTML body can reference with cid: URLs.
+	InlineParts []*InlinePart
+
+	// Raw is the full RFC 5322 message.
+	Raw []byte
+	// UID is the IMAP UID of the message in the selected mailbox.
+	UID uint32
+	// Sent is true if the message was found in the \Sent mailbox, i.e. the
+	// user sent it from another mail client. UID isn't valid for these.
+	Sent bool
+
+	Seen    bool
+	Flagged bool
+
+	// DeliveryReport is set if the message is a delivery status notification.
+	DeliveryReport *DeliveryReport
+	// DispositionNotification is set if the message is a read receipt.
+	DispositionNotification *DispositionNotification
+}
+
+// InlinePart is a non-text part with a Content-ID, usually an image shown
+// inside the HTML body.
+type InlinePart struct {
+	ContentID   string
+	ContentType string
+	Filename    string
+	Data        []byte
+}
+
+// GetInlinePart returns the part with the given Content-ID, or nil if the
+// message doesn't have one.
+func (msg *Message) GetInlinePart(contentID string) *InlinePart {
+	for _, part := range msg.InlineParts {
+		if part.ContentID == contentID {
+			return part
+		}
+	}
+	return nil
+}
+
+// DeliveryReport is a RFC 3464 delivery status notification, e.g. a bounce.
+type DeliveryReport struct {
+	// OriginalMessageID is the Message-ID of the mail that the report is about.
+	OriginalMessageID string
+	Recipients        []DeliveryStatus
+}
+
+// Failed returns the recipients that the mail couldn't be delivered to.
+func (dr *DeliveryReport) Failed() []DeliveryStatus {
+	var failed []DeliveryStatus
+	for _, rcpt := range dr.Recipients {
+		if rcpt.Action == "failed" {
+			failed = append(failed, rcpt)
+		}
+	}
+	return failed
+}
+
+// DeliveryStatus is the delivery status of a single recipient.
+type DeliveryStatus struct {
+	Recipient string
+	// Action is failed, delayed, delivered, relayed or expanded.
+	Action string
+	// Status is the enhanced status code, e.g. 5.1.1
+	Status string
+	// Diagnostic is the human-readable error from the remote server.
+	Diagnostic string
+}
+
+// DispositionNotification is a RFC 8098 message disposition notification,
+// which mail clients send when the recipient reads a message.
+type DispositionNotification struct {
+	// OriginalMessageID is the Message-ID of the mail that was read.
+	OriginalMessageID string
+	// Recipient is the address that the original mail was delivered to.
+	Recipient string
+	// Disposition is displayed, deleted, dispatched or processed.
+	Disposition string
+}
+
+// IsDisplayed returns true if the notification means that the mail was read.
+func (dn *DispositionNotification) IsDisplayed() bool {
+	return dn.Disposition == "displayed"
+}
+
+// FlagsChanged is sent when the flags of an already bridged message are
+// changed, e.g. by another mail client.
+type FlagsChanged struct {
+	MessageID string
+	Seen      bool
+	Flagged   bool
+}
+
+// Disconnected is sent when the receive loop stops due to a connection error.
+type Disconnected struct {
+	Err error
 }
 
 type ChatEvent struct {
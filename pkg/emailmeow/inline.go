@@ -0,0 +1,48 @@
+package emailmeow
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+
+	"imap-bridge/pkg/emailmeow/events"
+)
+
+// maxInlinePartSize is the size limit of parts referenced from the HTML body.
+// Larger parts are skipped instead of being kept in memory.
+const maxInlinePartSize = 10 * 1024 * 1024
+
+// parseInlinePart reads a non-text part that has a Content-ID, like an image
+// in a multipart/related message. It returns nil for other parts.
+func parseInlinePart(part *mail.Part) (*events.InlinePart, error) {
+	contentID := strings.Trim(strings.TrimSpace(part.Header.Get("Content-Id")), "<>")
+	if contentID == "" {
+		return nil, nil
+	}
+	contentType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	contentType = strings.ToLower(contentType)
+	if contentType == "" || strings.HasPrefix(contentType, "text/") || strings.HasPrefix(contentType, "multipart/") {
+		return nil, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(part.Body, maxInlinePartSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inline part %s: %w", contentID, err)
+	} else if len(data) > maxInlinePartSize {
+		return nil, nil
+	}
+	inline := &events.InlinePart{
+		ContentID:   contentID,
+		ContentType: contentType,
+		Filename:    params["name"],
+		Data:        data,
+	}
+	if attachment, ok := part.Header.(*mail.AttachmentHeader); ok {
+		if filename, _ := attachment.Filename(); filename != "" {
+			inline.Filename = filename
+		}
+	}
+	return inline, nil
+}
@@ -0,0 +1,84 @@
+package emailmeow
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+
+	"imap-bridge/pkg/emailmeow/events"
+)
+
+// parseHeaderURLs returns the angle-bracketed URLs of a RFC 2369 list header
+// like List-Post or List-Unsubscribe, in order of preference.
+func parseHeaderURLs(value string) []string {
+	var urls []string
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			return urls
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			return urls
+		}
+		if u := strings.Join(strings.Fields(value[start+1:start+end]), ""); u != "" {
+			urls = append(urls, u)
+		}
+		value = value[start+end+1:]
+	}
+}
+
+// mailtoAddress returns the address of a mailto: URL, or an empty string if
+// the URL isn't a mailto: URL.
+func mailtoAddress(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || !strings.EqualFold(parsed.Scheme, "mailto") {
+		return ""
+	}
+	addr := parsed.Opaque
+	if addr == "" {
+		addr = parsed.Path
+	}
+	addr, err = url.PathUnescape(addr)
+	if err != nil {
+		return ""
+	}
+	return NormalizeAddress(addr)
+}
+
+// parseListInfo reads the mailing list headers of a message. It returns nil
+// if the message doesn't have a List-Id header.
+func parseListInfo(h mail.Header) *events.ListInfo {
+	listID, err := h.Text("List-Id")
+	if err != nil {
+		listID = h.Get("List-Id")
+	}
+	listID = strings.TrimSpace(listID)
+	if listID == "" {
+		return nil
+	}
+	var info events.ListInfo
+	if start := strings.LastIndexByte(listID, '<'); start >= 0 {
+		info.ID = strings.TrimSuffix(listID[start+1:], ">")
+		info.Name = strings.Trim(strings.TrimSpace(listID[:start]), `"`)
+	} else {
+		info.ID = listID
+	}
+	info.ID = strings.ToLower(strings.TrimSpace(info.ID))
+	if info.ID == "" {
+		return nil
+	}
+	for _, postURL := range parseHeaderURLs(h.Get("List-Post")) {
+		if info.Post = mailtoAddress(postURL); info.Post != "" {
+			break
+		}
+	}
+	for _, archiveURL := range parseHeaderURLs(h.Get("List-Archive")) {
+		if strings.HasPrefix(archiveURL, "https://") || strings.HasPrefix(archiveURL, "http://") {
+			info.Archive = archiveURL
+			break
+		}
+	}
+	return &info
+}
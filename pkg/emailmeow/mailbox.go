@@ -0,0 +1,40 @@
+package emailmeow
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// MarkSeen sets the \Seen flag of a message in the selected mailbox.
+//
+// This must not be called synchronously from the EventHandler, as the
+// receive loop is blocked while events are being handled.
+func (cli *Client) MarkSeen(ctx context.Context, uid uint32) error {
+	return cli.runIMAPCommand(ctx, func(c *imapclient.Client) error {
+		err := c.Store(imap.UIDSetNum(imap.UID(uid)), &imap.StoreFlags{
+			Op:     imap.StoreFlagsAdd,
+			Silent: true,
+			Flags:  []imap.Flag{imap.FlagSeen},
+		}, nil).Close()
+		if err != nil {
+			return fmt.Errorf("failed to set seen flag: %w", err)
+		}
+		return nil
+	})
+}
+
+// MoveMessage moves a message from the selected mailbox to another mailbox.
+//
+// Like MarkSeen, this must not be called synchronously from the EventHandler.
+func (cli *Client) MoveMessage(ctx context.Context, uid uint32, mailbox string) error {
+	return cli.runIMAPCommand(ctx, func(c *imapclient.Client) error {
+		_, err := c.Move(imap.UIDSetNum(imap.UID(uid)), mailbox).Wait()
+		if err != nil {
+			return fmt.Errorf("failed to move message to %s: %w", mailbox, err)
+		}
+		return nil
+	})
+}
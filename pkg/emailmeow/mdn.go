@@ -0,0 +1,129 @@
+package emailmeow
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+
+	"imap-bridge/pkg/emailmeow/events"
+)
+
+// reportingUA identifies the bridge in disposition notifications it sends.
+const reportingUA = "imap-bridge"
+
+// OutgoingDispositionNotification is a read receipt for a received message.
+type OutgoingDispositionNotification struct {
+	// To is the address from the Disposition-Notification-To header.
+	To                string
+	OriginalMessageID string
+	OriginalSubject   string
+	// Manual is true if the user chose to send the notification, and false
+	// if it was sent automatically because of their settings.
+	Manual bool
+}
+
+// parseDisposition returns the disposition type of a RFC 8098 Disposition
+// field like "manual-action/MDN-sent-manually; displayed".
+func parseDisposition(value string) string {
+	_, dispositionType, found := strings.Cut(value, ";")
+	if !found {
+		dispositionType = value
+	}
+	// Strip modifiers like displayed/error
+	dispositionType, _, _ = strings.Cut(dispositionType, "/")
+	return strings.ToLower(strings.TrimSpace(dispositionType))
+}
+
+// parseDispositionNotificationPart handles the machine-readable part of a
+// multipart/report message. It returns false for other parts.
+func parseDispositionNotificationPart(dn *events.DispositionNotification, part *mail.Part) (bool, error) {
+	mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	switch strings.ToLower(mediaType) {
+	case "message/disposition-notification", "message/global-disposition-notification":
+	default:
+		return false, nil
+	}
+	fields, err := textproto.NewReader(bufio.NewReader(part.Body)).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return true, fmt.Errorf("failed to parse disposition notification: %w", err)
+	}
+	dn.OriginalMessageID = strings.Trim(strings.TrimSpace(fields.Get("Original-Message-Id")), "<>")
+	dn.Recipient = NormalizeAddress(typedValue(fields.Get("Final-Recipient")))
+	dn.Disposition = parseDisposition(fields.Get("Disposition"))
+	return true, nil
+}
+
+// composeDispositionNotification builds a multipart/report message saying
+// that the original message was displayed to the user.
+func (cli *Client) composeDispositionNotification(mdn *OutgoingDispositionNotification) ([]byte, error) {
+	h, _, err := cli.newHeader([]string{mdn.To}, "Read: "+mdn.OriginalSubject, mdn.OriginalMessageID, []string{mdn.OriginalMessageID})
+	if err != nil {
+		return nil, err
+	}
+	actionMode := "manual-action/MDN-sent-manually"
+	if !mdn.Manual {
+		actionMode = "automatic-action/MDN-sent-automatically"
+		h.Set("Auto-Submitted", "auto-replied")
+	}
+	h.SetContentType("multipart/report", map[string]string{"report-type": "disposition-notification"})
+
+	var buf bytes.Buffer
+	w, err := message.CreateWriter(&buf, h.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message writer: %w", err)
+	}
+	var textHeader message.Header
+	textHeader.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	text := fmt.Sprintf("The message sent to %s with the subject %q was displayed.\r\n", cli.emailAddress, mdn.OriginalSubject)
+	if err = writePart(w, textHeader, text); err != nil {
+		return nil, err
+	}
+	var reportHeader message.Header
+	reportHeader.SetContentType("message/disposition-notification", nil)
+	report := fmt.Sprintf(
+		"Reporting-UA: %s\r\nFinal-Recipient: rfc822;%s\r\nOriginal-Message-ID: <%s>\r\nDisposition: %s; displayed\r\n",
+		reportingUA, cli.emailAddress, mdn.OriginalMessageID, actionMode,
+	)
+	if err = writePart(w, reportHeader, report); err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to finish message: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func writePart(w *message.Writer, header message.Header, body string) error {
+	pw, err := w.CreatePart(header)
+	if err != nil {
+		return fmt.Errorf("failed to create message part: %w", err)
+	}
+	_, err = io.WriteString(pw, body)
+	if err != nil {
+		return fmt.Errorf("failed to write message part: %w", err)
+	}
+	return pw.Close()
+}
+
+// SendDispositionNotification sends a read receipt for a received message.
+func (cli *Client) SendDispositionNotification(ctx context.Context, mdn *OutgoingDispositionNotification) error {
+	raw, err := cli.composeDispositionNotification(mdn)
+	if err != nil {
+		return err
+	}
+	err = cli.Submit(ctx, []string{mdn.To}, raw)
+	if err != nil {
+		return err
+	}
+	cli.Zlog.Debug().Str("original_message_id", mdn.OriginalMessageID).Msg("Disposition notification sent")
+	return nil
+}
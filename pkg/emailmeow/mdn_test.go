@@ -0,0 +1,78 @@
+package emailmeow
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"imap-bridge/pkg/emailmeow/events"
+)
+
+func TestDispositionNotificationRoundTrip(t *testing.T) {
+	cli := NewClient("bob@example.com", "", ServerSettings{})
+	for _, manual := range []bool{false, true} {
+		raw, err := cli.composeDispositionNotification(&OutgoingDispositionNotification{
+			To:                "alice@example.com",
+			OriginalMessageID: "original@example.com",
+			OriginalSubject:   "Hello",
+			Manual:            manual,
+		})
+		if err != nil {
+			t.Fatalf("failed to compose notification: %v", err)
+		}
+		msg, err := ParseMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("failed to parse notification: %v", err)
+		}
+		if msg.Info.Automated != events.AutomatedDispositionNotification {
+			t.Errorf("manual=%t: expected automated reason %q, got %q", manual, events.AutomatedDispositionNotification, msg.Info.Automated)
+		}
+		dn := msg.DispositionNotification
+		if dn == nil {
+			t.Fatalf("manual=%t: notification wasn't parsed", manual)
+		}
+		if dn.OriginalMessageID != "original@example.com" {
+			t.Errorf("manual=%t: unexpected original message ID %q", manual, dn.OriginalMessageID)
+		}
+		if dn.Recipient != "bob@example.com" {
+			t.Errorf("manual=%t: unexpected recipient %q", manual, dn.Recipient)
+		}
+		if dn.Disposition != "displayed" {
+			t.Errorf("manual=%t: unexpected disposition %q", manual, dn.Disposition)
+		}
+	}
+}
+
+func TestDispositionNotificationToSender(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		want    bool
+	}{
+		{"sender", "Disposition-Notification-To: <Alice@example.com>\r\n", true},
+		{"return path", "Return-Path: <bounces@lists.example.com>\r\nDisposition-Notification-To: bounces@lists.example.com\r\n", true},
+		{"third party", "Return-Path: <alice@example.com>\r\nDisposition-Notification-To: tracker@example.net\r\n", false},
+		{"empty return path", "Return-Path: <>\r\nDisposition-Notification-To: tracker@example.net\r\n", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := "From: Alice <alice@example.com>\r\n" +
+				"To: bob@example.com\r\n" +
+				"Subject: Hello\r\n" +
+				"Message-ID: <hello@example.com>\r\n" +
+				test.headers +
+				"\r\n" +
+				"Hi Bob\r\n"
+			msg, err := ParseMessage(strings.NewReader(raw))
+			if err != nil {
+				t.Fatalf("failed to parse message: %v", err)
+			}
+			if msg.Info.DispositionNotificationTo == "" {
+				t.Fatal("read receipt address wasn't parsed")
+			}
+			if msg.Info.DispositionNotificationToSender != test.want {
+				t.Errorf("expected %t, got %t", test.want, msg.Info.DispositionNotificationToSender)
+			}
+		})
+	}
+}
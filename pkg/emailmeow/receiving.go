@@ -1,31 +1,405 @@
 package emailmeow
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
 
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	// Register charsets for decoding non-UTF-8 bodies and RFC 2047 encoded words
+	_ "github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
+
+	"imap-bridge/pkg/emailmeow/events"
 )
 
-type EmailConnectionStatus struct {
-	Event mail.Part
-	Err   error
+var ErrNotConnected = errors.New("not connected to IMAP server")
+
+type imapCommand struct {
+	fn   func(*imapclient.Client) error
+	done chan error
+}
+
+func (cli *Client) signalWakeup() {
+	select {
+	case cli.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (cli *Client) handleMailbox(evt *imapclient.UnilateralDataMailbox) {
+	if evt.NumMessages == nil {
+		return
+	}
+	cli.pendingLock.Lock()
+	cli.numMessages = *evt.NumMessages
+	hasNew := cli.numMessages > cli.seenMessages
+	cli.pendingLock.Unlock()
+	if hasNew {
+		cli.signalWakeup()
+	}
+}
+
+func (cli *Client) handleExpunge(seqNum uint32) {
+	cli.pendingLock.Lock()
+	defer cli.pendingLock.Unlock()
+	if cli.numMessages > 0 {
+		cli.numMessages--
+	}
+	if seqNum <= cli.seenMessages {
+		cli.seenMessages--
+	}
+	// Sequence numbers of pending flag updates may have shifted
+	clear(cli.flagUpdates)
+}
+
+func (cli *Client) handleFetch(msg *imapclient.FetchMessageData) {
+	buf, err := msg.Collect()
+	if err != nil {
+		cli.Zlog.Warn().Err(err).Uint32("seq_num", msg.SeqNum).Msg("Failed to read unilateral FETCH")
+		return
+	} else if buf.Flags == nil {
+		return
+	}
+	cli.pendingLock.Lock()
+	// Flags of messages that haven't been bridged yet will be fetched with the message itself
+	isKnown := buf.SeqNum <= cli.seenMessages
+	if isKnown {
+		cli.flagUpdates[buf.SeqNum] = buf.Flags
+	}
+	cli.pendingLock.Unlock()
+	if isKnown {
+		cli.signalWakeup()
+	}
+}
+
+// StartReceiveLoops starts idling in the selected mailbox and the \Sent
+// mailbox. New messages and flag changes are passed to the EventHandler until
+// StopReceiveLoops is called or the connection fails.
+func (cli *Client) StartReceiveLoops(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	cli.stopReceiving = cancel
+	cli.receiveDone = make(chan struct{})
+	go cli.receiveLoop(ctx)
+	if cli.sent != nil {
+		go cli.sentLoop(ctx)
+	}
+}
+
+// StopReceiveLoops stops idling and waits for the receive loops to exit.
+func (cli *Client) StopReceiveLoops() {
+	if cli.stopReceiving == nil {
+		return
+	}
+	cli.stopReceiving()
+	<-cli.receiveDone
+	if cli.sent != nil {
+		<-cli.sent.done
+	}
+	cli.stopReceiving = nil
+}
+
+func (cli *Client) receiveLoop(ctx context.Context) {
+	defer close(cli.receiveDone)
+	for {
+		cli.imapLock.Lock()
+		idleCmd, err := cli.imapClient.Idle()
+		if err != nil {
+			cli.imapLock.Unlock()
+			cli.Zlog.Err(err).Msg("IDLE command failed")
+			cli.dispatch(&events.Disconnected{Err: err})
+			return
+		}
+		var cmd *imapCommand
+		select {
+		case <-ctx.Done():
+		case <-cli.wakeup:
+		case cmd = <-cli.commands:
+		}
+		if err = idleCmd.Close(); err == nil {
+			err = idleCmd.Wait()
+		}
+		if err != nil {
+			cli.imapLock.Unlock()
+			cli.Zlog.Err(err).Msg("Failed to stop idling")
+			if cmd != nil {
+				cmd.done <- err
+			}
+			cli.dispatch(&events.Disconnected{Err: err})
+			return
+		}
+		if cmd != nil {
+			cmd.done <- cmd.fn(cli.imapClient)
+		}
+		cli.imapLock.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		cli.processPending()
+	}
+}
+
+// runIMAPCommand runs fn with exclusive access to the IMAP connection,
+// pausing IDLE if the receive loop is running.
+func (cli *Client) runIMAPCommand(ctx context.Context, fn func(*imapclient.Client) error) error {
+	if cli.imapClient == nil {
+		return ErrNotConnected
+	}
+	if cli.stopReceiving != nil {
+		cmd := &imapCommand{fn: fn, done: make(chan error, 1)}
+		select {
+		case cli.commands <- cmd:
+			return <-cmd.done
+		case <-cli.receiveDone:
+			// The receive loop exited, fall back to running directly
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return cli.runLocked(fn)
+}
+
+// runLocked runs fn directly. It must only be used when IDLE isn't running,
+// i.e. outside the receive loop or between its IDLE commands.
+func (cli *Client) runLocked(fn func(*imapclient.Client) error) error {
+	cli.imapLock.Lock()
+	defer cli.imapLock.Unlock()
+	return fn(cli.imapClient)
+}
+
+func (cli *Client) dispatch(evt any) {
+	if cli.EventHandler != nil {
+		cli.EventHandler(evt)
+	}
+}
+
+func (cli *Client) processPending() {
+	cli.pendingLock.Lock()
+	from, to := cli.seenMessages+1, cli.numMessages
+	cli.seenMessages = cli.numMessages
+	flagUpdates := cli.flagUpdates
+	cli.flagUpdates = make(map[uint32][]imap.Flag)
+	cli.pendingLock.Unlock()
+
+	if from <= to {
+		var seqSet imap.SeqSet
+		seqSet.AddRange(from, to)
+		cli.fetchNewMessages(seqSet)
+	}
+	if len(flagUpdates) > 0 {
+		cli.fetchFlagUpdates(flagUpdates)
+	}
+}
+
+var newMessageFetchOptions = &imap.FetchOptions{
+	UID:         true,
+	Flags:       true,
+	BodySection: []*imap.FetchItemBodySection{{Peek: true}},
 }
 
-func (cli *Client) StartReceiveLoops(ctx context.Context) (chan EmailConnectionStatus, error) {
-	defer func() {
-		if err := cli.idleCmd.Close(); err != nil {
-			cli.Zlog.Err(err).Msg("failed to stop idling: %v")
+func (cli *Client) fetchNewMessages(seqSet imap.SeqSet) {
+	var msgs []*imapclient.FetchMessageBuffer
+	err := cli.runLocked(func(c *imapclient.Client) (err error) {
+		msgs, err = c.Fetch(seqSet, newMessageFetchOptions).Collect()
+		return
+	})
+	if err != nil {
+		cli.Zlog.Err(err).Stringer("seq_set", seqSet).Msg("Failed to fetch new messages")
+		return
+	}
+	for _, msg := range cli.parseFetchedMessages(msgs) {
+		cli.dispatch(msg)
+	}
+}
+
+func (cli *Client) parseFetchedMessages(msgs []*imapclient.FetchMessageBuffer) []*events.Message {
+	parsed := make([]*events.Message, 0, len(msgs))
+	for _, buf := range msgs {
+		var raw []byte
+		for _, body := range buf.BodySection {
+			raw = body
+		}
+		if raw == nil {
+			cli.Zlog.Warn().Uint32("seq_num", buf.SeqNum).Msg("FETCH did not return message body")
+			continue
 		}
-	}()
+		msg, err := ParseMessage(bytes.NewReader(raw))
+		if err != nil {
+			cli.Zlog.Err(err).Uint32("seq_num", buf.SeqNum).Msg("Failed to parse message")
+			continue
+		}
+		msg.Raw = raw
+		msg.UID = uint32(buf.UID)
+		if cli.isLooped(msg.Header) {
+			msg.Info.Automated = events.AutomatedLoop
+		}
+		msg.Seen = slices.Contains(buf.Flags, imap.FlagSeen)
+		msg.Flagged = slices.Contains(buf.Flags, imap.FlagFlagged)
+		parsed = append(parsed, msg)
+	}
+	return parsed
+}
 
-	// Start idling
-	initialIdleCmd, err := cli.imapClient.Idle()
+func (cli *Client) fetchFlagUpdates(flagUpdates map[uint32][]imap.Flag) {
+	var seqSet imap.SeqSet
+	for seqNum := range flagUpdates {
+		seqSet.AddNum(seqNum)
+	}
+	var msgs []*imapclient.FetchMessageBuffer
+	err := cli.runLocked(func(c *imapclient.Client) (err error) {
+		msgs, err = c.Fetch(seqSet, &imap.FetchOptions{Envelope: true}).Collect()
+		return
+	})
 	if err != nil {
-		cli.Zlog.Err(err).Msg("IDLE command failed: %v")
-		return nil, err
+		cli.Zlog.Err(err).Stringer("seq_set", seqSet).Msg("Failed to fetch envelopes for flag updates")
+		return
+	}
+	for _, buf := range msgs {
+		if buf.Envelope == nil || buf.Envelope.MessageID == "" {
+			continue
+		}
+		flags := flagUpdates[buf.SeqNum]
+		cli.dispatch(&events.FlagsChanged{
+			MessageID: buf.Envelope.MessageID,
+			Seen:      slices.Contains(flags, imap.FlagSeen),
+			Flagged:   slices.Contains(flags, imap.FlagFlagged),
+		})
+	}
+}
+
+// ParseMessageInfo extracts the metadata used for bridging from a message header.
+func ParseMessageInfo(h mail.Header) events.MessageInfo {
+	var info events.MessageInfo
+	from, _ := h.AddressList("From")
+	if len(from) > 0 {
+		info.Sender = NormalizeAddress(from[0].Address)
+		info.SenderName = from[0].Name
+	}
+	if info.SenderName == "" {
+		replyTo, _ := h.AddressList("Reply-To")
+		for _, addr := range replyTo {
+			if NormalizeAddress(addr.Address) == info.Sender && addr.Name != "" {
+				info.SenderName = addr.Name
+				break
+			}
+		}
+	}
+	for _, key := range []string{"To", "Cc"} {
+		addrs, _ := h.AddressList(key)
+		for _, addr := range addrs {
+			info.Recipients = append(info.Recipients, NormalizeAddress(addr.Address))
+		}
 	}
+	info.ThreadName, _ = h.Subject()
+	info.MessageID, _ = h.MessageID()
+	info.InReplyTo, _ = h.MsgIDList("In-Reply-To")
+	info.References, _ = h.MsgIDList("References")
+	info.Timestamp, _ = h.Date()
+	info.List = parseListInfo(h)
+	info.ListUnsubscribe = h.Get("List-Unsubscribe")
+	info.ListUnsubscribePost = h.Get("List-Unsubscribe-Post")
+	if mdnTo, _ := h.AddressList("Disposition-Notification-To"); len(mdnTo) > 0 {
+		info.DispositionNotificationTo = NormalizeAddress(mdnTo[0].Address)
+		returnPath := strings.Trim(strings.TrimSpace(h.Get("Return-Path")), "<>")
+		info.DispositionNotificationToSender = info.DispositionNotificationTo == info.Sender ||
+			(returnPath != "" && info.DispositionNotificationTo == NormalizeAddress(returnPath))
+	}
+	info.Automated = detectAutomated(h, info.List != nil)
+	switch {
+	case len(info.References) > 0:
+		info.ThreadID = info.References[0]
+	case len(info.InReplyTo) > 0:
+		info.ThreadID = info.InReplyTo[0]
+	default:
+		info.ThreadID = info.MessageID
+	}
+	return info
+}
 
-	cli.idleCmd = initialIdleCmd
+// ParseMessage reads a full RFC 5322 message.
+func ParseMessage(r io.Reader) (*events.Message, error) {
+	mr, err := mail.CreateReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mail reader: %w", err)
+	}
+	defer mr.Close()
 
-	return cli.connectionStatus, nil
+	msg := &events.Message{
+		Info:   ParseMessageInfo(mr.Header),
+		Header: mr.Header,
+	}
+	switch reportType(mr.Header) {
+	case "delivery-status":
+		msg.DeliveryReport = &events.DeliveryReport{}
+	case "disposition-notification":
+		msg.DispositionNotification = &events.DispositionNotification{}
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read message part: %w", err)
+		}
+		if msg.DeliveryReport != nil {
+			isReportPart, err := parseDeliveryReportPart(msg.DeliveryReport, part)
+			if err != nil {
+				return nil, err
+			} else if isReportPart {
+				continue
+			}
+		} else if msg.DispositionNotification != nil {
+			isReportPart, err := parseDispositionNotificationPart(msg.DispositionNotification, part)
+			if err != nil {
+				return nil, err
+			} else if isReportPart {
+				continue
+			}
+		}
+		inlinePart, err := parseInlinePart(part)
+		if err != nil {
+			return nil, err
+		} else if inlinePart != nil {
+			msg.InlineParts = append(msg.InlineParts, inlinePart)
+			continue
+		}
+		inlineHeader, ok := part.Header.(*mail.InlineHeader)
+		if !ok {
+			continue
+		}
+		contentType, _, err := inlineHeader.ContentType()
+		if err != nil {
+			contentType = "text/plain"
+		}
+		if !strings.HasPrefix(contentType, "text/") {
+			continue
+		}
+		body, err := io.ReadAll(part.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s part: %w", contentType, err)
+		}
+		switch {
+		case contentType == "text/html" && msg.HTML == "":
+			msg.HTML = string(body)
+		case contentType == "text/plain" && msg.Text == "":
+			msg.Text = string(body)
+		}
+	}
+	if msg.DeliveryReport != nil && msg.DeliveryReport.OriginalMessageID == "" && len(msg.Info.InReplyTo) > 0 {
+		msg.DeliveryReport.OriginalMessageID = msg.Info.InReplyTo[0]
+	}
+	if msg.DispositionNotification != nil {
+		if msg.DispositionNotification.OriginalMessageID == "" && len(msg.Info.InReplyTo) > 0 {
+			msg.DispositionNotification.OriginalMessageID = msg.Info.InReplyTo[0]
+		}
+		if msg.DispositionNotification.Recipient == "" {
+			msg.DispositionNotification.Recipient = msg.Info.Sender
+		}
+	}
+	return msg, nil
 }
@@ -0,0 +1,249 @@
+package emailmeow
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// OutgoingMessage is an email to be composed and submitted over SMTP.
+type OutgoingMessage struct {
+	To      []string
+	Subject string
+	Text    string
+
+	InReplyTo  string
+	References []string
+
+	Attachments []*OutgoingAttachment
+
+	// Date is the time shown as the send time, e.g. for scheduled messages.
+	// The current time is used if it's not set.
+	Date time.Time
+
+	// RequestReadReceipt asks the recipient's mail client to send a RFC 8098
+	// read receipt to the account.
+	RequestReadReceipt bool
+}
+
+// OutgoingAttachment is a file attached to an outgoing email.
+type OutgoingAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// newHeader creates the header fields shared by all mail sent from the account.
+func (cli *Client) newHeader(to []string, subject, inReplyTo string, references []string) (mail.Header, string, error) {
+	var h mail.Header
+	h.SetDate(time.Now())
+	h.SetAddressList("From", []*mail.Address{{Address: cli.emailAddress}})
+	toAddrs := make([]*mail.Address, len(to))
+	for i, addr := range to {
+		toAddrs[i] = &mail.Address{Address: addr}
+	}
+	h.SetAddressList("To", toAddrs)
+	h.SetSubject(subject)
+	err := h.GenerateMessageIDWithHostname(AddressDomain(cli.emailAddress))
+	if err != nil {
+		return h, "", fmt.Errorf("failed to generate message ID: %w", err)
+	}
+	messageID, _ := h.MessageID()
+	if inReplyTo != "" {
+		h.SetMsgIDList("In-Reply-To", []string{inReplyTo})
+	}
+	h.SetMsgIDList("References", references)
+	h.Set(LoopHeader, cli.emailAddress)
+	return h, messageID, nil
+}
+
+// Compose builds the MIME representation of the message. It returns the raw
+// message and the generated Message-ID without angle brackets.
+func (cli *Client) Compose(msg *OutgoingMessage) ([]byte, string, error) {
+	h, messageID, err := cli.newHeader(msg.To, msg.Subject, msg.InReplyTo, msg.References)
+	if err != nil {
+		return nil, "", err
+	}
+	if !msg.Date.IsZero() {
+		h.SetDate(msg.Date)
+	}
+	if msg.RequestReadReceipt {
+		h.SetAddressList("Disposition-Notification-To", []*mail.Address{{Address: cli.emailAddress}})
+	}
+	var buf bytes.Buffer
+	if len(msg.Attachments) == 0 {
+		h.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+		err = writeSinglePart(&buf, h, msg.Text)
+	} else {
+		err = writeMixedParts(&buf, h, msg.Text, msg.Attachments)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), messageID, nil
+}
+
+func writeSinglePart(buf *bytes.Buffer, h mail.Header, text string) error {
+	w, err := mail.CreateSingleInlineWriter(buf, h)
+	if err != nil {
+		return fmt.Errorf("failed to create message writer: %w", err)
+	}
+	_, err = io.WriteString(w, text)
+	if err != nil {
+		return fmt.Errorf("failed to write message body: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to finish message: %w", err)
+	}
+	return nil
+}
+
+// writeMixedParts writes a multipart/mixed message with the text followed by
+// the attachments.
+func writeMixedParts(buf *bytes.Buffer, h mail.Header, text string, attachments []*OutgoingAttachment) error {
+	w, err := mail.CreateWriter(buf, h)
+	if err != nil {
+		return fmt.Errorf("failed to create message writer: %w", err)
+	}
+	var textHeader mail.InlineHeader
+	textHeader.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	tw, err := w.CreateSingleInline(textHeader)
+	if err != nil {
+		return fmt.Errorf("failed to create text part: %w", err)
+	}
+	_, err = io.WriteString(tw, text)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write message body: %w", err)
+	}
+	for _, att := range attachments {
+		var attHeader mail.AttachmentHeader
+		attHeader.SetContentType(att.ContentType, nil)
+		attHeader.SetFilename(att.Filename)
+		aw, err := w.CreateAttachment(attHeader)
+		if err != nil {
+			return fmt.Errorf("failed to create attachment part: %w", err)
+		}
+		_, err = aw.Write(att.Data)
+		if err == nil {
+			err = aw.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write attachment %s: %w", att.Filename, err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to finish message: %w", err)
+	}
+	return nil
+}
+
+// Submit sends an already composed message to the given recipients through
+// the SMTP server of the account.
+func (cli *Client) Submit(ctx context.Context, to []string, raw []byte) error {
+	host, port, err := net.SplitHostPort(cli.SMTPServer)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP server address: %w", err)
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	var dialer net.Dialer
+	var conn net.Conn
+	if port == "465" {
+		conn, err = (&tls.Dialer{NetDialer: &dialer, Config: tlsConfig}).DialContext(ctx, "tcp", cli.SMTPServer)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", cli.SMTPServer)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		if err = c.Auth(smtp.PlainAuth("", cli.emailAddress, cli.password, host)); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+	if err = c.Mail(cli.emailAddress); err != nil {
+		return fmt.Errorf("MAIL FROM failed: %w", err)
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("RCPT TO %s failed: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA failed: %w", err)
+	}
+	if _, err = w.Write(raw); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("failed to finish message: %w", err)
+	}
+	return c.Quit()
+}
+
+// IsPermanentError returns true if the SMTP server rejected the message with
+// a permanent (5xx) error, which means that retrying won't help.
+func IsPermanentError(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
+}
+
+// SendMessage composes the message and submits it. It returns the Message-ID
+// of the sent message.
+func (cli *Client) SendMessage(ctx context.Context, msg *OutgoingMessage) (string, error) {
+	raw, messageID, err := cli.Compose(msg)
+	if err != nil {
+		return "", err
+	}
+	err = cli.Submit(ctx, msg.To, raw)
+	if err != nil {
+		cli.Zlog.Err(err).Msg("Couldn't send email")
+		return "", err
+	}
+	cli.Zlog.Debug().Str("message_id", messageID).Msg("Email sent")
+	return messageID, nil
+}
+
+// AddressDomain returns the domain part of an email address, or an empty
+// string if the address doesn't have one.
+func AddressDomain(address string) string {
+	idx := strings.LastIndexByte(address, '@')
+	if idx < 0 {
+		return ""
+	}
+	return address[idx+1:]
+}
+
+// NormalizeAddress returns the form of an email address used as an identifier.
+func NormalizeAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
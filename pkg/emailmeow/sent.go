@@ -0,0 +1,189 @@
+package emailmeow
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/rs/zerolog"
+)
+
+// sentMailboxNames are tried in order if the server doesn't mark any mailbox
+// with the RFC 6154 \Sent attribute.
+var sentMailboxNames = []string{"Sent", "Sent Items", "Sent Messages", "INBOX.Sent"}
+
+// sentMailbox is a second IMAP connection that idles in the \Sent mailbox,
+// as a connection can only idle in one mailbox. It only receives new
+// messages, so it's opened read-only.
+type sentMailbox struct {
+	name   string
+	client *imapclient.Client
+	done   chan struct{}
+
+	lock         sync.Mutex
+	numMessages  uint32
+	seenMessages uint32
+	wakeup       chan struct{}
+}
+
+// openSentMailbox connects to the \Sent mailbox. Mail sent from other clients
+// isn't essential for bridging, so errors are only logged and nil is returned.
+func (cli *Client) openSentMailbox(address, password string) *sentMailbox {
+	sent := &sentMailbox{
+		done:   make(chan struct{}),
+		wakeup: make(chan struct{}, 1),
+	}
+	options := &imapclient.Options{
+		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+			Expunge: sent.handleExpunge,
+			Mailbox: sent.handleMailbox,
+		},
+	}
+	log := cli.Zlog.With().Str("component", "sent mailbox").Logger()
+	c, err := imapclient.DialTLS(cli.IMAPServer, options)
+	if err != nil {
+		log.Err(err).Msg("Failed to dial IMAP server for sent mailbox")
+		return nil
+	}
+	sent.client = c
+	if err = c.Login(address, password).Wait(); err != nil {
+		log.Err(err).Msg("Failed to log in for sent mailbox")
+		sent.close(log)
+		return nil
+	}
+	sent.name, err = findSentMailbox(c)
+	if err != nil {
+		log.Err(err).Msg("Failed to list mailboxes")
+		sent.close(log)
+		return nil
+	} else if sent.name == "" {
+		log.Info().Msg("Server doesn't have a sent mailbox, mail sent from other clients won't be bridged")
+		sent.close(log)
+		return nil
+	}
+	data, err := c.Select(sent.name, &imap.SelectOptions{ReadOnly: true}).Wait()
+	if err != nil {
+		log.Err(err).Str("mailbox", sent.name).Msg("Failed to select sent mailbox")
+		sent.close(log)
+		return nil
+	}
+	sent.numMessages = data.NumMessages
+	sent.seenMessages = data.NumMessages
+	log.Debug().Str("mailbox", sent.name).Msg("Watching sent mailbox")
+	return sent
+}
+
+// findSentMailbox returns the name of the mailbox with the \Sent attribute,
+// falling back to common names. An empty name means there's no such mailbox.
+func findSentMailbox(c *imapclient.Client) (string, error) {
+	var options *imap.ListOptions
+	if c.Caps().Has(imap.CapSpecialUse) && c.Caps().Has(imap.CapListExtended) {
+		options = &imap.ListOptions{ReturnSpecialUse: true}
+	}
+	mailboxes, err := c.List("", "*", options).Collect()
+	if err != nil {
+		return "", err
+	}
+	for _, mbox := range mailboxes {
+		if slices.Contains(mbox.Attrs, imap.MailboxAttrSent) {
+			return mbox.Mailbox, nil
+		}
+	}
+	for _, name := range sentMailboxNames {
+		for _, mbox := range mailboxes {
+			if strings.EqualFold(mbox.Mailbox, name) && !slices.Contains(mbox.Attrs, imap.MailboxAttrNoSelect) {
+				return mbox.Mailbox, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (sent *sentMailbox) signalWakeup() {
+	select {
+	case sent.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (sent *sentMailbox) handleMailbox(evt *imapclient.UnilateralDataMailbox) {
+	if evt.NumMessages == nil {
+		return
+	}
+	sent.lock.Lock()
+	sent.numMessages = *evt.NumMessages
+	hasNew := sent.numMessages > sent.seenMessages
+	sent.lock.Unlock()
+	if hasNew {
+		sent.signalWakeup()
+	}
+}
+
+func (sent *sentMailbox) handleExpunge(seqNum uint32) {
+	sent.lock.Lock()
+	defer sent.lock.Unlock()
+	if sent.numMessages > 0 {
+		sent.numMessages--
+	}
+	if seqNum <= sent.seenMessages {
+		sent.seenMessages--
+	}
+}
+
+func (sent *sentMailbox) close(log zerolog.Logger) {
+	_ = sent.client.Logout().Wait()
+	if err := sent.client.Close(); err != nil {
+		log.Debug().Err(err).Msg("Failed to close sent mailbox connection")
+	}
+}
+
+// sentLoop idles in the \Sent mailbox and passes new messages to the
+// EventHandler with Sent set. If the connection fails, only sent mail stops
+// being received, so the loop exits without a Disconnected event.
+func (cli *Client) sentLoop(ctx context.Context) {
+	sent := cli.sent
+	defer close(sent.done)
+	log := cli.Zlog.With().Str("component", "sent mailbox").Logger()
+	for {
+		idleCmd, err := sent.client.Idle()
+		if err != nil {
+			log.Err(err).Msg("IDLE command failed, no longer watching sent mailbox")
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-sent.wakeup:
+		}
+		if err = idleCmd.Close(); err == nil {
+			err = idleCmd.Wait()
+		}
+		if err != nil {
+			log.Err(err).Msg("Failed to stop idling, no longer watching sent mailbox")
+			return
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		sent.lock.Lock()
+		from, to := sent.seenMessages+1, sent.numMessages
+		sent.seenMessages = sent.numMessages
+		sent.lock.Unlock()
+		if from > to {
+			continue
+		}
+		var seqSet imap.SeqSet
+		seqSet.AddRange(from, to)
+		msgs, err := sent.client.Fetch(seqSet, newMessageFetchOptions).Collect()
+		if err != nil {
+			log.Err(err).Stringer("seq_set", seqSet).Msg("Failed to fetch new sent messages")
+			continue
+		}
+		for _, msg := range cli.parseFetchedMessages(msgs) {
+			msg.Sent = true
+			cli.dispatch(msg)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package emailmeow
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// newListServer connects a client to an IMAP stand-in that answers LIST
+// commands with the given untagged responses.
+func newListServer(t *testing.T, caps string, list []string) *imapclient.Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		r := bufio.NewReader(serverConn)
+		fmt.Fprintf(serverConn, "* OK [CAPABILITY %s] ready\r\n", strings.TrimSpace("IMAP4rev1 "+caps))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			tag, cmd, _ := strings.Cut(strings.TrimSpace(line), " ")
+			switch {
+			case strings.HasPrefix(cmd, "LIST "):
+				if strings.Contains(cmd, "SPECIAL-USE") != strings.Contains(caps, "SPECIAL-USE") {
+					t.Errorf("unexpected LIST command %q", cmd)
+				}
+				for _, resp := range list {
+					fmt.Fprintf(serverConn, "* LIST %s\r\n", resp)
+				}
+				fmt.Fprintf(serverConn, "%s OK LIST completed\r\n", tag)
+			case cmd == "LOGOUT":
+				fmt.Fprintf(serverConn, "* BYE\r\n%s OK LOGOUT completed\r\n", tag)
+				return
+			default:
+				fmt.Fprintf(serverConn, "%s BAD unexpected command\r\n", tag)
+			}
+		}
+	}()
+	c := imapclient.New(clientConn, nil)
+	t.Cleanup(func() {
+		_ = c.Logout().Wait()
+		_ = c.Close()
+	})
+	return c
+}
+
+func TestFindSentMailbox(t *testing.T) {
+	tests := []struct {
+		name string
+		caps string
+		list []string
+		want string
+	}{
+		{"special use", "SPECIAL-USE LIST-EXTENDED", []string{
+			`() "/" INBOX`,
+			`() "/" Sent`,
+			`(\Sent) "/" "Gesendete Objekte"`,
+		}, "Gesendete Objekte"},
+		{"common name", "", []string{
+			`() "/" INBOX`,
+			`() "/" "Sent Items"`,
+		}, "Sent Items"},
+		{"name case", "", []string{
+			`() "." INBOX`,
+			`() "." INBOX.sent`,
+		}, "INBOX.sent"},
+		{"not selectable", "", []string{
+			`() "/" INBOX`,
+			`(\Noselect \HasChildren) "/" Sent`,
+		}, ""},
+		{"no sent mailbox", "", []string{
+			`() "/" INBOX`,
+			`() "/" Archive`,
+		}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newListServer(t, test.caps, test.list)
+			got, err := findSentMailbox(c)
+			if err != nil {
+				t.Fatalf("failed to find sent mailbox: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package emailmeow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const oneClickUnsubscribe = "List-Unsubscribe=One-Click"
+
+var (
+	ErrNoUnsubscribeMethod = errors.New("message doesn't have a usable List-Unsubscribe header")
+	// ErrManualUnsubscribe is returned when the only unsubscription method is
+	// a web page that has to be opened by the user.
+	ErrManualUnsubscribe = errors.New("unsubscribing requires opening a web page")
+)
+
+func (cli *Client) httpClient() *http.Client {
+	if cli.HTTPClient != nil {
+		return cli.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Unsubscribe unsubscribes from a mailing list or newsletter using the values
+// of the List-Unsubscribe and List-Unsubscribe-Post headers of a message.
+//
+// RFC 8058 one-click unsubscription is preferred, with mailto: URLs sent
+// through the account's SMTP server as a fallback. The returned URL is the
+// one that was used. If ErrManualUnsubscribe is returned, the URL is the page
+// the user should open instead.
+func (cli *Client) Unsubscribe(ctx context.Context, listUnsubscribe, listUnsubscribePost string) (*url.URL, error) {
+	var mailtoURL, webURL *url.URL
+	for _, rawURL := range parseHeaderURLs(listUnsubscribe) {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(parsed.Scheme) {
+		case "mailto":
+			if mailtoURL == nil {
+				mailtoURL = parsed
+			}
+		case "https", "http":
+			if webURL == nil {
+				webURL = parsed
+			}
+		}
+	}
+	isOneClick := strings.EqualFold(strings.TrimSpace(listUnsubscribePost), oneClickUnsubscribe)
+	switch {
+	case webURL != nil && webURL.Scheme == "https" && isOneClick:
+		return webURL, cli.unsubscribeOneClick(ctx, webURL)
+	case mailtoURL != nil:
+		return mailtoURL, cli.unsubscribeMailto(ctx, mailtoURL)
+	case webURL != nil:
+		return webURL, ErrManualUnsubscribe
+	default:
+		return nil, ErrNoUnsubscribeMethod
+	}
+}
+
+func (cli *Client) unsubscribeOneClick(ctx context.Context, target *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), strings.NewReader(oneClickUnsubscribe))
+	if err != nil {
+		return fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := cli.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (cli *Client) unsubscribeMailto(ctx context.Context, target *url.URL) error {
+	address := mailtoAddress(target.String())
+	if address == "" {
+		return fmt.Errorf("invalid mailto URL")
+	}
+	query := target.Query()
+	subject := query.Get("subject")
+	if subject == "" {
+		subject = "unsubscribe"
+	}
+	_, err := cli.SendMessage(ctx, &OutgoingMessage{
+		To:      []string{address},
+		Subject: subject,
+		Text:    query.Get("body"),
+	})
+	return err
+}
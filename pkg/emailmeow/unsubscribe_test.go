@@ -0,0 +1,116 @@
+package emailmeow
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newUnsubscribeServer starts an HTTPS server that accepts RFC 8058 one-click
+// unsubscription requests. The returned counter is incremented for every
+// request.
+func newUnsubscribeServer(t *testing.T, status int) (*httptest.Server, *int) {
+	t.Helper()
+	var requests int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST request, got %s", r.Method)
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/x-www-form-urlencoded" {
+			t.Errorf("unexpected content type %q", contentType)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "List-Unsubscribe=One-Click" {
+			t.Errorf("unexpected body %q", body)
+		}
+		if r.URL.Path != "/unsubscribe" || r.URL.Query().Get("id") != "123" {
+			t.Errorf("unexpected URL %s", r.URL)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestUnsubscribeOneClick(t *testing.T) {
+	srv, requests := newUnsubscribeServer(t, http.StatusOK)
+	cli := &Client{HTTPClient: srv.Client()}
+	header := "<mailto:unsubscribe@lists.example.com?subject=stop>, <" + srv.URL + "/unsubscribe?id=123>"
+	used, err := cli.Unsubscribe(context.Background(), header, "List-Unsubscribe=One-Click")
+	if err != nil {
+		t.Fatalf("failed to unsubscribe: %v", err)
+	}
+	if used.String() != srv.URL+"/unsubscribe?id=123" {
+		t.Errorf("expected one-click URL to be preferred over mailto, used %s", used)
+	}
+	if *requests != 1 {
+		t.Errorf("expected 1 request, got %d", *requests)
+	}
+}
+
+func TestUnsubscribeOneClickFailed(t *testing.T) {
+	srv, requests := newUnsubscribeServer(t, http.StatusInternalServerError)
+	cli := &Client{HTTPClient: srv.Client()}
+	_, err := cli.Unsubscribe(context.Background(), "<"+srv.URL+"/unsubscribe?id=123>", "List-Unsubscribe=One-Click")
+	if err == nil {
+		t.Error("expected error for HTTP 500 response")
+	}
+	if *requests != 1 {
+		t.Errorf("expected 1 request, got %d", *requests)
+	}
+}
+
+func TestUnsubscribeManual(t *testing.T) {
+	srv, requests := newUnsubscribeServer(t, http.StatusOK)
+	cli := &Client{HTTPClient: srv.Client()}
+	tests := []struct {
+		name   string
+		header string
+		post   string
+	}{
+		{"without List-Unsubscribe-Post", "<" + srv.URL + "/unsubscribe?id=123>", ""},
+		{"plain HTTP", "<http://lists.example.com/unsubscribe?id=123>", "List-Unsubscribe=One-Click"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			used, err := cli.Unsubscribe(context.Background(), test.header, test.post)
+			if !errors.Is(err, ErrManualUnsubscribe) {
+				t.Errorf("expected manual unsubscription, got %v", err)
+			}
+			if used == nil || "<"+used.String()+">" != test.header {
+				t.Errorf("expected the page URL to be returned, got %v", used)
+			}
+		})
+	}
+	if *requests != 0 {
+		t.Errorf("expected no requests, got %d", *requests)
+	}
+}
+
+func TestUnsubscribeMailtoFallback(t *testing.T) {
+	srv, requests := newUnsubscribeServer(t, http.StatusOK)
+	cli := &Client{HTTPClient: srv.Client()}
+	header := "<" + srv.URL + "/unsubscribe?id=123>, <mailto:unsubscribe@lists.example.com>"
+	// There's no SMTP server, so sending fails, but the mailto: URL must be
+	// chosen over a web page that isn't one-click.
+	used, _ := cli.Unsubscribe(context.Background(), header, "")
+	if used == nil || used.Scheme != "mailto" {
+		t.Errorf("expected mailto: URL to be used, got %v", used)
+	}
+	if *requests != 0 {
+		t.Errorf("expected no requests, got %d", *requests)
+	}
+}
+
+func TestUnsubscribeNoMethod(t *testing.T) {
+	cli := &Client{}
+	for _, header := range []string{"", "<ftp://lists.example.com/unsubscribe>", "unsubscribe@lists.example.com"} {
+		if _, err := cli.Unsubscribe(context.Background(), header, ""); !errors.Is(err, ErrNoUnsubscribeMethod) {
+			t.Errorf("%q: expected no unsubscription method, got %v", header, err)
+		}
+	}
+}
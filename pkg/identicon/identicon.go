@@ -0,0 +1,90 @@
+// Package identicon generates deterministic avatars for email addresses.
+//
+// The avatar is a horizontally symmetric 5x5 grid of blocks drawn in a colour
+// derived from a hash of the input, similar to the default avatars of many
+// code hosting sites.
+package identicon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+)
+
+const (
+	gridSize  = 5
+	blockSize = 50
+	padding   = 25
+	imageSize = gridSize*blockSize + 2*padding
+)
+
+var background = color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+// Generate returns a PNG image unique to the given seed.
+func Generate(seed string) []byte {
+	hash := sha256.Sum256([]byte(seed))
+
+	img := image.NewRGBA(image.Rect(0, 0, imageSize, imageSize))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
+	fg := &image.Uniform{C: hslToRGB(float64(hash[0])/255*360, 0.55, 0.5)}
+
+	// Only the left half and the middle column come from the hash, the right
+	// half mirrors the left.
+	const halfWidth = (gridSize + 1) / 2
+	for y := 0; y < gridSize; y++ {
+		for x := 0; x < halfWidth; x++ {
+			if hash[1+y*halfWidth+x]&1 == 0 {
+				continue
+			}
+			for _, col := range []int{x, gridSize - 1 - x} {
+				block := image.Rect(
+					padding+col*blockSize, padding+y*blockSize,
+					padding+(col+1)*blockSize, padding+(y+1)*blockSize,
+				)
+				draw.Draw(img, block, fg, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	// Encoding into a bytes.Buffer can't fail
+	_ = png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func hslToRGB(h, s, l float64) color.RGBA {
+	hueToRGB := func(p, q, t float64) float64 {
+		if t < 0 {
+			t++
+		} else if t > 1 {
+			t--
+		}
+		switch {
+		case t < 1.0/6:
+			return p + (q-p)*6*t
+		case t < 1.0/2:
+			return q
+		case t < 2.0/3:
+			return p + (q-p)*(2.0/3-t)*6
+		default:
+			return p
+		}
+	}
+	var q float64
+	if l < 0.5 {
+		q = l * (1 + s)
+	} else {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	h /= 360
+	return color.RGBA{
+		R: uint8(hueToRGB(p, q, h+1.0/3) * 255),
+		G: uint8(hueToRGB(p, q, h) * 255),
+		B: uint8(hueToRGB(p, q, h-1.0/3) * 255),
+		A: 0xff,
+	}
+}
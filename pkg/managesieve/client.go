@@ -0,0 +1,209 @@
+// Package managesieve is a ManageSieve (RFC 5804) client for managing the
+// Sieve filter scripts of a mail account.
+package managesieve
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DefaultPort is the registered port for ManageSieve.
+const DefaultPort = "4190"
+
+var (
+	ErrTLSNotSupported   = errors.New("server doesn't support STARTTLS")
+	ErrPlainNotSupported = errors.New("server doesn't support PLAIN authentication")
+)
+
+// Script is an entry in the script list of the account.
+type Script struct {
+	Name   string
+	Active bool
+}
+
+// Client is a connection to a ManageSieve server. Methods can be called from
+// multiple goroutines, but commands are sent one at a time.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	lock sync.Mutex
+
+	// Capabilities are the capabilities advertised by the server, e.g.
+	// SASL -> "PLAIN LOGIN". Capabilities without a value map to "".
+	Capabilities map[string]string
+}
+
+// NewClient wraps an existing connection and reads the server greeting.
+func NewClient(conn net.Conn) (*Client, error) {
+	c := &Client{conn: conn, r: bufio.NewReader(conn)}
+	err := c.readCapabilities()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read greeting: %w", err)
+	}
+	return c, nil
+}
+
+// Dial connects to a ManageSieve server. If tlsConfig is set, the connection
+// is upgraded with STARTTLS, failing if the server doesn't support it.
+func Dial(ctx context.Context, addr string, tlsConfig *tls.Config) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, err := NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if tlsConfig != nil {
+		err = c.StartTLS(tlsConfig)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Client) readCapabilities() error {
+	lines, resp, err := readResponse(c.r)
+	if err != nil {
+		return err
+	} else if err = resp.err(); err != nil {
+		return err
+	}
+	c.Capabilities = make(map[string]string, len(lines))
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var value string
+		if len(line) > 1 {
+			value = line[1].value
+		}
+		c.Capabilities[strings.ToUpper(line[0].value)] = value
+	}
+	return nil
+}
+
+// execute sends a command and reads the response. It returns the data lines
+// of a successful response.
+func (c *Client) execute(command string) ([][]token, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err := c.conn.Write([]byte(command + "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	lines, resp, err := readResponse(c.r)
+	if err != nil {
+		return nil, err
+	}
+	return lines, resp.err()
+}
+
+// StartTLS upgrades the connection to TLS.
+func (c *Client) StartTLS(tlsConfig *tls.Config) error {
+	if _, ok := c.Capabilities["STARTTLS"]; !ok {
+		return ErrTLSNotSupported
+	}
+	_, err := c.execute("STARTTLS")
+	if err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	c.conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	// The server sends its capabilities again after the handshake
+	return c.readCapabilities()
+}
+
+// Authenticate logs in using the PLAIN SASL mechanism.
+func (c *Client) Authenticate(username, password string) error {
+	if !strings.Contains(" "+strings.ToUpper(c.Capabilities["SASL"])+" ", " PLAIN ") {
+		return ErrPlainNotSupported
+	}
+	initialResponse := base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+	_, err := c.execute(`AUTHENTICATE "PLAIN" ` + quoteString(initialResponse))
+	return err
+}
+
+// ListScripts returns all scripts of the account.
+func (c *Client) ListScripts() ([]Script, error) {
+	lines, err := c.execute("LISTSCRIPTS")
+	if err != nil {
+		return nil, err
+	}
+	scripts := make([]Script, 0, len(lines))
+	for _, line := range lines {
+		if len(line) == 0 || line[0].atom {
+			continue
+		}
+		scripts = append(scripts, Script{
+			Name:   line[0].value,
+			Active: len(line) > 1 && line[1].atom && strings.EqualFold(line[1].value, "ACTIVE"),
+		})
+	}
+	return scripts, nil
+}
+
+// GetScript returns the content of a script.
+func (c *Client) GetScript(name string) (string, error) {
+	lines, err := c.execute("GETSCRIPT " + quoteString(name))
+	if err != nil {
+		return "", err
+	} else if len(lines) == 0 || len(lines[0]) == 0 {
+		return "", fmt.Errorf("%w: missing script content", ErrMalformedResponse)
+	}
+	return lines[0][0].value, nil
+}
+
+// CheckScript asks the server to validate a script without storing it.
+func (c *Client) CheckScript(content string) error {
+	_, err := c.execute("CHECKSCRIPT " + literalString(content))
+	return err
+}
+
+// PutScript uploads a script, replacing any existing script with the same
+// name. Syntax errors are returned as a *ResponseError.
+func (c *Client) PutScript(name, content string) error {
+	_, err := c.execute("PUTSCRIPT " + quoteString(name) + " " + literalString(content))
+	return err
+}
+
+// SetActive activates the given script. An empty name deactivates all scripts.
+func (c *Client) SetActive(name string) error {
+	_, err := c.execute("SETACTIVE " + quoteString(name))
+	return err
+}
+
+// DeleteScript deletes a script. The active script can't be deleted.
+func (c *Client) DeleteScript(name string) error {
+	_, err := c.execute("DELETESCRIPT " + quoteString(name))
+	return err
+}
+
+// Logout ends the session and closes the connection.
+func (c *Client) Logout() error {
+	_, err := c.execute("LOGOUT")
+	closeErr := c.conn.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
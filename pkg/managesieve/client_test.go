@@ -0,0 +1,234 @@
+package managesieve
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const greeting = "\"IMPLEMENTATION\" \"Stand-in\"\r\n" +
+	"\"SIEVE\" \"fileinto vacation\"\r\n" +
+	"\"STARTTLS\"\r\n" +
+	"OK \"ready\"\r\n"
+
+const tlsGreeting = "\"IMPLEMENTATION\" \"Stand-in\"\r\n" +
+	"\"SASL\" \"PLAIN LOGIN\"\r\n" +
+	"\"SIEVE\" \"fileinto vacation\"\r\n" +
+	"OK \"TLS negotiated\"\r\n"
+
+// standIn is the server side of a scripted ManageSieve session.
+type standIn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (s *standIn) send(data string) {
+	if _, err := io.WriteString(s.conn, data); err != nil {
+		s.t.Errorf("stand-in failed to send: %v", err)
+	}
+}
+
+// expect reads a command line. Non-synchronizing literals are read too and
+// appended to the line.
+func (s *standIn) expect(want string) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		s.t.Errorf("stand-in failed to read command: %v", err)
+		return
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if start := strings.LastIndexByte(line, '{'); start >= 0 && strings.HasSuffix(line, "+}") {
+		size, _ := strconv.Atoi(line[start+1 : len(line)-2])
+		literal := make([]byte, size)
+		if _, err = io.ReadFull(s.r, literal); err != nil {
+			s.t.Errorf("stand-in failed to read literal: %v", err)
+			return
+		}
+		line += "\r\n" + string(literal)
+		if rest, _ := s.r.ReadString('\n'); rest != "\r\n" {
+			s.t.Errorf("unexpected data after literal: %q", rest)
+		}
+	}
+	if line != want {
+		s.t.Errorf("expected command %q, got %q", want, line)
+	}
+}
+
+// drain reads until the client closes the connection, as net.Pipe doesn't
+// buffer the TLS close_notify sent when logging out.
+func (s *standIn) drain() {
+	_, _ = io.Copy(io.Discard, s.r)
+}
+
+func (s *standIn) startTLS(config *tls.Config) {
+	tlsConn := tls.Server(s.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		s.t.Errorf("stand-in TLS handshake failed: %v", err)
+		return
+	}
+	s.conn = tlsConn
+	s.r = bufio.NewReader(tlsConn)
+}
+
+// runStandIn connects a client to a stand-in server running the given
+// session. The returned channel is closed when the session ends.
+func runStandIn(t *testing.T, session func(s *standIn)) (net.Conn, <-chan struct{}) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer serverConn.Close()
+		session(&standIn{t: t, conn: serverConn, r: bufio.NewReader(serverConn)})
+	}()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		<-done
+	})
+	return clientConn, done
+}
+
+// testCertificate creates a self-signed certificate for the stand-in.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sieve.example.com"},
+		DNSNames:     []string{"sieve.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestSession(t *testing.T) {
+	cert, roots := testCertificate(t)
+	const badScript = "require \"fileinto\";\r\nfileinot \"Junk\";\r\n"
+	const syntaxError = "line 2: error: unknown command 'fileinot'.\r\n"
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00alice@example.com\x00secret"))
+	conn, done := runStandIn(t, func(s *standIn) {
+		s.send(greeting)
+		s.expect("STARTTLS")
+		s.send("OK \"Begin TLS negotiation now\"\r\n")
+		s.startTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+		s.send(tlsGreeting)
+		s.expect(`AUTHENTICATE "PLAIN" "` + auth + `"`)
+		s.send("OK \"Logged in\"\r\n")
+		s.expect("PUTSCRIPT \"bridge\" {" + strconv.Itoa(len(badScript)) + "+}\r\n" + badScript)
+		s.send("NO {" + strconv.Itoa(len(syntaxError)) + "}\r\n" + syntaxError + "\r\n")
+		s.expect("LISTSCRIPTS")
+		s.send("\"main\"\r\n\"vacation\" ACTIVE\r\nOK \"Listscripts completed\"\r\n")
+		s.expect("GETSCRIPT \"vacation\"")
+		s.send("{9}\r\nkeep;\r\n\r\n\r\nOK \"Getscript completed\"\r\n")
+		s.expect("LOGOUT")
+		s.send("OK \"Logout completed\"\r\n")
+		s.drain()
+	})
+
+	client, err := NewClient(conn)
+	if err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	}
+	if err = client.Authenticate("alice@example.com", "secret"); !errors.Is(err, ErrPlainNotSupported) {
+		t.Errorf("expected PLAIN to be unavailable before STARTTLS, got %v", err)
+	}
+	err = client.StartTLS(&tls.Config{ServerName: "sieve.example.com", RootCAs: roots})
+	if err != nil {
+		t.Fatalf("failed to start TLS: %v", err)
+	}
+	if client.Capabilities["SASL"] != "PLAIN LOGIN" {
+		t.Errorf("capabilities weren't updated after STARTTLS: %v", client.Capabilities)
+	}
+	if err = client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+
+	err = client.PutScript("bridge", badScript)
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		t.Fatalf("expected response error for invalid script, got %v", err)
+	} else if respErr.Status != "NO" || respErr.Message != syntaxError {
+		t.Errorf("unexpected response error %+v", respErr)
+	}
+
+	scripts, err := client.ListScripts()
+	if err != nil {
+		t.Fatalf("failed to list scripts: %v", err)
+	}
+	if len(scripts) != 2 || scripts[0] != (Script{Name: "main"}) || scripts[1] != (Script{Name: "vacation", Active: true}) {
+		t.Errorf("unexpected scripts %+v", scripts)
+	}
+	script, err := client.GetScript("vacation")
+	if err != nil {
+		t.Fatalf("failed to get script: %v", err)
+	} else if script != "keep;\r\n\r\n" {
+		t.Errorf("unexpected script %q", script)
+	}
+
+	if err = client.Logout(); err != nil {
+		t.Errorf("failed to log out: %v", err)
+	}
+	<-done
+}
+
+func TestStartTLSNotSupported(t *testing.T) {
+	conn, _ := runStandIn(t, func(s *standIn) {
+		s.send("\"SASL\" \"PLAIN\"\r\nOK\r\n")
+	})
+	client, err := NewClient(conn)
+	if err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	}
+	if err = client.StartTLS(&tls.Config{}); !errors.Is(err, ErrTLSNotSupported) {
+		t.Errorf("expected STARTTLS to be unsupported, got %v", err)
+	}
+}
+
+func TestAuthenticationFailed(t *testing.T) {
+	conn, _ := runStandIn(t, func(s *standIn) {
+		s.send("\"SASL\" \"PLAIN\"\r\nOK\r\n")
+		s.expect(`AUTHENTICATE "PLAIN" "` + base64.StdEncoding.EncodeToString([]byte("\x00alice\x00wrong")) + `"`)
+		s.send("NO (AUTH-TOO-WEAK) \"Authentication failed\"\r\n")
+	})
+	client, err := NewClient(conn)
+	if err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	}
+	err = client.Authenticate("alice", "wrong")
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		t.Fatalf("expected response error, got %v", err)
+	} else if respErr.Code != "AUTH-TOO-WEAK" || respErr.Message != "Authentication failed" {
+		t.Errorf("unexpected response error %+v", respErr)
+	}
+}
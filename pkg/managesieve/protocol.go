@@ -0,0 +1,209 @@
+package managesieve
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxLiteralSize is the largest string literal accepted from the server.
+const maxLiteralSize = 1024 * 1024
+
+var ErrMalformedResponse = errors.New("malformed response from server")
+
+// ResponseError is a NO or BYE response from the server. For PUTSCRIPT and
+// CHECKSCRIPT, the message contains the syntax errors of the script.
+type ResponseError struct {
+	Status  string
+	Code    string
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("server responded with ")
+	sb.WriteString(e.Status)
+	if e.Code != "" {
+		sb.WriteString(" (")
+		sb.WriteString(e.Code)
+		sb.WriteString(")")
+	}
+	if e.Message != "" {
+		sb.WriteString(": ")
+		sb.WriteString(e.Message)
+	}
+	return sb.String()
+}
+
+type token struct {
+	value string
+	// atom is true for bare words like OK or ACTIVE, false for quoted strings and literals.
+	atom bool
+}
+
+type response struct {
+	status  string
+	code    string
+	message string
+}
+
+func (resp *response) err() error {
+	if resp.status == "OK" {
+		return nil
+	}
+	return &ResponseError{Status: resp.status, Code: resp.code, Message: resp.message}
+}
+
+func readQuoted(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			b, err = r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+		case '\r', '\n':
+			return "", fmt.Errorf("%w: newline in quoted string", ErrMalformedResponse)
+		}
+		sb.WriteByte(b)
+	}
+}
+
+func readLiteral(r *bufio.Reader) (string, error) {
+	header, err := r.ReadString('}')
+	if err != nil {
+		return "", err
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(header, "}"), "+"))
+	if err != nil || size < 0 || size > maxLiteralSize {
+		return "", fmt.Errorf("%w: invalid literal size {%s", ErrMalformedResponse, header)
+	}
+	if line, err := r.ReadString('\n'); err != nil {
+		return "", err
+	} else if strings.TrimRight(line, "\r\n") != "" {
+		return "", fmt.Errorf("%w: unexpected data after literal size", ErrMalformedResponse)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// readResponseCode reads a parenthesized response code like (WARNINGS) or
+// (SASL "..."), without the parentheses.
+func readResponseCode(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	inQuotes := false
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case b == '"':
+			inQuotes = !inQuotes
+		case b == ')' && !inQuotes:
+			return sb.String(), nil
+		case b == '\r' || b == '\n':
+			return "", fmt.Errorf("%w: newline in response code", ErrMalformedResponse)
+		}
+		sb.WriteByte(b)
+	}
+}
+
+// readLine reads the tokens of a single response line. Literals may span
+// multiple physical lines.
+func readLine(r *bufio.Reader) ([]token, error) {
+	var tokens []token
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case '\n':
+			return tokens, nil
+		case '\r', ' ':
+		case '"':
+			value, err := readQuoted(r)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{value: value})
+		case '{':
+			value, err := readLiteral(r)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{value: value})
+		case '(':
+			code, err := readResponseCode(r)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{value: "(" + code + ")", atom: true})
+		default:
+			var sb strings.Builder
+			sb.WriteByte(b)
+			for {
+				next, err := r.Peek(1)
+				if err != nil {
+					return nil, err
+				} else if next[0] == ' ' || next[0] == '\r' || next[0] == '\n' {
+					break
+				}
+				_, _ = r.ReadByte()
+				sb.WriteByte(next[0])
+			}
+			tokens = append(tokens, token{value: sb.String(), atom: true})
+		}
+	}
+}
+
+// readResponse reads data lines until the final OK, NO or BYE response.
+func readResponse(r *bufio.Reader) (lines [][]token, resp *response, err error) {
+	for {
+		tokens, err := readLine(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(tokens) > 0 && tokens[0].atom {
+			status := strings.ToUpper(tokens[0].value)
+			if status == "OK" || status == "NO" || status == "BYE" {
+				resp = &response{status: status}
+				rest := tokens[1:]
+				if len(rest) > 0 && rest[0].atom && strings.HasPrefix(rest[0].value, "(") {
+					resp.code = strings.Trim(rest[0].value, "()")
+					rest = rest[1:]
+				}
+				if len(rest) > 0 {
+					resp.message = rest[0].value
+				}
+				return lines, resp, nil
+			}
+		}
+		lines = append(lines, tokens)
+	}
+}
+
+func quoteString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// literalString formats s as a non-synchronizing literal, which can contain
+// any characters including newlines.
+func literalString(s string) string {
+	return "{" + strconv.Itoa(len(s)) + "+}\r\n" + s
+}
@@ -0,0 +1,120 @@
+package managesieve
+
+import (
+	"bufio"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []token
+	}{{
+		name:  "atoms",
+		input: "OK\r\n",
+		want:  []token{{value: "OK", atom: true}},
+	}, {
+		name:  "quoted strings",
+		input: "\"SIEVE\" \"fileinto \\\"vacation\\\" a\\\\b\"\r\n",
+		want:  []token{{value: "SIEVE"}, {value: `fileinto "vacation" a\b`}},
+	}, {
+		name:  "script list",
+		input: "\"main\" ACTIVE\r\n",
+		want:  []token{{value: "main"}, {value: "ACTIVE", atom: true}},
+	}, {
+		name:  "literal",
+		input: "{12}\r\nline 1\r\nl2\r\n\r\n",
+		want:  []token{{value: "line 1\r\nl2\r\n"}},
+	}, {
+		name:  "non-synchronizing literal",
+		input: "{3+}\r\nabc\r\n",
+		want:  []token{{value: "abc"}},
+	}, {
+		name:  "response code",
+		input: "NO (QUOTA/MAXSIZE \"too (big)\") \"Quota exceeded\"\r\n",
+		want:  []token{{value: "NO", atom: true}, {value: `(QUOTA/MAXSIZE "too (big)")`, atom: true}, {value: "Quota exceeded"}},
+	}, {
+		name:  "bare LF",
+		input: "OK \"done\"\n",
+		want:  []token{{value: "OK", atom: true}, {value: "done"}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readLine(bufio.NewReader(strings.NewReader(test.input)))
+			if err != nil {
+				t.Fatalf("failed to read line: %v", err)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("expected %d tokens, got %+v", len(test.want), got)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("token %d: expected %+v, got %+v", i, test.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadLineMalformed(t *testing.T) {
+	for _, input := range []string{
+		"\"unterminated\r\n",
+		"{abc}\r\nabc\r\n",
+		"{-1}\r\n\r\n",
+		"{3} junk\r\nabc\r\n",
+		"NO (CODE\r\n",
+	} {
+		_, err := readLine(bufio.NewReader(strings.NewReader(input)))
+		if !errors.Is(err, ErrMalformedResponse) {
+			t.Errorf("%q: expected malformed response error, got %v", input, err)
+		}
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	input := "\"IMPLEMENTATION\" \"Test\"\r\n" +
+		"\"SASL\" \"PLAIN\"\r\n" +
+		"OK (WARNINGS) \"Script has warnings\"\r\n"
+	lines, resp, err := readResponse(bufio.NewReader(strings.NewReader(input)))
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if len(lines) != 2 || lines[1][0].value != "SASL" {
+		t.Errorf("unexpected data lines %+v", lines)
+	}
+	if resp.status != "OK" || resp.code != "WARNINGS" || resp.message != "Script has warnings" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if resp.err() != nil {
+		t.Errorf("expected no error for OK response, got %v", resp.err())
+	}
+}
+
+func TestReadResponseNoWithLiteral(t *testing.T) {
+	message := "line 2: error: unknown command 'fileinot'.\r\n"
+	input := "NO {" + strconv.Itoa(len(message)) + "}\r\n" + message + "\r\n"
+	_, resp, err := readResponse(bufio.NewReader(strings.NewReader(input)))
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	var respErr *ResponseError
+	if !errors.As(resp.err(), &respErr) {
+		t.Fatalf("expected response error, got %v", resp.err())
+	}
+	if respErr.Status != "NO" || respErr.Message != message {
+		t.Errorf("unexpected response error %+v", respErr)
+	}
+}
+
+func TestQuoting(t *testing.T) {
+	if got := quoteString(`a "b" \c`); got != `"a \"b\" \\c"` {
+		t.Errorf("unexpected quoted string %s", got)
+	}
+	if got := literalString("a\r\nb"); got != "{4+}\r\na\r\nb" {
+		t.Errorf("unexpected literal %q", got)
+	}
+}
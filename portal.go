@@ -4,12 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/emersion/go-message/mail"
-
 	"github.com/rs/zerolog"
 
 	"maunium.net/go/mautrix"
@@ -17,9 +16,13 @@ import (
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 
+	"imap-bridge/config"
 	"imap-bridge/database"
+	"imap-bridge/pkg/emailmeow"
+	"imap-bridge/pkg/emailmeow/events"
 )
 
 func (br *IMAPBridge) GetPortalByMXID(mxid id.RoomID) *Portal {
@@ -47,8 +50,10 @@ const (
 )
 
 type portalEmailMessage struct {
-	message *mail.Part
+	message *events.Message
 	user    *User
+	// silent messages are bridged as notices, which don't notify by default.
+	silent bool
 }
 
 type portalMatrixMessage struct {
@@ -77,8 +82,22 @@ func (portal *Portal) IsEncrypted() bool {
 }
 
 func (portal *Portal) IsPrivateChat() bool {
-	// FIXME
-	return false
+	return portal.EmailAddress != ""
+}
+
+// listPortalPrefix is prepended to the List-Id of mailing lists to get the
+// thread ID of their portals.
+const listPortalPrefix = "list:"
+
+// IsListPortal returns true if the portal is a group chat for a mailing list.
+func (portal *Portal) IsListPortal() bool {
+	return strings.HasPrefix(portal.ThreadID, listPortalPrefix)
+}
+
+// IsThreadPortal returns true if the portal only contains a single email
+// thread rather than all mail with a contact.
+func (portal *Portal) IsThreadPortal() bool {
+	return portal.IsPrivateChat() && portal.ThreadID != portal.EmailAddress
 }
 
 func (portal *Portal) MainIntent() *appservice.IntentAPI {
@@ -146,8 +165,35 @@ func (portal *Portal) HasRelaybot() bool {
 	return portal.bridge.Config.Bridge.Relay.Enabled && len(portal.RelayUserID) > 0
 }
 
-func (portal *Portal) getBridgeInfo() (string, string) {
-	return "", ""
+func (portal *Portal) getBridgeInfo() (string, event.BridgeEventContent) {
+	bridgeInfo := event.BridgeEventContent{
+		BridgeBot: portal.bridge.Bot.UserID,
+		Creator:   portal.MainIntent().UserID,
+		Protocol: event.BridgeInfoSection{
+			ID:          "email",
+			DisplayName: portal.bridge.ProtocolName,
+			AvatarURL:   portal.bridge.Config.AppService.Bot.ParsedAvatar.CUString(),
+		},
+		Channel: event.BridgeInfoSection{
+			ID:          portal.ThreadID,
+			DisplayName: portal.Subject,
+		},
+	}
+	if user := portal.bridge.GetCachedUserByEmailAddress(portal.Receiver); user != nil {
+		bridgeInfo.Creator = user.MXID
+	}
+	if domain := emailmeow.AddressDomain(portal.Receiver); domain != "" {
+		bridgeInfo.Network = &event.BridgeInfoSection{
+			ID:          domain,
+			DisplayName: domain,
+		}
+	}
+	if portal.IsListPortal() {
+		bridgeInfo.Channel.DisplayName = portal.Name
+	} else if portal.IsPrivateChat() && bridgeInfo.Channel.DisplayName == "" {
+		bridgeInfo.Channel.DisplayName = portal.EmailAddress
+	}
+	return portal.getBridgeInfoStateKey(), bridgeInfo
 }
 
 func (portal *Portal) messageLoop() {
@@ -172,6 +218,10 @@ func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
 	switch msg.evt.Type {
 	case event.EventMessage, event.EventSticker:
 		portal.handleMatrixMessage(ctx, msg.user, msg.evt)
+	case event.StateRoomName:
+		portal.handleMatrixRoomName(ctx, msg.user, msg.evt)
+	case event.EventRedaction:
+		portal.handleMatrixRedaction(ctx, msg.user, msg.evt)
 	default:
 		log.Warn().Str("type", msg.evt.Type.Type).Msg("Unhandled matrix message type")
 	}
@@ -264,6 +314,9 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 		} else if editTargetMsg.Sender != sender.EmailAddress {
 			go ms.sendMessageMetrics(evt, errEditDifferentSender, "Error converting", true)
 			return
+		} else if err = portal.checkEdit(ctx, editTargetMsg); err != nil {
+			go ms.sendMessageMetrics(evt, err, "Error converting", true)
+			return
 		}
 		if content.NewContent != nil {
 			content = content.NewContent
@@ -278,75 +331,359 @@ func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt
 	}
 	ctx = context.WithValue(ctx, msgconvContextKeyClient, sender.Client)
 
+	sendAt := getSendAtHint(evt)
+	outboxMsg, err := portal.queueEmailMessage(ctx, content, sender, evt.ID, editTargetMsg, sendAt)
 	timings.convert = time.Since(start)
+	if err != nil {
+		log.Err(err).Str("content_body", content.Body).Msg("Failed to compose email")
+		go ms.sendMessageMetrics(evt, err, "Error converting", true)
+		return
+	} else if !sendAt.IsZero() {
+		log.Debug().Time("send_at", sendAt).Msg("Scheduled email")
+		portal.bridge.outbox.wake()
+		go ms.sendMessageMetrics(evt, fmt.Errorf("%w for %s", errMessageScheduled, formatSendTime(sendAt)), "Scheduled", true)
+		return
+	} else if delay := sender.GetUndoSendDelay(); delay > 0 {
+		// Leave the email to the outbox loop, so that it can be cancelled
+		// by redacting the message until then.
+		outboxMsg.NextAttempt = time.Now().Add(delay)
+		err = outboxMsg.Update(ctx)
+		if err == nil {
+			portal.bridge.outbox.wake()
+			go ms.sendMessageMetrics(evt, fmt.Errorf("%w: the email will be sent in %s unless the message is redacted", errSendDelayed, delay), "Delaying", true)
+			return
+		}
+		log.Err(err).Msg("Failed to delay email, sending immediately")
+	}
 	start = time.Now()
 
-	err := portal.sendEmailMessage(ctx, content.Body, sender, evt.ID)
+	err = portal.submitOutboxMessage(ctx, sender, outboxMsg)
 	if err != nil {
-		log.Err(err).Str("content_body", content.Body).Msg("Failed to send email")
+		log.Err(err).Msg("Failed to send email")
 	}
 
 	timings.totalSend = time.Since(start)
-	go ms.sendMessageMetrics(evt, err, "Error sending", true)
+	retrying := errors.Is(err, errSendRetrying)
+	// The handling deadline is cancelled when this function returns, but the
+	// error notice must still be saved afterwards.
+	noticeCtx := context.WithoutCancel(ctx)
+	go func() {
+		ms.sendMessageMetrics(evt, err, "Error sending", !retrying)
+		if retrying {
+			portal.bridge.outbox.saveErrorNotice(noticeCtx, outboxMsg, ms.getNoticeID())
+		}
+	}()
+}
 
-	var timeStamp time.Time
-	timeStamp = time.Now()
+func (portal *Portal) HandleMatrixMeta(brSender bridge.User, evt *event.Event) {
+	portal.matrixMessages <- portalMatrixMessage{user: brSender.(*User), evt: evt}
+}
 
-	if editTargetMsg != nil {
-		err = editTargetMsg.SetTimestamp(ctx, uint64(timeStamp.Unix()))
+func (portal *Portal) handleMatrixRoomName(ctx context.Context, sender *User, evt *event.Event) {
+	content, ok := evt.Content.Parsed.(*event.RoomNameEventContent)
+	if !ok || content.Name == "" || content.Name == portal.Name {
+		return
+	}
+	portal.Name = content.Name
+	portal.NameSet = true
+	portal.Subject = threadSubject(content.Name)
+	err := portal.Update(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal after room name change")
+		return
+	}
+	zerolog.Ctx(ctx).Debug().
+		Stringer("sender", sender.MXID).
+		Str("subject", portal.Subject).
+		Msg("Room renamed, changed subject for the next email")
+}
+
+var replyPrefixRegex = regexp.MustCompile(`(?i)^\s*((re|aw|sv|antw)(\[\d+])?:\s*)+`)
+
+// threadSubject strips reply prefixes from an email subject.
+func threadSubject(subject string) string {
+	return replyPrefixRegex.ReplaceAllString(subject, "")
+}
+
+func replySubject(subject string) string {
+	if subject == "" {
+		return ""
+	}
+	return "Re: " + subject
+}
+
+func (portal *Portal) updateName(ctx context.Context, name string) bool {
+	if portal.Name == name && (portal.NameSet || portal.MXID == "") {
+		return false
+	}
+	portal.Name = name
+	portal.NameSet = false
+	if portal.MXID != "" {
+		_, err := portal.MainIntent().SetRoomName(ctx, portal.MXID, name)
 		if err != nil {
-			log.Err(err).Msg("Failed to update message timestamp in database after editing")
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to update room name")
+		} else {
+			portal.NameSet = true
+		}
+	}
+	return true
+}
+
+func (portal *Portal) updateTopic(ctx context.Context, topic string) bool {
+	if portal.Topic == topic && (portal.TopicSet || portal.MXID == "") {
+		return false
+	}
+	portal.Topic = topic
+	portal.TopicSet = false
+	if portal.MXID != "" {
+		_, err := portal.MainIntent().SetRoomTopic(ctx, portal.MXID, topic)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to update room topic")
+		} else {
+			portal.TopicSet = true
+		}
+	}
+	return true
+}
+
+// updateSubject switches the portal to the thread of an incoming email,
+// using its subject as the room name and topic.
+func (portal *Portal) updateSubject(ctx context.Context, subject string) {
+	subject = threadSubject(subject)
+	if subject == "" || (portal.Subject == subject && !portal.NewThread) {
+		return
+	}
+	portal.Subject = subject
+	portal.NewThread = false
+	portal.updateName(ctx, subject)
+	portal.updateTopic(ctx, subject)
+	portal.UpdateBridgeInfo(ctx)
+	err := portal.Update(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal after updating subject")
+	}
+}
+
+// updateListInfo updates the name and topic of a mailing list portal. The
+// subject is only remembered for replies, as the room represents the list
+// rather than a single thread.
+func (portal *Portal) updateListInfo(ctx context.Context, list *events.ListInfo, subject string) {
+	name := list.Name
+	if name == "" {
+		name = list.ID
+	}
+	var topicParts []string
+	if list.Post != "" {
+		topicParts = append(topicParts, "Post: "+list.Post)
+	}
+	if list.Archive != "" {
+		topicParts = append(topicParts, "Archive: "+list.Archive)
+	}
+	subject = threadSubject(subject)
+	changed := portal.updateName(ctx, name)
+	changed = portal.updateTopic(ctx, strings.Join(topicParts, "\n")) || changed
+	if portal.ListPost != list.Post {
+		portal.ListPost = list.Post
+		changed = true
+	}
+	if subject != "" && portal.Subject != subject {
+		portal.Subject = subject
+		changed = true
+	}
+	if changed {
+		portal.UpdateBridgeInfo(ctx)
+		err := portal.Update(ctx)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal after updating list info")
 		}
-	} else {
-		portal.storeMessageInDB(ctx, evt.ID, sender.EmailAddress, uint64(timeStamp.Unix()), 0)
 	}
 }
 
-// FIXME: delete this
-type DataMessage string
+// updateUnsubscribeInfo remembers the unsubscription headers of the latest
+// message that had them for the unsubscribe command.
+func (portal *Portal) updateUnsubscribeInfo(ctx context.Context, info events.MessageInfo) {
+	if info.ListUnsubscribe == "" ||
+		(portal.ListUnsubscribe == info.ListUnsubscribe && portal.ListUnsubscribePost == info.ListUnsubscribePost) {
+		return
+	}
+	portal.ListUnsubscribe = info.ListUnsubscribe
+	portal.ListUnsubscribePost = info.ListUnsubscribePost
+	err := portal.Update(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal after updating unsubscribe info")
+	}
+}
+
+// archive tags the portal room with the configured archive tag using the
+// user's double puppet.
+func (portal *Portal) archive(ctx context.Context, user *User) error {
+	tag := portal.bridge.Config.Bridge.ArchiveTag
+	if tag == "" || portal.MXID == "" {
+		return nil
+	}
+	doublePuppet := user.GetIDoublePuppet()
+	if doublePuppet == nil {
+		return errNoDoublePuppet
+	}
+	return doublePuppet.CustomIntent().AddTag(ctx, portal.MXID, tag, 0.5)
+}
+
+// startNewThread makes the next email sent in the portal start a new thread
+// with the given subject instead of replying to the previous message.
+func (portal *Portal) startNewThread(ctx context.Context, subject string) error {
+	portal.Subject = subject
+	portal.NewThread = true
+	return portal.Update(ctx)
+}
 
 func (portal *Portal) handleEmailMessage(portalMessage portalEmailMessage) {
-	sender_address := portalMessage.message.Header.Get("From")
+	info := portalMessage.message.Info
 
 	log := portal.log.With().
 		Str("action", "handle email message").
-		Str("email_address", sender_address).
+		Str("email_address", info.Sender).
+		Str("email_message_id", info.MessageID).
 		Logger()
 
 	ctx := log.WithContext(context.Background())
 
-	if portal.MXID == "" {
-		portal.log.Debug().
-			Str("email_address", sender_address).
-			Msg("Creating Matrix room from incoming message")
-		if err := portal.CreateMatrixRoom(ctx, portalMessage.user, sender_address); err != nil {
-			portal.log.Err(err).Msg("Failed to create portal room")
+	if info.MessageID != "" {
+		existing, err := portal.bridge.DB.Message.GetByEmailMessageID(ctx, portal.Receiver, info.MessageID)
+		if err != nil {
+			log.Err(err).Msg("Failed to check if message is already bridged")
+		} else if existing != nil {
+			log.Debug().Stringer("existing_mxid", existing.MXID).Msg("Ignoring already bridged message")
 			return
 		}
 	}
 
-	sender := portal.bridge.GetPuppetByEmailAddress(sender_address)
-
-	// intent := sender.IntentFor(portal)
-
-	body, err := ioutil.ReadAll(portalMessage.message.Body)
-	if err != nil {
-		log.Err(err).Msg("Failed to parse email message")
+	sender := portal.bridge.GetPuppetByEmailAddress(info.Sender)
+	if sender == nil {
+		log.Warn().Msg("Failed to get sender ghost, dropping message")
 		return
 	}
+	sender.UpdateInfo(ctx, headerPuppetInfo(info.SenderName))
+	if portal.IsListPortal() && info.List != nil {
+		portal.updateListInfo(ctx, info.List, info.ThreadName)
+	} else {
+		portal.updateSubject(ctx, info.ThreadName)
+	}
+	portal.updateUnsubscribeInfo(ctx, info)
+
+	if portal.MXID == "" {
+		log.Debug().Msg("Creating Matrix room from incoming message")
+		if err := portal.CreateMatrixRoom(ctx, portalMessage.user, info.Sender); err != nil {
+			log.Err(err).Msg("Failed to create portal room")
+			return
+		}
+	}
+
+	intent := sender.IntentFor(portal)
 
+	quotedTextAction := portalMessage.user.GetQuotedText()
+	splitQuote := quotedTextAction != config.QuotedTextKeep
+	text, quotedText := portalMessage.message.Text, ""
+	if splitQuote {
+		text, quotedText = splitQuotedText(text)
+	}
 	content := &event.MessageEventContent{
 		MsgType: event.MsgText,
-		Body:    string(body),
+		Body:    text,
+	}
+	if portalMessage.silent {
+		content.MsgType = event.MsgNotice
+	}
+	var quotedHTML string
+	if portalMessage.message.HTML != "" {
+		formatted, quoted, err := portal.convertEmailHTML(ctx, intent, portalMessage.message, splitQuote)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to convert email HTML, sending plain text only")
+		} else if formatted != "" {
+			content.Format = event.FormatHTML
+			content.FormattedBody = formatted
+			quotedHTML = quoted
+		}
+		if strings.TrimSpace(content.Body) == "" || (quotedHTML != "" && quotedText == "") {
+			// Always include a plain text version for clients that don't render HTML
+			if content.FormattedBody != "" {
+				content.Body = format.HTMLToText(content.FormattedBody)
+			} else {
+				content.Body = format.HTMLToText(portalMessage.message.HTML)
+			}
+		}
+		if quotedText == "" && quotedHTML != "" {
+			quotedText = format.HTMLToText(quotedHTML)
+		}
+	} else if quotedText != "" {
+		quotedHTML = textToHTML(quotedText)
+	}
+	var extraContent map[string]any
+	if quotedText != "" {
+		extraContent = map[string]any{quotedTextKey: quotedText}
+		if quotedTextAction == config.QuotedTextCollapse && quotedHTML != "" {
+			if content.Format != event.FormatHTML {
+				content.Format = event.FormatHTML
+				content.FormattedBody = textToHTML(content.Body)
+			}
+			content.FormattedBody = collapseQuotedHTML(content.FormattedBody, quotedHTML)
+		}
+	}
+
+	if !portal.IsThreadPortal() {
+		portal.setThreadRelation(ctx, content, info)
 	}
 
-	resp, err := portal.sendMatrixEvent(ctx, portal.MainIntent(), event.EventMessage, content, nil, 0)
+	var ts int64
+	if !info.Timestamp.IsZero() {
+		ts = info.Timestamp.UnixMilli()
+	}
+	resp, err := portal.sendMatrixEvent(ctx, intent, event.EventMessage, content, extraContent, ts)
 	if err != nil {
 		log.Err(err).Msg("Failed to send message to Matrix")
 		return
 	}
 
-	portal.storeMessageInDB(ctx, resp.EventID, sender.EmailAddress, uint64(time.Now().UnixMilli()), 0)
+	bridgedAt := uint64(time.Now().UnixMilli())
+	portal.storeMessageInDB(ctx, resp.EventID, sender.EmailAddress, bridgedAt, 0, emailThreading{
+		MessageID: info.MessageID,
+		ThreadID:  info.ThreadID,
+	})
+	portal.storeReadReceiptRequest(ctx, portalMessage.user, portalMessage.message, resp.EventID, bridgedAt)
+
+	if portalMessage.message.Seen {
+		if doublePuppet := portalMessage.user.GetIDoublePuppet(); doublePuppet != nil {
+			err = doublePuppet.CustomIntent().MarkRead(ctx, portal.MXID, resp.EventID)
+			if err != nil {
+				log.Err(err).Msg("Failed to mark message as read with double puppet")
+			}
+		}
+	}
+}
+
+// setThreadRelation puts replies to an email thread that is already in the
+// room into a Matrix thread under the first bridged message of that thread.
+func (portal *Portal) setThreadRelation(ctx context.Context, content *event.MessageEventContent, info events.MessageInfo) {
+	if info.ThreadID == "" || info.ThreadID == info.MessageID {
+		return
+	}
+	log := zerolog.Ctx(ctx)
+	root, err := portal.bridge.DB.Message.GetFirstInEmailThread(ctx, portal.PortalKey, info.ThreadID)
+	if err != nil {
+		log.Err(err).Str("email_thread_id", info.ThreadID).Msg("Failed to get thread root message")
+		return
+	} else if root == nil {
+		return
+	}
+	last, err := portal.bridge.DB.Message.GetLastInEmailThread(ctx, portal.PortalKey, info.ThreadID)
+	if err != nil {
+		log.Err(err).Str("email_thread_id", info.ThreadID).Msg("Failed to get last message in thread")
+		return
+	}
+	fallback := root.MXID
+	if last != nil {
+		fallback = last.MXID
+	}
+	content.RelatesTo = (&event.RelatesTo{}).SetThread(root.MXID, fallback)
 }
 
 func (portal *Portal) sendMainIntentMessage(ctx context.Context, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
@@ -391,7 +728,7 @@ func (portal *Portal) getEncryptionEventContent() (evt *event.EncryptionEventCon
 }
 
 func (portal *Portal) getBridgeInfoStateKey() string {
-	return fmt.Sprintf("net.maunium.imap-bridge://bridge/%v", portal.ThreadID)
+	return fmt.Sprintf("net.maunium.imap-bridge://email/%s/%s", portal.Receiver, portal.ThreadID)
 }
 
 func (portal *Portal) GetRelayUser() *User {
@@ -426,32 +763,182 @@ func (portal *Portal) addRelaybotFormat(ctx context.Context, userID id.UserID, e
 	return true
 }
 
-func (portal *Portal) sendEmailMessage(ctx context.Context, msg string, sender *User, evtID id.EventID) error {
+// emailThreading contains the email headers used to group bridged messages
+// into threads.
+type emailThreading struct {
+	MessageID string
+	ThreadID  string
+}
+
+// getReplyTarget finds the message an outgoing email should reply to and the
+// ID of the email thread it belongs to. A nil message means that the email
+// starts a new thread. Matrix replies to a bridged email reply to that email.
+func (portal *Portal) getReplyTarget(ctx context.Context, content *event.MessageEventContent) (*database.Message, string, error) {
+	if replyToID := content.RelatesTo.GetNonFallbackReplyTo(); replyToID != "" {
+		replyMsg, err := portal.bridge.DB.Message.GetByMXID(ctx, replyToID)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get replied-to message: %w", err)
+		} else if replyMsg != nil && replyMsg.RoomID == portal.MXID && replyMsg.EmailMessageID != "" {
+			threadID := replyMsg.EmailThreadID
+			if threadID == "" {
+				threadID = replyMsg.EmailMessageID
+			}
+			return replyMsg, threadID, nil
+		}
+	}
+	if threadRoot := content.RelatesTo.GetThreadParent(); threadRoot != "" {
+		rootMsg, err := portal.bridge.DB.Message.GetByMXID(ctx, threadRoot)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get thread root message: %w", err)
+		} else if rootMsg != nil && (rootMsg.EmailThreadID != "" || rootMsg.EmailMessageID != "") {
+			threadID := rootMsg.EmailThreadID
+			if threadID == "" {
+				threadID = rootMsg.EmailMessageID
+			}
+			lastMsg, err := portal.bridge.DB.Message.GetLastInEmailThread(ctx, portal.PortalKey, threadID)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to get last message in thread: %w", err)
+			} else if lastMsg == nil || lastMsg.EmailMessageID == "" {
+				lastMsg = rootMsg
+			}
+			return lastMsg, threadID, nil
+		}
+	}
+	if portal.NewThread {
+		return nil, "", nil
+	}
+	prevMsg, err := portal.bridge.DB.Message.GetLastWithEmailID(ctx, portal.PortalKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get previous message in thread: %w", err)
+	} else if prevMsg == nil {
+		return nil, "", nil
+	}
+	threadID := prevMsg.EmailThreadID
+	if portal.IsThreadPortal() {
+		threadID = portal.ThreadID
+	} else if threadID == "" {
+		threadID = prevMsg.EmailMessageID
+	}
+	return prevMsg, threadID, nil
+}
+
+// queueEmailMessage composes the email for a Matrix message and adds it to
+// the outbox, where it stays until the SMTP server accepts it. Edits are sent
+// as replies to the edited email, and Matrix replies quote the replied-to
+// message. If sendAt is set, the email won't be sent before that time.
+func (portal *Portal) queueEmailMessage(ctx context.Context, content *event.MessageEventContent, sender *User, evtID id.EventID, editTarget *database.Message, sendAt time.Time) (*database.OutboxMessage, error) {
 	log := zerolog.Ctx(ctx).With().
-		Str("action", "send email message").
+		Str("action", "queue email message").
 		Stringer("event_id", evtID).
 		Str("portal_chat_id", portal.ThreadID).
 		Logger()
 	ctx = log.WithContext(ctx)
 
-	log.Debug().Msg("Sending event to Email")
+	log.Debug().Msg("Composing email for event")
 
-	// Check to see if portal.ThreadID is an email address
-	if portal.IsPrivateChat() {
-		err := sender.Client.SendEmail(ctx, portal.EmailAddress, msg)
-		if err != nil {
-			return err
+	recipient := portal.EmailAddress
+	if portal.IsListPortal() {
+		recipient = portal.ListPost
+		if recipient == "" {
+			return nil, errListPostingNotAllowed
 		}
-	} else {
+	} else if !portal.IsPrivateChat() {
 		// FIXME
-		return errors.New("sending to email groups not supported yet")
+		return nil, errors.New("sending to email groups not supported yet")
 	}
 
-	log.Debug().Msg("Email sent successfully")
-	return nil
+	content.RemoveReplyFallback()
+	text := content.Body
+	if isMediaMessage(content) {
+		text = mediaCaption(content)
+	}
+	outgoing := &emailmeow.OutgoingMessage{
+		To:      []string{recipient},
+		Subject: portal.Subject,
+		Text:    text,
+		Date:    sendAt,
+
+		RequestReadReceipt: portal.bridge.Config.Bridge.RequestReadReceipts && !portal.IsListPortal(),
+	}
+	var replyTo *database.Message
+	var threadID string
+	var err error
+	if editTarget != nil && portal.bridge.Config.Bridge.EditMode == config.EditModeCorrection {
+		outgoing.Text = portal.correctionText(ctx, editTarget, text)
+	} else if isMediaMessage(content) {
+		attachment, err := portal.downloadAttachment(ctx, content)
+		if err != nil {
+			return nil, err
+		}
+		outgoing.Attachments = append(outgoing.Attachments, attachment)
+	}
+	if editTarget != nil && editTarget.EmailMessageID != "" {
+		replyTo, threadID = editTarget, editTarget.EmailThreadID
+		if threadID == "" {
+			threadID = editTarget.EmailMessageID
+		}
+	} else if replyTo, threadID, err = portal.getReplyTarget(ctx, content); err != nil {
+		return nil, err
+	}
+	if replyTo != nil {
+		outgoing.Subject = replySubject(portal.Subject)
+		outgoing.InReplyTo = replyTo.EmailMessageID
+		outgoing.References = []string{threadID}
+		if replyTo.EmailMessageID != threadID {
+			outgoing.References = append(outgoing.References, replyTo.EmailMessageID)
+		}
+		if editTarget == nil && replyTo.MXID == content.RelatesTo.GetNonFallbackReplyTo() {
+			if quote := portal.replyQuote(ctx, replyTo); quote != "" {
+				if outgoing.Text != "" {
+					quote = strings.TrimRight(outgoing.Text, "\n") + "\n\n" + quote
+				}
+				outgoing.Text = quote
+			}
+		}
+	}
+	raw, emailMessageID, err := sender.Client.Compose(outgoing)
+	if err != nil {
+		return nil, err
+	}
+	if replyTo == nil {
+		threadID = emailMessageID
+	}
+	now := time.Now()
+	msg := portal.bridge.DB.Outbox.New()
+	msg.MXID = evtID
+	msg.RoomID = portal.MXID
+	msg.UserMXID = sender.MXID
+	msg.EmailMessageID = emailMessageID
+	msg.EmailThreadID = threadID
+	if editTarget != nil {
+		msg.EditTarget = editTarget.MXID
+	}
+	msg.Recipients = outgoing.To
+	msg.Raw = raw
+	msg.Text = text
+	msg.CreatedAt = now
+	msg.NextAttempt = now.Add(outboxMinRetryDelay)
+	if !sendAt.IsZero() {
+		msg.ScheduledFor = sendAt
+		msg.NextAttempt = sendAt
+	}
+	err = msg.Insert(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add email to outbox: %w", err)
+	}
+	if portal.NewThread {
+		portal.NewThread = false
+		err = portal.Update(ctx)
+		if err != nil {
+			log.Err(err).Msg("Failed to save portal after starting new thread")
+		}
+	}
+
+	log.Debug().Str("email_message_id", emailMessageID).Msg("Email added to outbox")
+	return msg, nil
 }
 
-func (portal *Portal) storeMessageInDB(ctx context.Context, eventID id.EventID, senderEmail string, timestamp uint64, partIndex int) {
+func (portal *Portal) storeMessageInDB(ctx context.Context, eventID id.EventID, senderEmail string, timestamp uint64, partIndex int, threading emailThreading) {
 	dbMessage := portal.bridge.DB.Message.New()
 	dbMessage.MXID = eventID
 	dbMessage.RoomID = portal.MXID
@@ -459,7 +946,10 @@ func (portal *Portal) storeMessageInDB(ctx context.Context, eventID id.EventID,
 	dbMessage.Timestamp = timestamp
 	dbMessage.PartIndex = partIndex
 	dbMessage.ThreadID = portal.ThreadID
+	dbMessage.EmailAddress = portal.ThreadID
 	dbMessage.EmailReceiver = portal.Receiver
+	dbMessage.EmailMessageID = threading.MessageID
+	dbMessage.EmailThreadID = threading.ThreadID
 	err := dbMessage.Insert(ctx)
 	if err != nil {
 		portal.log.Err(err).Msg("Failed to insert message into database")
@@ -543,8 +1033,62 @@ func (portal *Portal) ensureUserInvited(ctx context.Context, user *User) bool {
 	return user.ensureInvited(ctx, portal.MainIntent(), portal.MXID, portal.IsPrivateChat())
 }
 
+func (portal *Portal) shouldSetDMRoomMetadata() bool {
+	if !portal.IsPrivateChat() {
+		return false
+	}
+	switch portal.bridge.Config.Bridge.PrivateChatPortalMeta {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return portal.Encrypted
+	}
+}
+
 func (portal *Portal) UpdateDMInfo(ctx context.Context, forceSave bool) {
-	// FIXME
+	if !portal.shouldSetDMRoomMetadata() {
+		if forceSave {
+			err := portal.Update(ctx)
+			if err != nil {
+				zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal")
+			}
+		}
+		return
+	}
+	dmPuppet := portal.GetDMPuppet()
+	if dmPuppet == nil {
+		return
+	}
+	update := portal.updateAvatar(ctx, dmPuppet.AvatarURL, dmPuppet.AvatarHash)
+	if portal.Subject == "" {
+		update = portal.updateName(ctx, dmPuppet.Name) || update
+	}
+	if update || forceSave {
+		err := portal.Update(ctx)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal after updating DM info")
+		}
+	}
+}
+
+func (portal *Portal) updateAvatar(ctx context.Context, avatarURL id.ContentURI, avatarHash string) bool {
+	if portal.AvatarURL == avatarURL && (portal.AvatarSet || portal.MXID == "") {
+		return false
+	}
+	portal.AvatarURL = avatarURL
+	portal.AvatarHash = avatarHash
+	portal.AvatarSet = false
+	if portal.MXID != "" {
+		_, err := portal.MainIntent().SetRoomAvatar(ctx, portal.MXID, avatarURL)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to update room avatar")
+		} else {
+			portal.AvatarSet = true
+		}
+	}
+	return true
 }
 
 func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, emailAddress string) error {
@@ -570,15 +1114,6 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, emailAdd
 		StateKey: &bridgeInfoStateKey,
 	}}
 
-	if !portal.AvatarURL.IsEmpty() {
-		initialState = append(initialState, &event.Event{
-			Type: event.StateRoomAvatar,
-			Content: event.Content{Parsed: &event.RoomAvatarEventContent{
-				URL: portal.AvatarURL,
-			}},
-		})
-	}
-
 	creationContent := make(map[string]interface{})
 	if !portal.bridge.Config.Bridge.FederateRooms {
 		creationContent["m.federate"] = false
@@ -608,12 +1143,28 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, emailAdd
 	if portal.IsPrivateChat() {
 		dmPuppet = portal.GetDMPuppet()
 		if dmPuppet != nil {
-			dmPuppet.UpdateInfo(ctx, user)
+			dmPuppet.UpdateInfo(ctx, headerPuppetInfo(""))
+			if portal.shouldSetDMRoomMetadata() {
+				portal.AvatarURL = dmPuppet.AvatarURL
+				portal.AvatarHash = dmPuppet.AvatarHash
+				if portal.Name == "" {
+					portal.Name = dmPuppet.Name
+				}
+			}
 		}
-	} else {
+	} else if !portal.IsListPortal() {
 		portal.log.Warn().Msg("Not implemented yet")
 	}
 
+	if !portal.AvatarURL.IsEmpty() {
+		initialState = append(initialState, &event.Event{
+			Type: event.StateRoomAvatar,
+			Content: event.Content{Parsed: &event.RoomAvatarEventContent{
+				URL: portal.AvatarURL,
+			}},
+		})
+	}
+
 	req := &mautrix.ReqCreateRoom{
 		Visibility:      "private",
 		Name:            portal.Name,
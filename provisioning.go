@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	_ "net/http/pprof"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/id"
+
+	"imap-bridge/pkg/emailmeow"
+)
+
+type provisioningContextKey int
+
+const (
+	provisioningUserKey provisioningContextKey = iota
+)
+
+type ProvisioningAPI struct {
+	bridge *IMAPBridge
+	log    zerolog.Logger
+}
+
+func (prov *ProvisioningAPI) Init() {
+	prov.log.Debug().Str("prefix", prov.bridge.Config.Bridge.Provisioning.Prefix).Msg("Enabling provisioning API")
+	r := prov.bridge.AS.Router.PathPrefix(prov.bridge.Config.Bridge.Provisioning.Prefix).Subrouter()
+	r.Use(prov.AuthMiddleware)
+	r.HandleFunc("/v1/ping", prov.Ping).Methods(http.MethodGet)
+	r.HandleFunc("/v1/login", prov.Login).Methods(http.MethodPost)
+	r.HandleFunc("/v1/logout", prov.Logout).Methods(http.MethodPost)
+	r.HandleFunc("/v1/portals", prov.ListPortals).Methods(http.MethodGet)
+	r.HandleFunc("/v1/resolve_identifier/{address}", prov.ResolveIdentifier).Methods(http.MethodGet)
+	r.HandleFunc("/v1/pm/{address}", prov.StartPM).Methods(http.MethodPost)
+
+	if prov.bridge.Config.Bridge.Provisioning.DebugEndpoints {
+		prov.log.Debug().Msg("Enabling debug API at /debug")
+		r := prov.bridge.AS.Router.PathPrefix("/debug").Subrouter()
+		r.Use(prov.AuthMiddleware)
+		r.PathPrefix("/pprof").Handler(http.DefaultServeMux)
+	}
+}
+
+func jsonResponse(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+type Error struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+	ErrCode string `json:"errcode"`
+}
+
+type Response struct {
+	Success bool   `json:"success"`
+	Status  string `json:"status"`
+}
+
+func (prov *ProvisioningAPI) AuthMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		auth = strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(prov.bridge.Config.Bridge.Provisioning.SharedSecret)) != 1 {
+			prov.log.Info().Msg("Authentication token does not match shared secret")
+			jsonResponse(w, http.StatusForbidden, Error{
+				Error:   "Authentication token does not match shared secret",
+				ErrCode: "M_FORBIDDEN",
+			})
+			return
+		}
+		userID := id.UserID(r.URL.Query().Get("user_id"))
+		if _, _, err := userID.Parse(); err != nil {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Missing or invalid user_id query parameter",
+				ErrCode: "M_INVALID_PARAM",
+			})
+			return
+		}
+		user := prov.bridge.GetUserByMXID(userID)
+		if user == nil {
+			jsonResponse(w, http.StatusForbidden, Error{
+				Error:   "User can't use the bridge",
+				ErrCode: "M_FORBIDDEN",
+			})
+			return
+		}
+		log := prov.log.With().Stringer("user_id", userID).Str("path", r.URL.Path).Logger()
+		ctx := log.WithContext(context.WithValue(r.Context(), provisioningUserKey, user))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type PingEmailInfo struct {
+	Address    string `json:"address"`
+	IMAPServer string `json:"imap_server"`
+	SMTPServer string `json:"smtp_server"`
+	Connected  bool   `json:"connected"`
+}
+
+type PingResponse struct {
+	MXID           id.UserID          `json:"mxid"`
+	Admin          bool               `json:"admin"`
+	ManagementRoom id.RoomID          `json:"management_room,omitempty"`
+	SpaceRoom      id.RoomID          `json:"space_room,omitempty"`
+	Email          *PingEmailInfo     `json:"email,omitempty"`
+	BridgeState    status.BridgeState `json:"bridge_state"`
+}
+
+func (prov *ProvisioningAPI) Ping(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(provisioningUserKey).(*User)
+	resp := PingResponse{
+		MXID:           user.MXID,
+		Admin:          user.Admin,
+		ManagementRoom: user.ManagementRoom,
+		SpaceRoom:      user.SpaceRoom,
+		BridgeState:    user.BridgeState.GetPrev(),
+	}
+	if user.EmailAddress != "" {
+		resp.Email = &PingEmailInfo{
+			Address:    user.EmailAddress,
+			IMAPServer: user.IMAPServer,
+			SMTPServer: user.SMTPServer,
+			Connected:  user.IsLoggedIn(),
+		}
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+type ReqLogin struct {
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	emailmeow.ServerSettings
+}
+
+func (prov *ProvisioningAPI) Login(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(provisioningUserKey).(*User)
+	log := zerolog.Ctx(r.Context())
+
+	var req ReqLogin
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Failed to parse request body",
+			ErrCode: "M_BAD_JSON",
+		})
+		return
+	} else if user.IsLoggedIn() {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "You're already logged in",
+			ErrCode: "FI.MAU.IMAP.ALREADY_LOGGED_IN",
+		})
+		return
+	}
+
+	reply, err := user.Login(r.Context(), req.Address, req.Password, req.ServerSettings)
+	if err != nil {
+		log.Err(err).Msg("Failed to log in")
+		jsonResponse(w, http.StatusUnauthorized, Error{
+			Error:   reply,
+			ErrCode: "FI.MAU.IMAP.LOGIN_FAILED",
+		})
+		return
+	}
+	log.Info().Str("email_address", user.EmailAddress).Msg("Logged in via provisioning API")
+	jsonResponse(w, http.StatusOK, Response{Success: true, Status: "logged_in"})
+}
+
+func (prov *ProvisioningAPI) Logout(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(provisioningUserKey).(*User)
+	if user.EmailAddress == "" {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "You're not logged in",
+			ErrCode: "FI.MAU.IMAP.NOT_LOGGED_IN",
+		})
+		return
+	}
+	user.Logout(r.Context())
+	jsonResponse(w, http.StatusOK, Response{Success: true, Status: "logged_out"})
+}
+
+type PortalInfo struct {
+	RoomID       id.RoomID `json:"room_id"`
+	ThreadID     string    `json:"thread_id"`
+	EmailAddress string    `json:"email_address,omitempty"`
+	Name         string    `json:"name,omitempty"`
+	Encrypted    bool      `json:"encrypted"`
+}
+
+func (prov *ProvisioningAPI) ListPortals(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(provisioningUserKey).(*User)
+	if user.EmailAddress == "" {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "You're not logged in",
+			ErrCode: "FI.MAU.IMAP.NOT_LOGGED_IN",
+		})
+		return
+	}
+	dbPortals, err := prov.bridge.DB.Portal.FindPrivateChatsOf(r.Context(), user.EmailAddress)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Err(err).Msg("Failed to get portals of user")
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to get portals",
+			ErrCode: "M_UNKNOWN",
+		})
+		return
+	}
+	portals := make([]PortalInfo, 0, len(dbPortals))
+	for _, portal := range dbPortals {
+		if portal.MXID == "" {
+			continue
+		}
+		portals = append(portals, PortalInfo{
+			RoomID:       portal.MXID,
+			ThreadID:     portal.ThreadID,
+			EmailAddress: portal.EmailAddress,
+			Name:         portal.Name,
+			Encrypted:    portal.Encrypted,
+		})
+	}
+	jsonResponse(w, http.StatusOK, portals)
+}
+
+type ResolveIdentifierResponse struct {
+	RoomID       id.RoomID `json:"room_id,omitempty"`
+	JustCreated  bool      `json:"just_created,omitempty"`
+	EmailAddress string    `json:"email_address"`
+	MXID         id.UserID `json:"mxid"`
+	Displayname  string    `json:"displayname,omitempty"`
+}
+
+func (prov *ProvisioningAPI) resolveIdentifier(w http.ResponseWriter, r *http.Request) (*User, *Puppet) {
+	user := r.Context().Value(provisioningUserKey).(*User)
+	if !user.IsLoggedIn() {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "You're not logged in",
+			ErrCode: "FI.MAU.IMAP.NOT_LOGGED_IN",
+		})
+		return nil, nil
+	}
+	addr, err := mail.ParseAddress(mux.Vars(r)["address"])
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Invalid email address",
+			ErrCode: "M_INVALID_PARAM",
+		})
+		return nil, nil
+	}
+	puppet := prov.bridge.GetPuppetByEmailAddress(addr.Address)
+	if puppet == nil {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to get ghost user",
+			ErrCode: "M_UNKNOWN",
+		})
+		return nil, nil
+	}
+	return user, puppet
+}
+
+func (prov *ProvisioningAPI) ResolveIdentifier(w http.ResponseWriter, r *http.Request) {
+	user, puppet := prov.resolveIdentifier(w, r)
+	if puppet == nil {
+		return
+	}
+	resp := ResolveIdentifierResponse{
+		EmailAddress: puppet.EmailAddress,
+		MXID:         puppet.MXID,
+		Displayname:  puppet.Name,
+	}
+	portal := prov.bridge.GetPortalByThreadIDIfExists(user.privateChatKey(puppet.EmailAddress))
+	if portal != nil {
+		resp.RoomID = portal.MXID
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+type ReqStartPM struct {
+	Subject string `json:"subject,omitempty"`
+}
+
+func (prov *ProvisioningAPI) StartPM(w http.ResponseWriter, r *http.Request) {
+	user, puppet := prov.resolveIdentifier(w, r)
+	if puppet == nil {
+		return
+	}
+	var req ReqStartPM
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Failed to parse request body",
+				ErrCode: "M_BAD_JSON",
+			})
+			return
+		}
+	}
+	portal, justCreated, err := user.GetOrCreatePrivateChat(r.Context(), puppet.EmailAddress, req.Subject)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Err(err).Str("email_address", puppet.EmailAddress).Msg("Failed to start private chat")
+		errCode := "M_UNKNOWN"
+		if errors.Is(err, errPortalNotFound) {
+			errCode = "M_NOT_FOUND"
+		}
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to create portal room",
+			ErrCode: errCode,
+		})
+		return
+	}
+	status := http.StatusOK
+	if justCreated {
+		status = http.StatusCreated
+	}
+	jsonResponse(w, status, ResolveIdentifierResponse{
+		RoomID:       portal.MXID,
+		JustCreated:  justCreated,
+		EmailAddress: puppet.EmailAddress,
+		MXID:         puppet.MXID,
+		Displayname:  puppet.Name,
+	})
+}
@@ -2,16 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"regexp"
 	"strings"
 
 	"github.com/emersion/go-message/mail"
 
+	"imap-bridge/config"
 	"imap-bridge/database"
+	"imap-bridge/pkg/identicon"
 
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/id"
@@ -29,9 +32,11 @@ type Puppet struct {
 	customUser   *User
 }
 
-// CustomIntent implements bridge.Ghost.
-func (*Puppet) CustomIntent() *appservice.IntentAPI {
-	panic("unimplemented")
+func (puppet *Puppet) CustomIntent() *appservice.IntentAPI {
+	if puppet == nil {
+		return nil
+	}
+	return puppet.customIntent
 }
 
 func (puppet *Puppet) IntentFor(portal *Portal) *appservice.IntentAPI {
@@ -44,9 +49,8 @@ func (puppet *Puppet) IntentFor(portal *Portal) *appservice.IntentAPI {
 	return nil
 }
 
-// GetMXID implements bridge.Ghost.
-func (*Puppet) GetMXID() id.UserID {
-	panic("unimplemented")
+func (puppet *Puppet) GetMXID() id.UserID {
+	return puppet.MXID
 }
 
 func (puppet *Puppet) DefaultIntent() *appservice.IntentAPI {
@@ -85,6 +89,22 @@ func (br *IMAPBridge) GetPuppetByEmailAddress(addr string) *Puppet {
 	return puppet
 }
 
+func (br *IMAPBridge) GetPuppetByEmailAddressIfExists(addr string) *Puppet {
+	br.puppetsLock.Lock()
+	defer br.puppetsLock.Unlock()
+
+	puppet, ok := br.puppets[addr]
+	if !ok {
+		dbPuppet, err := br.DB.Puppet.GetByEmailAddress(context.TODO(), addr)
+		if err != nil {
+			br.ZLog.Err(err).Msg("Failed to get puppet from database")
+			return nil
+		}
+		return br.loadPuppet(context.TODO(), dbPuppet, "")
+	}
+	return puppet
+}
+
 func (br *IMAPBridge) NewPuppet(dbPuppet *database.Puppet) *Puppet {
 	return &Puppet{
 		Puppet: dbPuppet,
@@ -97,36 +117,31 @@ func (br *IMAPBridge) NewPuppet(dbPuppet *database.Puppet) *Puppet {
 
 func (br *IMAPBridge) FormatPuppetMXID(emailAddr string) id.UserID {
 	return id.NewUserID(
-		br.Config.Bridge.FormatUsername(emailAddr),
+		br.Config.Bridge.FormatUsername(id.EncodeUserLocalpart(emailAddr)),
 		br.Config.Homeserver.Domain,
 	)
 }
 
 var userIDRegex *regexp.Regexp
 
-func ParseFromRFC5322(addrr string) (string, error) {
-	// FIXME
-	return "Barry Gibbs <bg@example.com>", nil
-}
-
 func (br *IMAPBridge) ParsePuppetMXID(mxid id.UserID) (string, bool) {
 	if userIDRegex == nil {
 		pattern := fmt.Sprintf(
 			"^@%s:%s$",
-			br.Config.Bridge.FormatUsername(`(\d+)`),
-			br.Config.Homeserver.Domain,
+			br.Config.Bridge.FormatUsername(`([a-z0-9._=/-]+)`),
+			regexp.QuoteMeta(br.Config.Homeserver.Domain),
 		)
 		userIDRegex = regexp.MustCompile(pattern)
 	}
 
 	match := userIDRegex.FindStringSubmatch(string(mxid))
 	if len(match) == 2 {
-		parsedRFC5322, err := ParseFromRFC5322(match[1])
+		decoded, err := id.DecodeUserLocalpart(match[1])
 		if err != nil {
 			return "", false
 		}
 
-		parsed, err := mail.ParseAddress(parsedRFC5322)
+		parsed, err := mail.ParseAddress(decoded)
 		if err != nil {
 			return "", false
 		}
@@ -201,26 +216,59 @@ func (br *IMAPBridge) dbPuppetsToPuppets(dbPuppets []*database.Puppet) []*Puppet
 	return output
 }
 
-func Format(addr string) string {
-	return strings.ReplaceAll(addr, "@", "_")
+// Name qualities, from worst to best. A name is only replaced by one of equal
+// or better quality.
+const (
+	nameQualityNone = iota
+	nameQualityAddress
+	nameQualityHeader
+	nameQualityContact
+)
+
+// Avatar sources stored in the avatar_path column.
+const (
+	avatarSourceIdenticon = "identicon"
+	avatarSourceContact   = "contact"
+)
+
+// PuppetInfo is profile info about an email user from a single source.
+type PuppetInfo struct {
+	Name        string
+	NameQuality int
 
+	// Avatar is the image data from a contact card. If nil, an identicon is
+	// used unless the ghost already has an avatar from a better source.
+	Avatar     []byte
+	AvatarType string
 }
 
-func (puppet *Puppet) UpdateInfo(ctx context.Context, source *User) {
-	var err error
+// headerPuppetInfo returns the info for the display name found in an email
+// header. An empty name falls back to the bare address.
+func headerPuppetInfo(name string) PuppetInfo {
+	if name == "" {
+		return PuppetInfo{NameQuality: nameQualityAddress}
+	}
+	return PuppetInfo{Name: name, NameQuality: nameQualityHeader}
+}
+
+func (puppet *Puppet) UpdateInfo(ctx context.Context, info PuppetInfo) {
+	log := zerolog.Ctx(ctx).With().
+		Str("function", "UpdateInfo").
+		Str("puppet_email_address", puppet.EmailAddress).
+		Logger()
+	ctx = log.WithContext(ctx)
 
 	log.Trace().Msg("Updating puppet info")
 
-	update := false
-	if puppet.EmailAddress != source.EmailAddress {
-		puppet.EmailAddress = source.EmailAddress
-		update = true
+	update := puppet.updateName(ctx, info.Name, info.NameQuality)
+	if info.Avatar != nil {
+		update = puppet.updateAvatar(ctx, info.Avatar, info.AvatarType, avatarSourceContact) || update
+	} else {
+		update = puppet.updateIdenticon(ctx) || update
 	}
-	update = puppet.updateName(ctx, Format(puppet.EmailAddress)) || update
 	if update {
-		puppet.NameSet = false
 		puppet.UpdateContactInfo(ctx)
-		err = puppet.Update(ctx)
+		err := puppet.Update(ctx)
 		if err != nil {
 			log.Err(err).Msg("Failed to save puppet to database after updating")
 		}
@@ -229,13 +277,32 @@ func (puppet *Puppet) UpdateInfo(ctx context.Context, source *User) {
 	}
 }
 
-func (puppet *Puppet) updateName(ctx context.Context, contact string) bool {
-	// TODO set name quality
-	newName := strings.ReplaceAll(contact, "@", "_")
-	if puppet.NameSet && puppet.Name == newName {
+func (puppet *Puppet) formatName(name string) string {
+	localPart, domain, _ := strings.Cut(puppet.EmailAddress, "@")
+	return puppet.bridge.Config.Bridge.FormatDisplayname(config.DisplaynameParams{
+		Name:      name,
+		Address:   puppet.EmailAddress,
+		LocalPart: localPart,
+		Domain:    domain,
+	})
+}
+
+func (puppet *Puppet) updateName(ctx context.Context, name string, quality int) bool {
+	if quality < puppet.NameQuality {
+		return false
+	}
+	newName := puppet.formatName(name)
+	if newName == "" {
+		return false
+	} else if puppet.NameSet && puppet.Name == newName {
+		if puppet.NameQuality != quality {
+			puppet.NameQuality = quality
+			return true
+		}
 		return false
 	}
 	puppet.Name = newName
+	puppet.NameQuality = quality
 	puppet.NameSet = false
 	err := puppet.DefaultIntent().SetDisplayName(ctx, newName)
 	if err != nil {
@@ -246,6 +313,42 @@ func (puppet *Puppet) updateName(ctx context.Context, contact string) bool {
 	return true
 }
 
+func (puppet *Puppet) updateIdenticon(ctx context.Context) bool {
+	if puppet.AvatarPath != "" && (puppet.AvatarPath != avatarSourceIdenticon || puppet.AvatarSet) {
+		// Either the identicon is already set, or the avatar came from a
+		// better source that shouldn't be replaced.
+		return false
+	}
+	return puppet.updateAvatar(ctx, identicon.Generate(puppet.EmailAddress), "image/png", avatarSourceIdenticon)
+}
+
+func (puppet *Puppet) updateAvatar(ctx context.Context, data []byte, mimeType, source string) bool {
+	hash := sha256.Sum256(data)
+	avatarHash := hex.EncodeToString(hash[:])
+	if puppet.AvatarSet && puppet.AvatarHash == avatarHash && !puppet.AvatarURL.IsEmpty() {
+		return false
+	}
+	log := zerolog.Ctx(ctx)
+	if puppet.AvatarHash != avatarHash || puppet.AvatarURL.IsEmpty() {
+		resp, err := puppet.DefaultIntent().UploadBytes(ctx, data, mimeType)
+		if err != nil {
+			log.Err(err).Str("avatar_source", source).Msg("Failed to upload avatar")
+			return false
+		}
+		puppet.AvatarURL = resp.ContentURI
+		puppet.AvatarHash = avatarHash
+	}
+	puppet.AvatarPath = source
+	puppet.AvatarSet = false
+	err := puppet.DefaultIntent().SetAvatarURL(ctx, puppet.AvatarURL)
+	if err != nil {
+		log.Err(err).Msg("Failed to update user avatar")
+	} else {
+		puppet.AvatarSet = true
+	}
+	return true
+}
+
 func (puppet *Puppet) UpdateContactInfo(ctx context.Context) {
 	if !puppet.bridge.SpecVersions.Supports(mautrix.BeeperFeatureArbitraryProfileMeta) || puppet.NameSet {
 		return
@@ -272,7 +375,7 @@ func (puppet *Puppet) updatePortalMeta(ctx context.Context) {
 	for _, portal := range puppet.bridge.FindPrivateChatPortalsWith(puppet.EmailAddress) {
 		// Get room create lock to prevent races between receiving contact info and room creation.
 		portal.roomCreateLock.Lock()
-		// portal.UpdateDMInfo(ctx, false)
+		portal.UpdateDMInfo(ctx, false)
 		portal.roomCreateLock.Unlock()
 	}
 }
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// quotedTextKey is the custom content key that holds the quoted text and
+// signature removed from an incoming email, so that the full original stays
+// reachable with the show-quoted command.
+const quotedTextKey = "net.maunium.imap-bridge.quoted_text"
+
+// attributionRegex matches the line that mail clients put above the quoted
+// message in a reply, like "On Mon, 1 Jan 2024, Alice <alice@example.com> wrote:".
+var attributionRegex = regexp.MustCompile(`(?i)^(?:` + strings.Join([]string{
+	`on .+ wrote`,                   // English
+	`.+ wrote`,                      // English without a date
+	`am .+ schrieb.*`,               // German
+	`le .+ a écrit ?`,               // French
+	`el .+ escribió`,                // Spanish
+	`il .+ ha scritto`,              // Italian
+	`em .+ escreveu`,                // Portuguese
+	`op .+ schreef.*`,               // Dutch
+	`den .+ skrev.*`,                // Swedish, Danish and Norwegian
+	`w dniu .+ napisał(?:\(a\))?.*`, // Polish
+	`.+ (?:пишет|написал(?:\(а\))?)`, // Russian
+}, "|") + `):$`)
+
+// originalMessageRegex matches the separator that Outlook puts above the
+// quoted message in plain text replies.
+var originalMessageRegex = regexp.MustCompile(`(?i)^-{2,}\s*(?:original message|ursprüngliche nachricht|message d'origine|mensaje original|messaggio originale|mensagem original|oorspronkelijk bericht)\s*-{2,}$`)
+
+// forwardedMessageRegex matches the line above a forwarded message, which
+// shouldn't be hidden like a quote.
+var forwardedMessageRegex = regexp.MustCompile(`(?i)^(?:-{2,}\s*(?:forwarded message|weitergeleitete nachricht|message transféré|mensaje reenviado|messaggio inoltrato|mensagem encaminhada|doorgestuurd bericht)\s*-{2,}|begin forwarded message:)$`)
+
+const (
+	outlookFromPattern = `\**(?:from|von|de|van|da|från|od)\s*:`
+	outlookSentPattern = `\**(?:sent|date|gesendet|datum|envoyé|enviado|fecha|inviato|data|verzonden|skickat|wysłano)\s*:`
+)
+
+var (
+	outlookFromRegex = regexp.MustCompile(`(?i)^` + outlookFromPattern)
+	outlookSentRegex = regexp.MustCompile(`(?i)^` + outlookSentPattern)
+	// outlookHeaderHTMLRegex matches the text of an element that has the
+	// headers, as the lines aren't separated in the text of HTML elements.
+	outlookHeaderHTMLRegex = regexp.MustCompile(`(?is)^` + outlookFromPattern + `.*\s` + outlookSentPattern)
+)
+
+// quoteClasses are the classes that mail clients put on the quoted message
+// in HTML replies.
+var quoteClasses = []string{"gmail_quote", "gmail_quote_container", "yahoo_quoted", "protonmail_quote"}
+
+// quoteIDs are the IDs of the elements that Outlook puts above the quoted
+// message.
+var quoteIDs = []string{"divRplyFwdMsg", "appendonsend", "OLK_SRC_BODY_SECTION"}
+
+// attributionClasses are the classes of the attribution line above a quote.
+var attributionClasses = []string{"gmail_attr", "moz-cite-prefix"}
+
+// signatureClasses are the classes that mail clients put on signatures.
+var signatureClasses = []string{"gmail_signature", "moz-signature"}
+
+// splitQuotedText splits the plain text body of an email into the reply and
+// the quoted previous messages and signature at the end. If no quote is
+// found, or if the email consists of only a quote, quoted is empty.
+func splitQuotedText(text string) (body, quoted string) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	cut := findQuoteStart(lines)
+	if cut < 0 {
+		return text, ""
+	}
+	bodyLines := lines[:cut]
+	for len(bodyLines) > 0 && isSeparatorLine(bodyLines[len(bodyLines)-1]) {
+		bodyLines = bodyLines[:len(bodyLines)-1]
+	}
+	if len(bodyLines) == 0 {
+		return text, ""
+	}
+	return strings.Join(bodyLines, "\n"), strings.TrimSpace(strings.Join(lines[cut:], "\n"))
+}
+
+// findQuoteStart returns the index of the first line of the quoted part, or
+// -1 if there is no quote. Quoted sections that are followed by unquoted text
+// are inline replies, so they're kept.
+func findQuoteStart(lines []string) int {
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case forwardedMessageRegex.MatchString(trimmed):
+			return -1
+		case isSignatureDelimiter(line),
+			originalMessageRegex.MatchString(trimmed),
+			isOutlookHeader(lines[i:]):
+			return i
+		case strings.HasPrefix(trimmed, ">") && onlyQuotedAfter(lines[i:]):
+			return i
+		}
+		if n := attributionLines(lines[i:]); n > 0 && onlyQuotedAfter(lines[i+n:]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isSignatureDelimiter checks for the "-- " line that starts a signature.
+// Some clients strip the trailing space, so it's optional.
+func isSignatureDelimiter(line string) bool {
+	return strings.TrimRight(line, " \r") == "--"
+}
+
+func isSeparatorLine(line string) bool {
+	return strings.Trim(line, " \t_-=*") == ""
+}
+
+// isOutlookHeader checks whether the lines start with the From: and Sent:
+// headers that Outlook puts above the quoted message instead of quoting it.
+func isOutlookHeader(lines []string) bool {
+	if len(lines) == 0 || !outlookFromRegex.MatchString(strings.TrimSpace(lines[0])) {
+		return false
+	}
+	for _, line := range lines[1:min(len(lines), 5)] {
+		if outlookSentRegex.MatchString(strings.TrimSpace(line)) {
+			return true
+		}
+	}
+	return false
+}
+
+// attributionLines returns the number of lines that the attribution at the
+// start of lines spans, which is up to 2 as clients wrap long lines.
+func attributionLines(lines []string) int {
+	first := strings.TrimSpace(lines[0])
+	if first == "" || strings.HasPrefix(first, ">") {
+		return 0
+	} else if attributionRegex.MatchString(first) {
+		return 1
+	} else if len(lines) > 1 && attributionRegex.MatchString(first+" "+strings.TrimSpace(lines[1])) {
+		return 2
+	}
+	return 0
+}
+
+// onlyQuotedAfter checks that the lines contain a quote and no unquoted text
+// other than a signature.
+func onlyQuotedAfter(lines []string) bool {
+	var hasQuote bool
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case isSignatureDelimiter(line):
+			return hasQuote
+		case strings.HasPrefix(trimmed, ">"):
+			hasQuote = true
+		case trimmed != "":
+			return false
+		}
+	}
+	return hasQuote
+}
+
+// splitQuotedHTML removes the quoted previous messages and signature at the
+// end of an HTML email, and returns them in a separate element. It returns
+// nil if there is no quote, or if the email consists of only a quote.
+func splitQuotedHTML(root *html.Node) *html.Node {
+	cut, _ := findQuoteStartHTML(root)
+	if cut == nil || !hasContentBefore(root, cut) {
+		return nil
+	}
+	quoted := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	// Move the cut node and everything after it in document order
+	for node := cut; node != root; {
+		parent := node.Parent
+		next := node.NextSibling
+		if node == cut {
+			next = node
+		}
+		for next != nil {
+			sibling := next
+			next = sibling.NextSibling
+			parent.RemoveChild(sibling)
+			quoted.AppendChild(sibling)
+		}
+		node = parent
+	}
+	return quoted
+}
+
+// findQuoteStartHTML returns the first node of the quoted part. If a
+// forwarded message is found first, forwarded is true and nothing is split.
+func findQuoteStartHTML(parent *html.Node) (found *html.Node, forwarded bool) {
+	for node := parent.FirstChild; node != nil; node = node.NextSibling {
+		switch node.Type {
+		case html.TextNode:
+			text := strings.TrimSpace(node.Data)
+			if forwardedMessageRegex.MatchString(text) {
+				return nil, true
+			} else if text == "--" || originalMessageRegex.MatchString(text) {
+				return node, false
+			}
+		case html.ElementNode:
+			if droppedElements[node.DataAtom] {
+				continue
+			} else if forwardedMessageRegex.MatchString(firstLine(node)) {
+				return nil, true
+			} else if isQuoteElement(node) {
+				return withAttribution(node), false
+			}
+			found, forwarded = findQuoteStartHTML(node)
+			if found != nil || forwarded {
+				return
+			}
+		}
+	}
+	return nil, false
+}
+
+func isQuoteElement(node *html.Node) bool {
+	classes := strings.Fields(getAttr(node, "class"))
+	switch {
+	case isSignatureElement(node),
+		containsString(quoteIDs, getAttr(node, "id")),
+		node.DataAtom != atom.Blockquote && containsAny(classes, quoteClasses),
+		(node.DataAtom == atom.P || node.DataAtom == atom.Div) && outlookHeaderHTMLRegex.MatchString(textContent(node)):
+		return true
+	case node.DataAtom == atom.Blockquote, containsAny(classes, attributionClasses):
+		// Quotes followed by unquoted text are inline replies
+		return !hasUnquotedTextAfter(node)
+	default:
+		return false
+	}
+}
+
+func isSignatureElement(node *html.Node) bool {
+	return containsAny(strings.Fields(getAttr(node, "class")), signatureClasses) ||
+		getAttr(node, "data-smartmail") == "gmail_signature"
+}
+
+// withAttribution returns the attribution line before a quote if there is
+// one, or the quote itself otherwise.
+func withAttribution(quote *html.Node) *html.Node {
+	for node := quote.PrevSibling; node != nil; node = node.PrevSibling {
+		if node.Type == html.ElementNode && node.DataAtom == atom.Br {
+			continue
+		}
+		text := strings.Join(strings.Fields(textContent(node)), " ")
+		if text == "" {
+			continue
+		} else if attributionRegex.MatchString(text) {
+			return node
+		}
+		break
+	}
+	return quote
+}
+
+// hasUnquotedTextAfter checks whether there is text after the node that isn't
+// in a quote. A signature ends the check.
+func hasUnquotedTextAfter(node *html.Node) bool {
+	for ; node != nil; node = node.Parent {
+		for sibling := node.NextSibling; sibling != nil; sibling = sibling.NextSibling {
+			if found, signature := findUnquotedText(sibling); found || signature {
+				return found
+			}
+		}
+	}
+	return false
+}
+
+func findUnquotedText(node *html.Node) (found, signature bool) {
+	switch node.Type {
+	case html.TextNode:
+		text := strings.TrimSpace(node.Data)
+		return text != "" && text != "--", text == "--"
+	case html.ElementNode:
+		if isSignatureElement(node) {
+			return false, true
+		} else if node.DataAtom == atom.Blockquote || droppedElements[node.DataAtom] {
+			return false, false
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if found, signature = findUnquotedText(child); found || signature {
+				return
+			}
+		}
+	}
+	return false, false
+}
+
+// hasContentBefore checks whether there is text or an image before the cut
+// node in document order.
+func hasContentBefore(root, cut *html.Node) bool {
+	var found, done bool
+	var walk func(*html.Node)
+	walk = func(parent *html.Node) {
+		for node := parent.FirstChild; node != nil && !found && !done; node = node.NextSibling {
+			switch {
+			case node == cut:
+				done = true
+			case node.Type == html.TextNode:
+				found = strings.TrimSpace(node.Data) != ""
+			case node.Type == html.ElementNode && node.DataAtom == atom.Img:
+				found = true
+			case node.Type == html.ElementNode && !droppedElements[node.DataAtom]:
+				walk(node)
+			}
+		}
+	}
+	walk(root)
+	return found
+}
+
+// textContent returns the text in an element, limited to the first kilobyte
+// as it's only used for matching headers.
+func textContent(node *html.Node) string {
+	var buf strings.Builder
+	var walk func(*html.Node)
+	walk = func(node *html.Node) {
+		switch {
+		case buf.Len() > 1024:
+		case node.Type == html.TextNode:
+			buf.WriteString(node.Data)
+		case node.Type == html.ElementNode && node.DataAtom == atom.Br:
+			buf.WriteByte('\n')
+		case node.Type == html.ElementNode && !droppedElements[node.DataAtom]:
+			for child := node.FirstChild; child != nil; child = child.NextSibling {
+				walk(child)
+			}
+		}
+	}
+	walk(node)
+	return buf.String()
+}
+
+func firstLine(node *html.Node) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(textContent(node)), "\n")
+	return strings.TrimSpace(line)
+}
+
+func containsAny(list, values []string) bool {
+	for _, value := range values {
+		if containsString(list, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimTrailingBreaks removes line breaks and horizontal rules left at the
+// end of an email after the quote was removed.
+func trimTrailingBreaks(parent *html.Node) {
+	for node := parent.LastChild; node != nil; node = parent.LastChild {
+		switch {
+		case node.Type == html.TextNode && strings.TrimSpace(node.Data) == "",
+			node.Type == html.ElementNode && (node.DataAtom == atom.Br || node.DataAtom == atom.Hr):
+			parent.RemoveChild(node)
+		case node.Type == html.ElementNode && !keptEmptyElements[node.DataAtom]:
+			trimTrailingBreaks(node)
+			if !isEmptyElement(node) {
+				return
+			}
+			parent.RemoveChild(node)
+		default:
+			return
+		}
+	}
+}
+
+// textToHTML converts plain text to HTML that looks the same.
+func textToHTML(text string) string {
+	return strings.ReplaceAll(html.EscapeString(text), "\n", "<br/>")
+}
+
+// collapseQuotedHTML appends the quoted part of an email to the reply in a
+// collapsed section.
+func collapseQuotedHTML(body, quoted string) string {
+	return body + "<details><summary>Quoted text</summary>" + quoted + "</details>"
+}
+
+// getMessageEvent fetches a message event from a room, decrypting it if
+// necessary.
+func (br *IMAPBridge) getMessageEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	evt, err := br.Bot.GetEvent(ctx, roomID, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get event: %w", err)
+	}
+	err = evt.Content.ParseRaw(evt.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return nil, fmt.Errorf("failed to parse event: %w", err)
+	}
+	if evt.Type == event.EventEncrypted {
+		if br.Crypto == nil {
+			return nil, errors.New("event is encrypted, but encryption is not enabled")
+		}
+		evt, err = br.Crypto.Decrypt(ctx, evt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt event: %w", err)
+		}
+	}
+	return evt, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"imap-bridge/config"
+	"imap-bridge/database"
+	"imap-bridge/pkg/emailmeow"
+	"imap-bridge/pkg/emailmeow/events"
+)
+
+var _ bridge.ReadReceiptHandlingPortal = (*Portal)(nil)
+
+// GetReadReceiptPolicy returns the user's read receipt policy, falling back to the bridge default.
+func (user *User) GetReadReceiptPolicy() config.ReadReceiptPolicy {
+	if policy := config.ReadReceiptPolicy(user.ReadReceiptPolicy); policy.IsValid() {
+		return policy
+	}
+	return user.bridge.Config.Bridge.ReadReceiptPolicy
+}
+
+// handleDispositionNotification bridges a read receipt for an email sent
+// from Matrix as a Matrix read receipt from the recipient's ghost. It returns
+// false if the notification isn't about a message sent through the bridge.
+func (user *User) handleDispositionNotification(msg *events.Message) bool {
+	dn := msg.DispositionNotification
+	log := user.log.With().
+		Str("action", "handle disposition notification").
+		Str("email_message_id", msg.Info.MessageID).
+		Str("original_email_message_id", dn.OriginalMessageID).
+		Str("disposition", dn.Disposition).
+		Logger()
+	ctx := log.WithContext(context.TODO())
+	if dn.OriginalMessageID == "" {
+		log.Debug().Msg("Disposition notification doesn't reference original message")
+		return false
+	}
+	original, err := user.bridge.DB.Message.GetByEmailMessageID(ctx, user.EmailAddress, dn.OriginalMessageID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get original message of disposition notification")
+		return false
+	} else if original == nil || original.Sender != user.EmailAddress {
+		log.Debug().Msg("Disposition notification is not about a bridged message")
+		return false
+	}
+	if !dn.IsDisplayed() {
+		log.Debug().Msg("Ignoring disposition notification that isn't a read receipt")
+		return true
+	}
+	portal := user.bridge.GetPortalByMXID(original.RoomID)
+	if portal == nil {
+		log.Warn().Stringer("room_id", original.RoomID).Msg("Portal of read message not found")
+		return true
+	}
+	puppet := user.bridge.GetPuppetByEmailAddress(dn.Recipient)
+	if puppet == nil {
+		log.Warn().Str("recipient", dn.Recipient).Msg("Failed to get ghost of read receipt sender")
+		return true
+	}
+	intent := puppet.DefaultIntent()
+	if portal.IsListPortal() && !user.bridge.StateStore.IsInRoom(ctx, portal.MXID, puppet.MXID) {
+		// Don't add every list member who reads a post to the room
+		log.Debug().Str("recipient", dn.Recipient).Msg("Ignoring read receipt from list member who isn't in the room")
+		return true
+	} else if err = intent.EnsureJoined(ctx, portal.MXID); err != nil {
+		log.Err(err).Msg("Failed to ensure ghost is joined to send read receipt")
+		return true
+	}
+	err = intent.MarkRead(ctx, portal.MXID, original.MXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to send read receipt")
+	} else {
+		log.Debug().Stringer("event_id", original.MXID).Msg("Bridged read receipt")
+	}
+	return true
+}
+
+// storeReadReceiptRequest remembers that the sender of a bridged email asked
+// for a read receipt, so that one can be sent when the user reads it.
+func (portal *Portal) storeReadReceiptRequest(ctx context.Context, user *User, msg *events.Message, eventID id.EventID, timestamp uint64) {
+	info := msg.Info
+	if info.DispositionNotificationTo == "" || info.MessageID == "" || info.Automated != "" ||
+		msg.Seen || msg.Sent || portal.IsListPortal() || user.GetReadReceiptPolicy() == config.ReadReceiptPolicyNever {
+		return
+	}
+	req := portal.bridge.DB.ReadReceiptRequest.New()
+	req.EmailReceiver = portal.Receiver
+	req.EmailMessageID = info.MessageID
+	req.MXID = eventID
+	req.RoomID = portal.MXID
+	req.Timestamp = timestamp
+	req.NotifyTo = info.DispositionNotificationTo
+	req.ToSender = info.DispositionNotificationToSender
+	req.Subject = info.ThreadName
+	err := req.Insert(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save read receipt request")
+	}
+}
+
+func (portal *Portal) HandleMatrixReadReceipt(brUser bridge.User, eventID id.EventID, receipt event.ReadReceipt) {
+	user := brUser.(*User)
+	if !user.IsLoggedIn() || portal.Receiver != user.EmailAddress {
+		return
+	}
+	log := portal.log.With().
+		Str("action", "handle matrix read receipt").
+		Stringer("event_id", eventID).
+		Logger()
+	ctx := log.WithContext(context.TODO())
+	readUntil := uint64(receipt.Timestamp.UnixMilli())
+	msg, err := portal.bridge.DB.Message.GetByMXID(ctx, eventID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get read message from database")
+		return
+	} else if msg != nil {
+		readUntil = msg.Timestamp
+	}
+	requests, err := portal.bridge.DB.ReadReceiptRequest.GetAllBefore(ctx, portal.MXID, readUntil)
+	if err != nil {
+		log.Err(err).Msg("Failed to get read receipt requests")
+		return
+	}
+	policy := user.GetReadReceiptPolicy()
+	var toSend []*database.ReadReceiptRequest
+	for _, req := range requests {
+		if policy == config.ReadReceiptPolicyAsk || (policy == config.ReadReceiptPolicyAlways && !req.ToSender) {
+			if !req.Asked {
+				portal.askReadReceipt(ctx, req)
+			}
+			continue
+		}
+		if policy == config.ReadReceiptPolicyAlways {
+			toSend = append(toSend, req)
+		} else if err = req.Delete(ctx); err != nil {
+			log.Err(err).Str("email_message_id", req.EmailMessageID).Msg("Failed to delete read receipt request")
+		}
+	}
+	if len(toSend) > 0 {
+		go user.sendReadReceipts(log, toSend, false)
+	}
+}
+
+// askReadReceipt tells the user that the sender of a message asked for a
+// read receipt and how to send it.
+func (portal *Portal) askReadReceipt(ctx context.Context, req *database.ReadReceiptRequest) {
+	body := fmt.Sprintf("%s asked for a read receipt for this email.", req.NotifyTo)
+	if !req.ToSender {
+		body += " That address isn't the sender of the email."
+	}
+	content := &event.MessageEventContent{
+		MsgType:   event.MsgNotice,
+		Body:      fmt.Sprintf("%s Use `%s send-read-receipt` to send it.", body, portal.bridge.Config.Bridge.CommandPrefix),
+		RelatesTo: (&event.RelatesTo{}).SetReplyTo(req.MXID),
+	}
+	_, err := portal.sendMainIntentMessage(ctx, content)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to ask about read receipt")
+		return
+	}
+	err = req.MarkAsked(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to mark read receipt request as asked")
+	}
+}
+
+// sendReadReceipts sends disposition notifications for the given requests.
+// Each request is removed from the database after its notification has been
+// sent, so failed ones are retried the next time the user reads the room.
+// Mail is submitted over SMTP, so receipts can be sent while IMAP is down.
+func (user *User) sendReadReceipts(log zerolog.Logger, requests []*database.ReadReceiptRequest, manual bool) (sent int) {
+	user.readReceiptLock.Lock()
+	defer user.readReceiptLock.Unlock()
+	cli := user.getSMTPClient()
+	if cli == nil {
+		log.Warn().Msg("Not sending read receipts as user isn't logged in")
+		return
+	}
+	ctx := context.TODO()
+	for _, req := range requests {
+		log := log.With().Str("email_message_id", req.EmailMessageID).Logger()
+		// Another read receipt may have answered the request already
+		current, err := user.bridge.DB.ReadReceiptRequest.GetByEmailMessageID(ctx, req.EmailReceiver, req.EmailMessageID)
+		if err != nil {
+			log.Err(err).Msg("Failed to check read receipt request")
+			continue
+		} else if current == nil {
+			continue
+		}
+		err = cli.SendDispositionNotification(ctx, &emailmeow.OutgoingDispositionNotification{
+			To:                req.NotifyTo,
+			OriginalMessageID: req.EmailMessageID,
+			OriginalSubject:   req.Subject,
+			Manual:            manual,
+		})
+		if err != nil {
+			log.Err(err).Msg("Failed to send read receipt")
+			continue
+		}
+		sent++
+		if err = req.Delete(ctx); err != nil {
+			log.Err(err).Msg("Failed to delete read receipt request")
+		}
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+
+	"imap-bridge/database"
+)
+
+// replyQuote returns the attribution line and quoted text of the message that
+// an outgoing email replies to, or an empty string if the text isn't
+// available.
+func (portal *Portal) replyQuote(ctx context.Context, target *database.Message) string {
+	text, sentAt := portal.getMessageText(ctx, target)
+	if strings.TrimSpace(text) == "" {
+		return ""
+	}
+	return fmt.Sprintf("On %s, %s wrote:\n%s", sentAt.Local().Format("Mon, 2 Jan 2006 at 15:04"), portal.messageSenderName(target), quoteText(text))
+}
+
+// getMessageText returns the text of a bridged message and when it was sent.
+// The text of sent email is stored in the database, while the text of
+// received email is fetched from the Matrix event.
+func (portal *Portal) getMessageText(ctx context.Context, target *database.Message) (string, time.Time) {
+	log := zerolog.Ctx(ctx)
+	sent, err := portal.bridge.DB.SentMessage.GetByMXID(ctx, target.MXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get text of replied-to message")
+	} else if sent != nil && sent.Text != "" {
+		return sent.Text, sent.SentAt
+	}
+	evt, err := portal.bridge.getMessageEvent(ctx, target.RoomID, target.MXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get replied-to message for quoting")
+		return "", time.Time{}
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return "", time.Time{}
+	}
+	content.RemoveReplyFallback()
+	text := content.Body
+	if isMediaMessage(content) {
+		text = mediaCaption(content)
+	}
+	return text, time.UnixMilli(evt.Timestamp)
+}
+
+// messageSenderName returns the name and address of the sender of a message
+// for the attribution line of a reply.
+func (portal *Portal) messageSenderName(msg *database.Message) string {
+	puppet := portal.bridge.GetPuppetByEmailAddressIfExists(msg.Sender)
+	if puppet == nil || puppet.Name == "" || puppet.Name == msg.Sender {
+		return msg.Sender
+	}
+	return fmt.Sprintf("%s <%s>", puppet.Name, msg.Sender)
+}
+
+// quoteText prefixes each line of the text with "> ".
+func quoteText(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	for i, line := range lines {
+		switch {
+		case line == "":
+			lines[i] = ">"
+		case strings.HasPrefix(line, ">"):
+			lines[i] = ">" + line
+		default:
+			lines[i] = "> " + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
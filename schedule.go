@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// sendAtKey is the custom content key that Matrix clients can use to ask the
+// bridge to send a message later. The value is a unix timestamp in milliseconds.
+const sendAtKey = "net.maunium.imap-bridge.send_at"
+
+var (
+	errMessageScheduled = errors.New("message scheduled")
+	errInvalidSendTime  = errors.New("invalid send time")
+	errSendTimeInPast   = errors.New("send time is in the past")
+)
+
+// getSendAtHint returns the time a Matrix message asked to be sent at, or a
+// zero time if it should be sent immediately.
+func getSendAtHint(evt *event.Event) time.Time {
+	ts, ok := evt.Content.Raw[sendAtKey].(float64)
+	if !ok || ts <= 0 {
+		return time.Time{}
+	}
+	sendAt := time.UnixMilli(int64(ts))
+	if !sendAt.After(time.Now()) {
+		return time.Time{}
+	}
+	return sendAt
+}
+
+var dayDurationRegex = regexp.MustCompile(`^(\d+)d(.*)$`)
+
+// parseRelativeSendTime parses durations like 2h30m, with an optional day
+// count in front, e.g. 1d or 2d12h.
+func parseRelativeSendTime(input string) (time.Duration, error) {
+	var days time.Duration
+	if match := dayDurationRegex.FindStringSubmatch(input); match != nil {
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			return 0, err
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		input = match[2]
+		if input == "" {
+			return days, nil
+		}
+	}
+	dur, err := time.ParseDuration(input)
+	if err != nil {
+		return 0, err
+	}
+	return days + dur, nil
+}
+
+// parseSendTime parses the time argument of the schedule command. It accepts
+// durations (+2h, 1d), times of day (15:04, the next such time) and dates
+// with a time, which are interpreted in the bridge's local time zone.
+func parseSendTime(input string, now time.Time) (time.Time, error) {
+	input = strings.TrimSpace(input)
+	if dur, err := parseRelativeSendTime(strings.TrimPrefix(input, "+")); err == nil {
+		if dur <= 0 {
+			return time.Time{}, errSendTimeInPast
+		}
+		return now.Add(dur), nil
+	}
+	if clock, err := time.ParseInLocation("15:04", input, now.Location()); err == nil {
+		sendAt := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+		if !sendAt.After(now) {
+			sendAt = sendAt.AddDate(0, 0, 1)
+		}
+		return sendAt, nil
+	}
+	if sendAt, err := time.Parse(time.RFC3339, input); err == nil {
+		return checkSendTime(sendAt, now)
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04"} {
+		if sendAt, err := time.ParseInLocation(layout, input, now.Location()); err == nil {
+			return checkSendTime(sendAt, now)
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w %q", errInvalidSendTime, input)
+}
+
+func checkSendTime(sendAt, now time.Time) (time.Time, error) {
+	if !sendAt.After(now) {
+		return time.Time{}, errSendTimeInPast
+	}
+	return sendAt, nil
+}
+
+func formatSendTime(sendAt time.Time) string {
+	return sendAt.Local().Format("2006-01-02 15:04 MST")
+}
+
+// cutArg splits the first whitespace-separated argument from the rest of a
+// command, keeping the formatting of the rest.
+func cutArg(input string) (arg, rest string) {
+	input = strings.TrimLeftFunc(input, unicode.IsSpace)
+	idx := strings.IndexFunc(input, unicode.IsSpace)
+	if idx < 0 {
+		return input, ""
+	}
+	return input[:idx], strings.TrimLeftFunc(input[idx:], unicode.IsSpace)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+
+	"imap-bridge/pkg/managesieve"
+)
+
+// maxSieveScriptSize is the largest script file that will be downloaded from Matrix.
+const maxSieveScriptSize = 1024 * 1024
+
+var errNoSieveScript = errors.New("no script found, send it in a code block or reply to a file")
+
+// sieveAddress returns the ManageSieve server of the user, which is assumed
+// to run on the IMAP host.
+func (user *User) sieveAddress() string {
+	imapServer := user.serverSettings().Fill(user.EmailAddress).IMAPServer
+	host, _, err := net.SplitHostPort(imapServer)
+	if err != nil {
+		host = imapServer
+	}
+	return net.JoinHostPort(host, managesieve.DefaultPort)
+}
+
+// newSieveClient connects and logs into the user's ManageSieve server. The
+// caller must call Logout on the returned client.
+func (user *User) newSieveClient(ctx context.Context) (*managesieve.Client, error) {
+	addr := user.sieveAddress()
+	host, _, _ := net.SplitHostPort(addr)
+	client, err := managesieve.Dial(ctx, addr, &tls.Config{ServerName: host})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	err = client.Authenticate(user.EmailAddress, user.Password)
+	if err != nil {
+		_ = client.Logout()
+		return nil, fmt.Errorf("failed to log in: %w", err)
+	}
+	return client, nil
+}
+
+// extractCodeBlock returns the content of the first fenced code block in the
+// text, or the whole text if it doesn't contain one.
+func extractCodeBlock(text string) string {
+	start := strings.Index(text, "```")
+	if start < 0 {
+		return strings.TrimSpace(text)
+	}
+	text = text[start+3:]
+	// Skip the language tag on the opening fence
+	if newline := strings.IndexByte(text, '\n'); newline >= 0 {
+		text = text[newline+1:]
+	}
+	if end := strings.Index(text, "```"); end >= 0 {
+		text = text[:end]
+	}
+	return text
+}
+
+// getSieveScript finds the script to upload in a command. The script can
+// either be a file that the command replies to, or a code block on the
+// lines after the command.
+func getSieveScript(ce *WrappedCommandEvent) (string, error) {
+	if ce.ReplyTo != "" {
+		return downloadSieveScript(ce)
+	}
+	_, rest, found := strings.Cut(ce.RawArgs, "\n")
+	if !found {
+		return "", errNoSieveScript
+	}
+	script := extractCodeBlock(rest)
+	if script == "" {
+		return "", errNoSieveScript
+	}
+	return script, nil
+}
+
+func downloadSieveScript(ce *WrappedCommandEvent) (string, error) {
+	evt, err := ce.Bridge.getMessageEvent(ce.Ctx, ce.RoomID, ce.ReplyTo)
+	if err != nil {
+		return "", fmt.Errorf("failed to get replied-to message: %w", err)
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return "", errNoSieveScript
+	} else if content.MsgType != event.MsgFile {
+		script := extractCodeBlock(content.Body)
+		if script == "" {
+			return "", errNoSieveScript
+		}
+		return script, nil
+	} else if content.Info != nil && content.Info.Size > maxSieveScriptSize {
+		return "", fmt.Errorf("script file is larger than %d bytes", maxSieveScriptSize)
+	}
+	mxc := content.URL
+	if content.File != nil {
+		mxc = content.File.URL
+	}
+	parsedMXC, err := mxc.Parse()
+	if err != nil {
+		return "", fmt.Errorf("invalid file URL: %w", err)
+	}
+	data, err := ce.Bot.DownloadBytes(ce.Ctx, parsedMXC)
+	if err != nil {
+		return "", fmt.Errorf("failed to download script file: %w", err)
+	}
+	if content.File != nil {
+		data, err = content.File.Decrypt(data)
+		if err != nil {
+			return "", fmt.Errorf("failed to decrypt script file: %w", err)
+		}
+	}
+	return string(data), nil
+}
+
+// formatSieveError returns the error message of the server, which includes
+// syntax errors for uploaded scripts.
+func formatSieveError(err error) string {
+	var respErr *managesieve.ResponseError
+	if errors.As(err, &respErr) && respErr.Message != "" {
+		return fmt.Sprintf("```\n%s\n```", respErr.Message)
+	}
+	return err.Error()
+}
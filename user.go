@@ -3,14 +3,17 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
+	"imap-bridge/config"
 	"imap-bridge/database"
 	"imap-bridge/pkg/emailmeow"
+	"imap-bridge/pkg/emailmeow/events"
 
-	"github.com/emersion/go-imap/v2/imapclient"
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
@@ -18,6 +21,7 @@ import (
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -36,6 +40,14 @@ type User struct {
 
 	BridgeState *bridge.BridgeStateQueue
 
+	contactSyncCancel context.CancelFunc
+	contactSyncLock   sync.Mutex
+
+	filterRules     []*filterRule
+	filterRulesLock sync.Mutex
+
+	readReceiptLock sync.Mutex
+
 	spaceMembershipChecked bool
 	spaceCreateLock        sync.Mutex
 }
@@ -57,6 +69,12 @@ func (br *IMAPBridge) GetUserByMXIDIfExists(userID id.UserID) *User {
 	return br.maybeGetUserByMXID(userID, nil)
 }
 
+func (br *IMAPBridge) GetCachedUserByEmailAddress(address string) *User {
+	br.usersLock.Lock()
+	defer br.usersLock.Unlock()
+	return br.usersByEmailAddress[address]
+}
+
 func (br *IMAPBridge) maybeGetUserByMXID(userID id.UserID, userIDPtr *id.UserID) *User {
 	if userID == br.Bot.UserID || br.IsGhost(userID) {
 		return nil
@@ -77,8 +95,11 @@ func (br *IMAPBridge) maybeGetUserByMXID(userID id.UserID, userIDPtr *id.UserID)
 }
 
 func (user *User) GetIDoublePuppet() bridge.DoublePuppet {
-	// TODO
-	return nil
+	p := user.bridge.GetPuppetByCustomMXID(user.MXID)
+	if p == nil || p.customIntent == nil {
+		return nil
+	}
+	return p
 }
 
 func (user *User) GetIGhost() bridge.Ghost {
@@ -129,42 +150,367 @@ func (user *User) SetManagementRoom(roomID id.RoomID) {
 	}
 }
 
+func (user *User) serverSettings() emailmeow.ServerSettings {
+	return emailmeow.ServerSettings{
+		IMAPServer: user.IMAPServer,
+		SMTPServer: user.SMTPServer,
+	}
+}
+
+func (user *User) newClient(address, password string, settings emailmeow.ServerSettings) *emailmeow.Client {
+	cli := emailmeow.NewClient(address, password, settings)
+	cli.Zlog = user.log.With().Str("component", "emailmeow").Logger()
+	cli.EventHandler = user.eventHandler
+	return cli
+}
+
 func (user *User) Connect() {
+	if user.EmailAddress == "" || user.Password == "" {
+		user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBadCredentials, Error: "imap-no-credentials"})
+		return
+	}
 	user.log.Debug().Msg("Connecting user")
-	log := user.log.With().Str("component", "messagix").Logger()
-	cli := emailmeow.NewClient(user.EmailAddress, user.Password)
-	cli.Zlog = log
-	cli.EventHandler = user.eventHandler
+	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting})
+	cli := user.newClient(user.EmailAddress, user.Password, user.serverSettings())
+	err := cli.Login(user.log.WithContext(context.TODO()), user.EmailAddress, user.Password)
+	if err != nil {
+		user.log.Err(err).Msg("Failed to connect to email servers")
+		user.BridgeState.Send(status.BridgeState{
+			StateEvent: status.StateUnknownError,
+			Error:      "imap-connect-failed",
+			Message:    err.Error(),
+		})
+		return
+	}
+	user.Lock()
 	user.Client = cli
+	user.Unlock()
+	cli.StartReceiveLoops(context.Background())
+	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+	user.tryAutomaticDoublePuppeting()
+	user.startContactSync()
 	// TODO maybe add user.lastFullReconnect = time.Now() ?
 }
 
-func (user *User) eventHandler(evt *imapclient.UnilateralDataMailbox) {
-	// Note that part here represents mail.Part from go-message/mail
-	// Which is an entire mail message
-	lastReceivedMessage, err := user.Client.FetchLastMessagePart()
-	if err != nil {
-		user.log.Warn().Msg("Couldn't get message, dropping!")
+const reconnectDelay = 30 * time.Second
+
+func (user *User) handleDisconnected(evt *events.Disconnected) {
+	user.Lock()
+	cli := user.Client
+	user.Client = nil
+	user.Unlock()
+	user.BridgeState.Send(status.BridgeState{
+		StateEvent: status.StateTransientDisconnect,
+		Error:      "imap-disconnected",
+		Message:    evt.Err.Error(),
+	})
+	go func() {
+		if cli != nil {
+			_ = cli.Logout()
+		}
+		time.Sleep(reconnectDelay)
+		if user.EmailAddress != "" && !user.IsLoggedIn() {
+			user.Connect()
+		}
+	}()
+}
+
+func (user *User) eventHandler(rawEvt any) {
+	switch evt := rawEvt.(type) {
+	case *events.Message:
+		user.handleMessage(evt)
+	case *events.FlagsChanged:
+		user.handleFlagsChanged(evt)
+	case *events.Disconnected:
+		user.handleDisconnected(evt)
+	default:
+		user.log.Warn().Type("event_type", evt).Msg("Unhandled email event")
+	}
+}
+
+func (user *User) handleMessage(msg *events.Message) {
+	if msg.DeliveryReport != nil && user.handleDeliveryReport(msg) {
+		return
+	} else if msg.DispositionNotification != nil && user.handleDispositionNotification(msg) {
+		return
+	}
+	if msg.Info.Sender == "" {
+		user.log.Warn().Str("email_message_id", msg.Info.MessageID).Msg("Failed to parse From header field, dropping message")
+		return
+	} else if msg.Sent && msg.Info.Sender != user.EmailAddress {
+		user.log.Debug().Str("email_message_id", msg.Info.MessageID).Msg("Dropping mail in sent mailbox from another address")
 		return
 	}
 
-	sender_address := string(lastReceivedMessage.Header.Get("From"))
-	if sender_address == "" {
-		// user.log.Err(errors.New("Failed to parse")).Msg("failed to parse From header field, dropping")
-		// return
-		user.log.Warn().Msg("failed to parse From header field")
-		sender_address = "unknown"
+	if msg.Info.Automated == events.AutomatedLoop {
+		user.log.Debug().Str("email_message_id", msg.Info.MessageID).Msg("Dropping mail sent by the bridge")
+		return
+	}
+
+	var portal *Portal
+	var silent bool
+	if rule := user.matchFilterRule(msg); rule != nil {
+		log := user.log.With().
+			Str("email_message_id", msg.Info.MessageID).
+			Int("filter_rule", rule.Priority).
+			Str("filter_action", rule.Action).
+			Logger()
+		log.Debug().Msg("Message matched filter rule")
+		switch filterAction(rule.Action) {
+		case filterActionIgnore:
+			return
+		case filterActionMove:
+			go user.moveMessage(log, msg.UID, rule.Target)
+			return
+		case filterActionRead:
+			if !msg.Seen {
+				msg.Seen = true
+				go user.markSeen(log, msg.UID)
+			}
+		case filterActionSilent:
+			silent = true
+		case filterActionRoom:
+			portal = user.bridge.GetPortalByMXID(id.RoomID(rule.Target))
+			if portal == nil || portal.Receiver != user.EmailAddress {
+				log.Warn().Str("target_room", rule.Target).Msg("Filter rule target room is not a portal of the user")
+				portal = nil
+			}
+		}
 	}
 
-	portal := user.GetPortalByThreadID(sender_address)
+	if msg.Info.Automated != "" && portal == nil && !silent {
+		log := user.log.With().
+			Str("email_message_id", msg.Info.MessageID).
+			Str("automated_reason", string(msg.Info.Automated)).
+			Logger()
+		if msg.Sent {
+			// e.g. vacation replies, which would otherwise show up as
+			// messages the user sent
+			log.Debug().Msg("Dropping automated mail in sent mailbox")
+			return
+		}
+		switch user.bridge.Config.Bridge.AutomatedMail {
+		case config.AutomatedMailDrop:
+			log.Debug().Msg("Dropping automated mail")
+			return
+		case config.AutomatedMailManagementRoom:
+			if user.ManagementRoom != "" {
+				user.sendAutomatedMailNotice(log.WithContext(context.TODO()), msg)
+				return
+			}
+			silent = true
+		default:
+			silent = true
+		}
+	}
 
+	if portal == nil {
+		portal = user.getPortalForMessage(msg)
+	}
 	if portal != nil {
-		portal.emailMessages <- portalEmailMessage{user: user, message: &lastReceivedMessage}
+		portal.emailMessages <- portalEmailMessage{user: user, message: msg, silent: silent}
+	}
+}
+
+// deliveryFailureError describes the failed recipients of a delivery report,
+// preferring the diagnostic message of the remote server.
+func deliveryFailureError(msg *events.Message, failed []events.DeliveryStatus) error {
+	details := make([]string, len(failed))
+	for i, rcpt := range failed {
+		reason := rcpt.Diagnostic
+		if reason == "" {
+			reason = rcpt.Status
+		}
+		if reason == "" {
+			// Fall back to the first line of the human-readable part
+			reason, _, _ = strings.Cut(strings.TrimSpace(msg.Text), "\n")
+		}
+		details[i] = fmt.Sprintf("%s: %s", rcpt.Recipient, strings.TrimSpace(reason))
+	}
+	return fmt.Errorf("%w to %s", errDeliveryFailed, strings.Join(details, "; "))
+}
+
+// handleDeliveryReport maps a delivery status notification to the message
+// status of the Matrix event that the bounced email was sent from. It returns
+// false if the report isn't about a message sent through the bridge.
+func (user *User) handleDeliveryReport(msg *events.Message) bool {
+	report := msg.DeliveryReport
+	log := user.log.With().
+		Str("action", "handle delivery report").
+		Str("email_message_id", msg.Info.MessageID).
+		Str("original_email_message_id", report.OriginalMessageID).
+		Logger()
+	ctx := log.WithContext(context.TODO())
+	if report.OriginalMessageID == "" {
+		log.Debug().Msg("Delivery report doesn't reference original message")
+		return false
+	}
+	original, err := user.bridge.DB.Message.GetByEmailMessageID(ctx, user.EmailAddress, report.OriginalMessageID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get original message of delivery report")
+		return false
+	} else if original == nil || original.Sender != user.EmailAddress {
+		log.Debug().Msg("Delivery report is not about a bridged message")
+		return false
+	}
+	failed := report.Failed()
+	if len(failed) == 0 {
+		log.Debug().Msg("Delivery report doesn't contain failures")
+		return true
+	}
+	portal := user.bridge.GetPortalByMXID(original.RoomID)
+	if portal == nil {
+		log.Warn().Stringer("room_id", original.RoomID).Msg("Portal of bounced message not found")
+		return true
+	}
+	log.Debug().Stringer("event_id", original.MXID).Msg("Marking bounced message as failed")
+	portal.sendDeliveryFailure(ctx, original, deliveryFailureError(msg, failed))
+	return true
+}
+
+// sendAutomatedMailNotice summarizes automatically generated mail in the
+// management room instead of bridging it into a portal.
+func (user *User) sendAutomatedMailNotice(ctx context.Context, msg *events.Message) {
+	body := msg.Text
+	if body == "" && msg.HTML != "" {
+		body = format.HTMLToText(msg.HTML)
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Automated email (%s) from %s", msg.Info.Automated, msg.Info.Sender))
+	if msg.Info.ThreadName != "" {
+		sb.WriteString(": ")
+		sb.WriteString(msg.Info.ThreadName)
+	}
+	if body = strings.TrimSpace(body); body != "" {
+		sb.WriteString("\n\n")
+		sb.WriteString(body)
+	}
+	_, err := user.bridge.Bot.SendMessageEvent(ctx, user.ManagementRoom, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    sb.String(),
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to send automated mail to management room")
+	}
+}
+
+// getPortalForMessage finds the portal that an incoming email belongs to
+// based on its headers and the user's portal mode.
+func (user *User) getPortalForMessage(msg *events.Message) *Portal {
+	if msg.Info.List != nil {
+		portal := user.GetListPortal(msg.Info.List.ID)
+		if portal == nil {
+			user.log.Warn().Str("list_id", msg.Info.List.ID).Msg("Couldn't get list portal, dropping message")
+		}
+		return portal
+	}
+
+	chatWith := msg.Info.Sender
+	if chatWith == user.EmailAddress {
+		// Mail sent by the user from another client goes in the chat with the recipient
+		if len(msg.Info.Recipients) == 0 {
+			user.log.Debug().Str("email_message_id", msg.Info.MessageID).Msg("Dropping own message without recipients")
+			return nil
+		}
+		chatWith = msg.Info.Recipients[0]
+	}
+
+	var portal *Portal
+	if user.GetPortalMode() == config.PortalModeThread && msg.Info.ThreadID != "" {
+		portal = user.GetThreadPortal(msg.Info.ThreadID, chatWith)
 	} else {
-		user.log.Warn().Str("thread_id", sender_address).Msg("Couldn't get portal, dropping message")
+		portal = user.GetPortalByEmailAddress(chatWith)
+	}
+	if portal == nil {
+		user.log.Warn().Str("thread_id", chatWith).Msg("Couldn't get portal, dropping message")
+	}
+	return portal
+}
+
+const roomTagFavourite = "m.favourite"
+
+// handleFlagsChanged mirrors read and flag changes made in other mail clients
+// using the user's double puppet. The room is a favourite while any of its
+// messages are flagged.
+func (user *User) handleFlagsChanged(evt *events.FlagsChanged) {
+	doublePuppet := user.GetIDoublePuppet()
+	if doublePuppet == nil {
+		return
+	}
+	intent := doublePuppet.CustomIntent()
+	log := user.log.With().
+		Str("action", "handle flags change").
+		Str("email_message_id", evt.MessageID).
+		Logger()
+	ctx := log.WithContext(context.TODO())
+	msg, err := user.bridge.DB.Message.GetByEmailMessageID(ctx, user.EmailAddress, evt.MessageID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get message from database")
+		return
+	} else if msg == nil || msg.RoomID == "" {
+		log.Debug().Msg("Flags changed for unknown message")
+		return
+	}
+	if evt.Seen {
+		err = intent.MarkRead(ctx, msg.RoomID, msg.MXID)
+		if err != nil {
+			log.Err(err).Msg("Failed to mark message as read with double puppet")
+		}
+	}
+	if evt.Flagged == msg.Flagged {
+		return
+	}
+	err = msg.SetFlagged(ctx, evt.Flagged)
+	if err != nil {
+		log.Err(err).Msg("Failed to save flagged state of message")
+		return
+	}
+	portal := user.bridge.GetPortalByMXID(msg.RoomID)
+	if portal == nil {
+		return
+	}
+	user.updateFavouriteTag(ctx, intent, portal)
+}
+
+// updateFavouriteTag favourites the portal while it has flagged messages.
+// The tag is only removed if the bridge added it, so rooms the user
+// favourited themselves stay favourites.
+func (user *User) updateFavouriteTag(ctx context.Context, intent *appservice.IntentAPI, portal *Portal) {
+	log := zerolog.Ctx(ctx)
+	flagged, err := user.bridge.DB.Message.CountFlagged(ctx, portal.PortalKey)
+	if err != nil {
+		log.Err(err).Msg("Failed to count flagged messages in portal")
+		return
+	}
+	switch {
+	case flagged > 0 && !portal.FavouriteSet:
+		tags, err := intent.GetTags(ctx, portal.MXID)
+		if err != nil {
+			log.Err(err).Msg("Failed to get room tags with double puppet")
+			return
+		} else if _, ok := tags.Tags[roomTagFavourite]; ok {
+			return
+		}
+		err = intent.AddTag(ctx, portal.MXID, roomTagFavourite, 0.5)
+		if err != nil {
+			log.Err(err).Msg("Failed to add favourite tag with double puppet")
+			return
+		}
+		portal.FavouriteSet = true
+	case flagged == 0 && portal.FavouriteSet:
+		err = intent.RemoveTag(ctx, portal.MXID, roomTagFavourite)
+		if err != nil {
+			log.Err(err).Msg("Failed to remove favourite tag with double puppet")
+			return
+		}
+		portal.FavouriteSet = false
+	default:
+		return
+	}
+	err = portal.Update(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to save portal after updating favourite tag")
 	}
-	content := &event.MessageEventContent{MsgType: event.MsgNotice}
-	portal.sendMainIntentMessage(context.TODO(), content)
 }
 
 func (user *User) ensureInvited(ctx context.Context, intent *appservice.IntentAPI, roomID id.RoomID, isDirect bool) (ok bool) {
@@ -210,12 +556,20 @@ func (user *User) ensureInvited(ctx context.Context, intent *appservice.IntentAP
 
 func (user *User) syncChatDoublePuppetDetails(portal *Portal, justCreated bool) {
 	doublePuppet := portal.bridge.GetPuppetByCustomMXID(user.MXID)
-	if doublePuppet == nil {
+	if doublePuppet == nil || doublePuppet.CustomIntent() == nil || len(portal.MXID) == 0 {
 		return
 	}
-	if doublePuppet == nil || doublePuppet.CustomIntent() == nil || len(portal.MXID) == 0 {
+	ctx := portal.log.WithContext(context.TODO())
+	err := doublePuppet.CustomIntent().EnsureJoined(ctx, portal.MXID)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to ensure double puppet is joined to portal")
 		return
 	}
+	if justCreated && portal.IsPrivateChat() {
+		user.UpdateDirectChats(ctx, map[id.UserID][]id.RoomID{
+			portal.MainIntent().UserID: {portal.MXID},
+		})
+	}
 }
 
 func (user *User) UpdateDirectChats(ctx context.Context, chats map[id.UserID][]id.RoomID) {
@@ -223,7 +577,7 @@ func (user *User) UpdateDirectChats(ctx context.Context, chats map[id.UserID][]i
 		return
 	}
 
-	puppet := user.bridge.GetPuppetByMXID(user.MXID)
+	puppet := user.bridge.GetPuppetByCustomMXID(user.MXID)
 	if puppet == nil {
 		return
 	}
@@ -350,7 +704,7 @@ func (user *User) getDirectChats() map[id.UserID][]id.RoomID {
 	return chats
 }
 
-func (user *User) Login(ctx context.Context, address string, password string) (string, error) {
+func (user *User) Login(ctx context.Context, address string, password string, settings emailmeow.ServerSettings) (string, error) {
 	if address == "" {
 		reply := "Can't login with empty address"
 		return reply, errors.New(reply)
@@ -361,24 +715,67 @@ func (user *User) Login(ctx context.Context, address string, password string) (s
 		return reply, errors.New(reply)
 	}
 
-	user.EmailAddress = address
-	user.Password = password
-	mailClient := emailmeow.NewClient(address, password)
+	settings = settings.Fill(address)
+	mailClient := user.newClient(address, password, settings)
 	err := mailClient.Login(ctx, address, password)
 	if err != nil {
 		return "Couldn't login check logs", err
 	}
 
+	user.Lock()
 	user.Client = mailClient
+	user.EmailAddress = address
+	user.Password = password
+	user.IMAPServer = settings.IMAPServer
+	user.SMTPServer = settings.SMTPServer
+	user.Unlock()
+
+	user.bridge.usersLock.Lock()
+	user.bridge.usersByEmailAddress[address] = user
+	user.bridge.usersLock.Unlock()
 
 	err = user.Update(ctx)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to save user's email and password")
 	}
+	mailClient.StartReceiveLoops(context.Background())
+	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+	user.tryAutomaticDoublePuppeting()
+	user.startContactSync()
 
 	return "Login successful", nil
 }
 
+func (user *User) Logout(ctx context.Context) {
+	user.stopContactSync()
+	user.Lock()
+	if user.Client != nil {
+		err := user.Client.Logout()
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Error while disconnecting from email servers")
+		}
+		user.Client = nil
+	}
+	oldAddress := user.EmailAddress
+	user.EmailAddress = ""
+	user.Password = ""
+	user.IMAPServer = ""
+	user.SMTPServer = ""
+	user.Unlock()
+
+	user.bridge.usersLock.Lock()
+	if user.bridge.usersByEmailAddress[oldAddress] == user {
+		delete(user.bridge.usersByEmailAddress, oldAddress)
+	}
+	user.bridge.usersLock.Unlock()
+
+	err := user.Update(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to clear user's email and password")
+	}
+	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateLoggedOut})
+}
+
 func (br *IMAPBridge) GetAllLoggedInUsers() []*User {
 	br.usersLock.Lock()
 	defer br.usersLock.Unlock()
@@ -464,9 +861,100 @@ func (br *IMAPBridge) NewUser(dbUser *database.User) *User {
 	return user
 }
 
-func (user *User) GetPortalByThreadID(address string) *Portal {
-	return user.bridge.GetPortalByThreadID(database.PortalKey{
-		ThreadID: address,
-		Receiver: address,
-	})
+func (user *User) privateChatKey(address string) database.PortalKey {
+	return database.NewPortalKey(address, user.EmailAddress)
+}
+
+func (user *User) GetPortalByEmailAddress(address string) *Portal {
+	portal := user.bridge.GetPortalByThreadID(user.privateChatKey(address))
+	if portal != nil && portal.EmailAddress == "" {
+		portal.EmailAddress = address
+		err := portal.Update(context.TODO())
+		if err != nil {
+			portal.log.Err(err).Msg("Failed to save email address of private chat portal")
+		}
+	}
+	return portal
+}
+
+// GetListPortal finds the group portal of a mailing list.
+func (user *User) GetListPortal(listID string) *Portal {
+	return user.bridge.GetPortalByThreadID(database.NewPortalKey(listPortalPrefix+listID, user.EmailAddress))
+}
+
+// GetThreadPortal finds the portal of an email thread in room-per-thread mode.
+// Threads that were started from an existing portal stay in that portal.
+func (user *User) GetThreadPortal(threadID, address string) *Portal {
+	ctx := context.TODO()
+	key := database.NewPortalKey(threadID, user.EmailAddress)
+	threadMsg, err := user.bridge.DB.Message.GetAnyInEmailThread(ctx, user.EmailAddress, threadID)
+	if err != nil {
+		user.log.Err(err).Str("email_thread_id", threadID).Msg("Failed to find existing portal of email thread")
+	} else if threadMsg != nil {
+		key = database.NewPortalKey(threadMsg.EmailAddress, threadMsg.EmailReceiver)
+	}
+	portal := user.bridge.GetPortalByThreadID(key)
+	if portal != nil && portal.EmailAddress == "" {
+		portal.EmailAddress = address
+		err = portal.Update(ctx)
+		if err != nil {
+			portal.log.Err(err).Msg("Failed to save email address of thread portal")
+		}
+	}
+	return portal
+}
+
+// GetPortalMode returns the user's portal mode, falling back to the bridge default.
+func (user *User) GetPortalMode() config.PortalMode {
+	if mode := config.PortalMode(user.PortalMode); mode.IsValid() {
+		return mode
+	}
+	return user.bridge.Config.Bridge.PortalMode
+}
+
+// GetQuotedText returns what to do with quoted text in the user's incoming
+// email, falling back to the bridge default.
+func (user *User) GetQuotedText() config.QuotedTextAction {
+	if action := config.QuotedTextAction(user.QuotedText); action.IsValid() {
+		return action
+	}
+	return user.bridge.Config.Bridge.QuotedText
+}
+
+// GetUndoSendDelay returns how long the user's email waits in the outbox
+// before being sent, falling back to the bridge default.
+func (user *User) GetUndoSendDelay() time.Duration {
+	if delay, err := time.ParseDuration(user.UndoSendDelay); err == nil && delay >= 0 {
+		return delay
+	}
+	return user.bridge.Config.Bridge.UndoSendDelay
+}
+
+// GetOrCreatePrivateChat finds the private chat portal with the given address,
+// creating the portal and its Matrix room if they don't exist yet.
+// If subject is set, it's used for the next email sent in the portal.
+func (user *User) GetOrCreatePrivateChat(ctx context.Context, address, subject string) (portal *Portal, justCreated bool, err error) {
+	portal = user.GetPortalByEmailAddress(address)
+	if portal == nil {
+		return nil, false, errPortalNotFound
+	}
+	if subject != "" {
+		if portal.MXID == "" {
+			portal.Name = subject
+			portal.Topic = subject
+		}
+		err = portal.startNewThread(ctx, subject)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to save subject: %w", err)
+		}
+	}
+	if portal.MXID != "" {
+		portal.ensureUserInvited(ctx, user)
+		return portal, false, nil
+	}
+	err = portal.CreateMatrixRoom(ctx, user, address)
+	if err != nil {
+		return nil, false, err
+	}
+	return portal, true, nil
 }